@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/db"
+	"grandfather/internal/ui"
+	"grandfather/utils"
+	"html"
+	"log"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// notifyMember queues a message from the bot for one member of the circle.
+func (h *Handlers) notifyMember(ctx context.Context, circle *appModels.Circle, userId int64, text string, buttons [][]ui.MenuButton) error {
+	return h.store.CreateNotifications(ctx, []*appModels.Message{{
+		RecepientId: userId,
+		CircleName:  circle.Name,
+		Message:     text,
+		ParseMode:   string(models.ParseModeHTML),
+		Buttons:     buttons,
+	}})
+}
+
+func (h *Handlers) showAdmins(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, circle *appModels.Circle, note string) {
+	names, err := h.memberNames(ctx, circle)
+	if err != nil {
+		fmt.Printf("failed to get users for circle %s: %v\n", circle.Name, err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	title := fmt.Sprintf("👥 Circle: %s\n⭐ Admins can start and end sessions and remove members.\nPress a member to make them an admin, or an admin to make them a member again.", circle.Name)
+	if note != "" {
+		title = note + "\n\n" + title
+	}
+
+	adminsMenu := ui.Menu{
+		Title:   title,
+		Buttons: [][]ui.MenuButton{},
+	}
+	for _, id := range circle.Members {
+		switch circle.RoleOf(id) {
+		case appModels.RoleAdmin:
+			adminsMenu.AddButtonRow("⭐ "+names[id], commands.Encode(commands.DemoteAdminCommand, circle.ID, id))
+		case appModels.RoleMember:
+			adminsMenu.AddButtonRow(names[id], commands.Encode(commands.PromoteAdminCommand, circle.ID, id))
+		}
+	}
+	adminsMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, circle.ID))
+	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, adminsMenu)
+}
+
+func (h *Handlers) ManageAdminsCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Manage admins")
+
+	_, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	h.showAdmins(ctx, b, update, chatID, circle, "")
+}
+
+// PromoteAdminCommandHandler makes a member an admin and lets them know.
+func (h *Handlers) PromoteAdminCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, userId int64) {
+	fmt.Println("Promote admin")
+
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	updatedCircle, addErr := h.store.AddCircleAdmin(ctx, circleId, userId)
+	if errors.Is(addErr, db.ErrNotFound) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "That person is no longer a member of this circle.")
+		return
+	}
+	if addErr != nil {
+		fmt.Printf("failed to add admin to circle %s: %v\n", circleId.Hex(), addErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+	log.Printf("audit: user %d (@%s) made user %d an admin of circle %s (%s)\n",
+		user.ID, user.Username, userId, updatedCircle.ID.Hex(), updatedCircle.Name)
+
+	text := fmt.Sprintf("⭐ You are now an admin of circle <b>%s</b>. You can start and end sessions and remove members.", html.EscapeString(updatedCircle.Name))
+	if notifyErr := h.notifyMember(ctx, updatedCircle, userId, text, nil); notifyErr != nil {
+		fmt.Printf("failed to queue admin notification for circle %s: %v\n", updatedCircle.Name, notifyErr)
+	}
+
+	h.showAdmins(ctx, b, update, chatID, updatedCircle, "✅ Admin added.")
+}
+
+// DemoteAdminCommandHandler makes an admin an ordinary member again.
+func (h *Handlers) DemoteAdminCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, userId int64) {
+	fmt.Println("Demote admin")
+
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	updatedCircle, removeErr := h.store.RemoveCircleAdmin(ctx, circleId, userId)
+	if removeErr != nil {
+		fmt.Printf("failed to remove admin from circle %s: %v\n", circleId.Hex(), removeErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+	log.Printf("audit: user %d (@%s) removed user %d as an admin of circle %s (%s)\n",
+		user.ID, user.Username, userId, updatedCircle.ID.Hex(), updatedCircle.Name)
+
+	if updatedCircle.RoleOf(userId) == appModels.RoleMember {
+		text := fmt.Sprintf("You are no longer an admin of circle <b>%s</b>.", html.EscapeString(updatedCircle.Name))
+		if notifyErr := h.notifyMember(ctx, updatedCircle, userId, text, nil); notifyErr != nil {
+			fmt.Printf("failed to queue admin notification for circle %s: %v\n", updatedCircle.Name, notifyErr)
+		}
+	}
+
+	h.showAdmins(ctx, b, update, chatID, updatedCircle, "🗑 Admin removed.")
+}
+
+// TransferOwnershipCommandHandler lets the owner pick who should take over
+// the circle, then offers it to them. Nothing changes until they accept.
+func (h *Handlers) TransferOwnershipCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, newOwnerId int64) {
+	fmt.Println("Transfer ownership")
+
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	names, err := h.memberNames(ctx, circle)
+	if err != nil {
+		fmt.Printf("failed to get users for circle %s: %v\n", circle.Name, err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	transferMenu := ui.Menu{Buttons: [][]ui.MenuButton{}}
+
+	if newOwnerId == 0 {
+		transferMenu.Title = fmt.Sprintf("👥 Circle: %s\nWho should become the new owner? They have to accept before anything changes.", circle.Name)
+		for _, id := range circle.Members {
+			if id != circle.OwnerId {
+				transferMenu.AddButtonRow(names[id], commands.Encode(commands.TransferOwnershipCommand, circle.ID, id))
+			}
+		}
+		transferMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, circle.ID))
+		utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, transferMenu)
+		return
+	}
+
+	updatedCircle, offerErr := h.store.OfferCircleOwnership(ctx, circle.ID, newOwnerId)
+	if errors.Is(offerErr, db.ErrNotFound) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "That person is no longer a member of this circle.")
+		return
+	}
+	if offerErr != nil {
+		fmt.Printf("failed to offer circle %s: %v\n", circle.Name, offerErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+	log.Printf("audit: user %d (@%s) offered ownership of circle %s (%s) to user %d\n",
+		user.ID, user.Username, updatedCircle.ID.Hex(), updatedCircle.Name, newOwnerId)
+
+	text := fmt.Sprintf(
+		"👑 %s would like you to take over as the owner of circle <b>%s</b>.\n\nIf you accept, they will stay on as an admin.",
+		html.EscapeString(names[user.ID]),
+		html.EscapeString(updatedCircle.Name),
+	)
+	buttons := [][]ui.MenuButton{
+		{{Text: "✅ Accept", Command: commands.Encode(commands.AcceptOwnershipCommand, updatedCircle.ID)}},
+		{{Text: "❌ Decline", Command: commands.Encode(commands.DeclineOwnershipCommand, updatedCircle.ID)}},
+	}
+	if notifyErr := h.notifyMember(ctx, updatedCircle, newOwnerId, text, buttons); notifyErr != nil {
+		fmt.Printf("failed to queue ownership offer for circle %s: %v\n", updatedCircle.Name, notifyErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	transferMenu.Title = fmt.Sprintf("📨 We've asked %s to take over %s. You stay the owner until they accept.", names[newOwnerId], updatedCircle.Name)
+	transferMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, updatedCircle.ID))
+	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, transferMenu)
+}
+
+// AcceptOwnershipCommandHandler hands the circle to the member it was
+// offered to. The store only does so if the offer still stands, so a forged
+// button can't take a circle that wasn't offered.
+func (h *Handlers) AcceptOwnershipCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Accept ownership")
+
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	updatedCircle, acceptErr := h.store.AcceptCircleOwnership(ctx, circle.ID, user.ID)
+	if errors.Is(acceptErr, db.ErrNotFound) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This offer has been withdrawn or has already been answered.")
+		return
+	}
+	if acceptErr != nil {
+		fmt.Printf("failed to transfer circle %s: %v\n", circle.Name, acceptErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+	log.Printf("audit: ownership of circle %s (%s) passed from user %d to user %d (@%s)\n",
+		updatedCircle.ID.Hex(), updatedCircle.Name, circle.OwnerId, user.ID, user.Username)
+
+	names, err := h.memberNames(ctx, updatedCircle)
+	if err != nil {
+		fmt.Printf("failed to get users for circle %s: %v\n", updatedCircle.Name, err)
+	}
+	text := fmt.Sprintf(
+		"👑 %s accepted and is now the owner of circle <b>%s</b>. You are an admin of it.",
+		html.EscapeString(names[user.ID]),
+		html.EscapeString(updatedCircle.Name),
+	)
+	if notifyErr := h.notifyMember(ctx, updatedCircle, circle.OwnerId, text, nil); notifyErr != nil {
+		fmt.Printf("failed to queue ownership notification for circle %s: %v\n", updatedCircle.Name, notifyErr)
+	}
+
+	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: chatID,
+		Text:   fmt.Sprintf("👑 You are now the owner of %s!", updatedCircle.Name),
+	})
+	utils.SendMenu(ctx, b, chatID, updatedCircle.ToMenu(user.ID))
+}
+
+func (h *Handlers) DeclineOwnershipCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Decline ownership")
+
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	updatedCircle, declineErr := h.store.DeclineCircleOwnership(ctx, circleId, user.ID)
+	if errors.Is(declineErr, db.ErrNotFound) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This offer has been withdrawn or has already been answered.")
+		return
+	}
+	if declineErr != nil {
+		fmt.Printf("failed to decline circle %s: %v\n", circleId.Hex(), declineErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	names, err := h.memberNames(ctx, updatedCircle)
+	if err != nil {
+		fmt.Printf("failed to get users for circle %s: %v\n", updatedCircle.Name, err)
+	}
+	text := fmt.Sprintf(
+		"%s declined to take over circle <b>%s</b>. You are still its owner.",
+		html.EscapeString(names[user.ID]),
+		html.EscapeString(updatedCircle.Name),
+	)
+	if notifyErr := h.notifyMember(ctx, updatedCircle, updatedCircle.OwnerId, text, nil); notifyErr != nil {
+		fmt.Printf("failed to queue ownership notification for circle %s: %v\n", updatedCircle.Name, notifyErr)
+	}
+
+	utils.SendCustomErrorMessage(ctx, b, chatID, fmt.Sprintf("You declined to take over %s.", updatedCircle.Name))
+}
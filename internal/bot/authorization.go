@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/db"
+	"grandfather/utils"
+	"log"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// commandRoles is the least role a user needs in a circle to run each
+// circle-scoped command. Callback data can be forged, so this is checked for
+// every press, not just when the button is shown. Commands missing here are
+// refused, so a new command can't be left open by accident.
+var commandRoles = map[commands.Command]appModels.Role{
+	commands.GetCircleCommand:           appModels.RoleMember,
+	commands.GetMemberListCommand:       appModels.RoleMember,
+	commands.RevealMortalCommand:        appModels.RoleMember,
+	commands.RevealAngelCommand:         appModels.RoleMember,
+	commands.SendMessageCommandToMortal: appModels.RoleMember,
+	commands.SendMessageCommandToAngel:  appModels.RoleMember,
+	commands.MessageHistoryCommand:      appModels.RoleMember,
+	// Whether the circle was offered to them is checked by the store.
+	commands.AcceptOwnershipCommand:  appModels.RoleMember,
+	commands.DeclineOwnershipCommand: appModels.RoleMember,
+
+	commands.RemoveUserCommand:          appModels.RoleAdmin,
+	commands.RemoveSpecificUserCommand:  appModels.RoleAdmin,
+	commands.ChooseSessionLengthCommand: appModels.RoleAdmin,
+	commands.StartNewSessionCommand:     appModels.RoleAdmin,
+	commands.ChooseRevealModeCommand:    appModels.RoleAdmin,
+	commands.EndSessionCommand:          appModels.RoleAdmin,
+
+	commands.ShareInviteLinkCommand:   appModels.RoleOwner,
+	commands.RotateInviteLinkCommand:  appModels.RoleOwner,
+	commands.DisableInviteLinkCommand: appModels.RoleOwner,
+	commands.ManageExclusionsCommand:  appModels.RoleOwner,
+	commands.AddExclusionCommand:      appModels.RoleOwner,
+	commands.RemoveExclusionCommand:   appModels.RoleOwner,
+	commands.ManageAdminsCommand:      appModels.RoleOwner,
+	commands.PromoteAdminCommand:      appModels.RoleOwner,
+	commands.DemoteAdminCommand:       appModels.RoleOwner,
+	commands.TransferOwnershipCommand: appModels.RoleOwner,
+}
+
+// messageCommands act on a message rather than a circle. Their handlers
+// check that the user sent or received it.
+var messageCommands = map[commands.Command]bool{
+	commands.UnsendMessageCommand: true,
+	commands.MarkReadCommand:      true,
+}
+
+// authorize checks that the user pressing a button has the role command
+// needs in the circle. Otherwise it tells them why not, writes the attempt to
+// the audit log and returns false.
+func (h *Handlers) authorize(ctx context.Context, b *bot.Bot, update *models.Update, command commands.Command, circleId bson.ObjectID) bool {
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return false
+	}
+
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
+	if errors.Is(getCircleErr, db.ErrNotFound) {
+		fmt.Printf("User %d pressed %s for circle %s, which doesn't exist\n", user.ID, command, circleId.Hex())
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This circle no longer exists.")
+		return false
+	}
+	if getCircleErr != nil {
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return false
+	}
+
+	required, ok := commandRoles[command]
+	if !ok {
+		log.Printf("audit: denied %s in circle %s (%s) to user %d (@%s): the command has no role\n",
+			command, circle.ID.Hex(), circle.Name, user.ID, user.Username)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "You cannot carry out this action.")
+		return false
+	}
+	role := circle.RoleOf(user.ID)
+	if role >= required {
+		return true
+	}
+
+	log.Printf("audit: denied %s in circle %s (%s) to user %d (@%s): needs %s, is %s\n",
+		command, circle.ID.Hex(), circle.Name, user.ID, user.Username, required, role)
+	utils.SendCustomErrorMessage(ctx, b, chatID, denialMessage(circle, required))
+	return false
+}
+
+// denialMessage tells a user why they can't do something in the circle.
+func denialMessage(circle *appModels.Circle, required appModels.Role) string {
+	switch required {
+	case appModels.RoleMember:
+		return "You don't seem to be a part of this circle!"
+	case appModels.RoleAdmin:
+		return fmt.Sprintf("You cannot carry out this action. It doesn't seem like you are an admin of the circle %s!", circle.Name)
+	case appModels.RoleOwner:
+		return fmt.Sprintf("You cannot carry out this action. It doesn't seem like you are the owner of the circle %s!", circle.Name)
+	}
+	return "You cannot carry out this action."
+}
@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/db"
+	"grandfather/internal/ui"
+	"grandfather/utils"
+	"html"
+	"slices"
+	"time"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// chatSweepInterval is how often idle chats are looked for.
+const chatSweepInterval = time.Minute
+
+// chatTarget returns who a user in state is chatting with, "angel" or
+// "mortal", and the command that opens a chat with them.
+func chatTarget(state appModels.UserState) (string, commands.Command) {
+	if state == appModels.StateChattingWithAngel {
+		return "angel", commands.SendMessageCommandToAngel
+	}
+	return "mortal", commands.SendMessageCommandToMortal
+}
+
+// activeSession returns the circle's current session, or nil when it has
+// none or it has ended. Ended sessions stay current for their reveals, so
+// relays have to check the state.
+func (h *Handlers) activeSession(ctx context.Context, circle *appModels.Circle) (*appModels.Session, error) {
+	if circle.CurrentSession == nil {
+		return nil, nil
+	}
+	session, err := h.store.GetSession(ctx, *circle.CurrentSession)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.State != appModels.StateActive {
+		return nil, nil
+	}
+	return session, nil
+}
+
+// startChat puts the user into a chat with their angel or mortal in the
+// circle. Calling it while already chatting switches the target.
+func (h *Handlers) startChat(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, state appModels.UserState) {
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
+	if getCircleErr != nil {
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This circle was not found!")
+		return
+	}
+
+	session, getSessErr := h.activeSession(ctx, circle)
+	if getSessErr != nil {
+		fmt.Printf("failed to get the session of circle %s: %v\n", circle.ID.Hex(), getSessErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+	if session == nil {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "There is no current active session for the circle")
+		return
+	}
+
+	if err := h.store.UpdateStateWithCircle(ctx, user.ID, state, circle.ID); err != nil {
+		fmt.Println("Error updating user state:", err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	target, _ := chatTarget(state)
+	otherState := appModels.StateChattingWithMortal
+	if state == appModels.StateChattingWithMortal {
+		otherState = appModels.StateChattingWithAngel
+	}
+	other, otherCommand := chatTarget(otherState)
+
+	chatMenu := ui.Menu{
+		Title: fmt.Sprintf(
+			"💬 You're now chatting with your %s in %s.\nEverything you send here is passed on anonymously. Send /exit when you're done.",
+			target,
+			circle.Name,
+		),
+		Buttons: [][]ui.MenuButton{},
+	}
+	chatMenu.AddButtonRow(fmt.Sprintf("🔄 Switch to my %s", other), commands.Encode(otherCommand, circle.ID))
+	chatMenu.AddButtonRow("🚪 Exit chat", string(commands.ExitChatCommand))
+	utils.SendMenu(ctx, b, chatID, chatMenu)
+}
+
+// ChatMessageHandler relays a message from a user who is chatting with their
+// angel or mortal and keeps the chat open.
+func (h *Handlers) ChatMessageHandler(ctx context.Context, b *bot.Bot, update *models.Update, user *appModels.User) {
+	fmt.Println("Chat message")
+
+	chatID := update.Message.Chat.ID
+	target, chatCommand := chatTarget(user.State)
+
+	if time.Since(user.StateUpdatedAt) > h.cfg.ChatTimeout {
+		if err := h.store.UpdateStateWithCircle(ctx, user.ID, appModels.StateNone, bson.ObjectID{}); err != nil {
+			fmt.Println("Error updating user state:", err)
+		}
+
+		timedOutMenu := ui.Menu{
+			Title:   fmt.Sprintf("💤 Your chat with your %s timed out, so this message was not sent.", target),
+			Buttons: [][]ui.MenuButton{},
+		}
+		timedOutMenu.AddButtonRow("💬 Chat again", commands.Encode(chatCommand, user.StateCircleId))
+		utils.SendMenu(ctx, b, chatID, timedOutMenu)
+		return
+	}
+
+	circle, getCircleErr := h.store.GetCircleByID(ctx, user.StateCircleId)
+	if getCircleErr != nil {
+		fmt.Printf("There was an error getting circle %s: %s\n", user.StateCircleId.Hex(), getCircleErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	session, getSessErr := h.activeSession(ctx, circle)
+	if getSessErr != nil {
+		fmt.Printf("failed to get the session of circle %s: %v\n", circle.ID.Hex(), getSessErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+	if session == nil {
+		if err := h.store.UpdateStateWithCircle(ctx, user.ID, appModels.StateNone, bson.ObjectID{}); err != nil {
+			fmt.Println("Error updating user state:", err)
+		}
+		utils.SendCustomErrorMessage(ctx, b, chatID, "The session has ended, so your chat was closed.")
+		return
+	}
+
+	var match *appModels.Match
+	var getMatchErr error
+	var recipientId int64
+	senderRole := "mortal"
+	if user.State == appModels.StateChattingWithAngel {
+		match, getMatchErr = h.store.GetAngelMatch(ctx, session.ID, user.ID)
+		if match != nil {
+			recipientId = match.AngelId
+		}
+	} else {
+		senderRole = "angel"
+		match, getMatchErr = h.store.GetMortalMatch(ctx, session.ID, user.ID)
+		if match != nil {
+			recipientId = match.MortalId
+		}
+	}
+	if getMatchErr != nil || match == nil {
+		fmt.Printf("There was an error to get the %s for user %d: %v\n", target, user.ID, getMatchErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	payload, ok := relayablePayload(ctx, b, chatID, update.Message)
+	if !ok {
+		return
+	}
+
+	message, createMessageErr := h.store.CreateMessage(ctx, &appModels.Message{
+		SenderId:    user.ID,
+		RecepientId: recipientId,
+		CircleName:  circle.Name,
+		CircleId:    circle.ID,
+		SessionId:   session.ID,
+		Payload:     &payload,
+		SenderRole:  senderRole,
+	})
+	if createMessageErr != nil {
+		fmt.Printf("There was an error creating the message: %s\n", createMessageErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	// Setting the state again keeps the chat from timing out.
+	if err := h.store.UpdateStateWithCircle(ctx, user.ID, user.State, circle.ID); err != nil {
+		fmt.Println("Error updating user state:", err)
+	}
+
+	h.sendConfirmation(ctx, b, chatID, fmt.Sprintf("💬 Chatting with your %s in %s · /exit to stop", target, circle.Name), message)
+}
+
+// ExitChatCommandHandler handles /exit and the "Exit chat" button.
+func (h *Handlers) ExitChatCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	fmt.Println("Exit chat")
+
+	tgUser, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	user, getUserErr := h.store.GetUser(ctx, tgUser.ID)
+	if getUserErr != nil || user == nil || !slices.Contains(appModels.ChatStates, user.State) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "You're not chatting with anyone right now.")
+		return
+	}
+
+	if err := h.store.UpdateStateWithCircle(ctx, user.ID, appModels.StateNone, bson.ObjectID{}); err != nil {
+		fmt.Println("Error updating user state:", err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	target, _ := chatTarget(user.State)
+	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: chatID,
+		Text:   fmt.Sprintf("👋 You've left the chat with your %s.", target),
+	})
+
+	if circle, err := h.store.GetCircleByID(ctx, user.StateCircleId); err == nil {
+		utils.SendMenu(ctx, b, chatID, circle.ToMenu(user.ID))
+	}
+}
+
+// ExpireIdleChats closes every chat that has gone quiet for longer than the
+// chat timeout and lets the users know.
+func (h *Handlers) ExpireIdleChats(ctx context.Context) error {
+	expired, err := h.store.ExpireIdleChats(ctx, time.Now().Add(-h.cfg.ChatTimeout))
+	if err != nil {
+		return err
+	}
+
+	notifications := make([]*appModels.Message, 0, len(expired))
+	for _, user := range expired {
+		target, chatCommand := chatTarget(user.State)
+
+		circleName := "your circle"
+		if circle, err := h.store.GetCircleByID(ctx, user.StateCircleId); err == nil {
+			circleName = circle.Name
+		}
+
+		notifications = append(notifications, &appModels.Message{
+			RecepientId: user.ID,
+			CircleName:  circleName,
+			Message:     fmt.Sprintf("💤 Your chat with your %s in <b>%s</b> was closed because nothing was sent for a while.", target, html.EscapeString(circleName)),
+			ParseMode:   string(models.ParseModeHTML),
+			Buttons: [][]ui.MenuButton{
+				{{Text: "💬 Chat again", Command: commands.Encode(chatCommand, user.StateCircleId)}},
+			},
+		})
+	}
+
+	return h.store.CreateNotifications(ctx, notifications)
+}
+
+// RunChatSweeper expires idle chats every chatSweepInterval until ctx is
+// done. Chats are also checked when their next message arrives, so the
+// sweeper only needs to tell users who went quiet.
+func (h *Handlers) RunChatSweeper(ctx context.Context) {
+	ticker := time.NewTicker(chatSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := h.ExpireIdleChats(ctx); err != nil {
+				fmt.Println("failed to expire idle chats:", err)
+			}
+		}
+	}
+}
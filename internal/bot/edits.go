@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/db"
+	"grandfather/internal/ui"
+	"grandfather/utils"
+	"time"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// sendConfirmation tells the sender their message was queued, followed by
+// text. The confirmation is remembered so it can be edited as the message is
+// delivered and seen. While unsending is enabled it carries a button to take
+// the message back.
+func (h *Handlers) sendConfirmation(ctx context.Context, b *bot.Bot, chatID int64, text string, message *appModels.Message) {
+	menu := ui.Menu{Buttons: [][]ui.MenuButton{}}
+	if h.cfg.UnsendWindow > 0 {
+		menu.AddButtonRow("↩️ Unsend", commands.Encode(commands.UnsendMessageCommand, message.ID))
+	}
+	confirmation := appModels.Confirmation{ChatId: chatID, Text: text, Buttons: menu.Buttons}
+	message.Confirmation = &confirmation
+
+	sent, sendErr := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      chatID,
+		Text:        message.ConfirmationText(),
+		ReplyMarkup: menu.ToInlineKeyboard(),
+	})
+	if sendErr != nil {
+		fmt.Printf("failed to confirm message %s: %v\n", message.ID.Hex(), sendErr)
+		return
+	}
+
+	confirmation.MessageId = sent.ID
+	updated, updateErr := h.store.SetMessageConfirmation(ctx, message.ID, confirmation)
+	if updateErr != nil {
+		fmt.Printf("failed to store confirmation of message %s: %v\n", message.ID.Hex(), updateErr)
+		return
+	}
+
+	// The outbox may have delivered it while the confirmation was on its way.
+	if updated.MessageState != appModels.NotDelivered {
+		utils.EditConfirmation(ctx, b, updated)
+	}
+}
+
+// EditedMessageHandler applies a sender's edit to the message it was relayed
+// as. Edits to anything that wasn't relayed are ignored.
+func (h *Handlers) EditedMessageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	edited := update.EditedMessage
+	if edited.From == nil {
+		return
+	}
+
+	message, getMessageErr := h.store.GetMessageBySource(ctx, edited.From.ID, edited.ID)
+	if errors.Is(getMessageErr, db.ErrNotFound) {
+		return
+	}
+	if getMessageErr != nil {
+		fmt.Printf("failed to look up edited message %d from user %d: %v\n", edited.ID, edited.From.ID, getMessageErr)
+		return
+	}
+	if message.Payload == nil || message.MessageState == appModels.Unsent {
+		return
+	}
+
+	content, ok := contentOf(edited)
+	if !ok || content.Type != message.Payload.Type {
+		return
+	}
+	if content.TooLong() {
+		fmt.Printf("edit of message %s is too long to relay, ignoring it\n", message.ID.Hex())
+		return
+	}
+
+	// Only the text can change; the recipient keeps the file they were sent.
+	payload := *message.Payload
+	payload.Text = content.Text
+	payload.Caption = content.Caption
+
+	updated, updateErr := h.store.UpdateMessagePayload(ctx, message.ID, payload)
+	if updateErr != nil {
+		fmt.Printf("failed to update edited message %s: %v\n", message.ID.Hex(), updateErr)
+		return
+	}
+
+	// Messages still in the outbox go out with the new text. One being sent
+	// is brought up to date by the outbox once it is delivered.
+	if updated.MessageState != appModels.Delivered || len(updated.DeliveredMessageIds) == 0 {
+		return
+	}
+
+	recipient, getUserErr := h.store.GetUser(ctx, updated.RecepientId)
+	if getUserErr != nil {
+		fmt.Printf("failed to get recipient %d of edited message: %v\n", updated.RecepientId, getUserErr)
+		return
+	}
+
+	if editErr := utils.EditRelay(ctx, b, recipient.ChatID, updated); editErr != nil {
+		fmt.Printf("failed to edit delivered message %s for user %d: %v\n", updated.ID.Hex(), recipient.ID, editErr)
+	}
+}
+
+// UnsendMessageCommandHandler deletes a relayed message from its
+// recipient's chat, if its sender asks within the unsend window.
+func (h *Handlers) UnsendMessageCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, messageId bson.ObjectID) {
+	fmt.Println("Unsend message")
+
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	message, getMessageErr := h.store.GetMessage(ctx, messageId)
+	if getMessageErr != nil {
+		fmt.Printf("failed to get message %s: %v\n", messageId.Hex(), getMessageErr)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This message was not found!")
+		return
+	}
+
+	if message.SenderId != user.ID {
+		fmt.Printf("User %d tried to unsend message %s they didn't send\n", user.ID, messageId.Hex())
+		utils.SendCustomErrorMessage(ctx, b, chatID, "You can only unsend your own messages.")
+		return
+	}
+
+	if message.MessageState == appModels.Unsent {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This message has already been unsent.")
+		return
+	}
+
+	if h.cfg.UnsendWindow <= 0 || time.Since(message.ID.Timestamp()) > h.cfg.UnsendWindow {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "It's too late to unsend this message.")
+		return
+	}
+
+	// Marking it first keeps the outbox from delivering it after all. Copies
+	// delivered since it was read are in the updated message; ones the
+	// outbox is sending right now are deleted by the outbox itself.
+	message, unsendErr := h.store.UpdateMessageToUnsent(ctx, message.ID)
+	if unsendErr != nil {
+		fmt.Printf("failed to unsend message %s: %v\n", messageId.Hex(), unsendErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	if len(message.DeliveredMessageIds) > 0 {
+		recipient, getUserErr := h.store.GetUser(ctx, message.RecepientId)
+		if getUserErr != nil {
+			fmt.Printf("failed to get recipient %d of unsent message: %v\n", message.RecepientId, getUserErr)
+			utils.SendErrorMessage(ctx, b, chatID)
+			return
+		}
+
+		_, deleteErr := b.DeleteMessages(ctx, &bot.DeleteMessagesParams{
+			ChatID:     recipient.ChatID,
+			MessageIDs: message.DeliveredMessageIds,
+		})
+		if deleteErr != nil {
+			fmt.Printf("failed to delete unsent message %s for user %d: %v\n", message.ID.Hex(), recipient.ID, deleteErr)
+			utils.SendCustomErrorMessage(ctx, b, chatID, "Sorry, the message could not be removed from their chat.")
+			return
+		}
+	}
+
+	// Confirmations from before receipts weren't stored, so the button's
+	// message is edited directly.
+	if message.Confirmation != nil {
+		utils.EditConfirmation(ctx, b, message)
+		return
+	}
+	_, _ = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    chatID,
+		MessageID: update.CallbackQuery.Message.Message.ID,
+		Text:      message.Status(),
+	})
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/ui"
+	"grandfather/utils"
+	"slices"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Directions offered as the last step of adding an exclusion.
+const (
+	exclusionOneWay int64 = 1
+	exclusionMutual int64 = 2
+)
+
+// memberNames returns the display name of every member of the circle.
+func (h *Handlers) memberNames(ctx context.Context, circle *appModels.Circle) (map[int64]string, error) {
+	members, err := h.store.GetUsers(ctx, circle.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int64]string, len(members))
+	for _, member := range members {
+		names[member.ID] = member.DisplayName()
+	}
+	return names, nil
+}
+
+func (h *Handlers) showExclusions(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, circle *appModels.Circle, note string) {
+	names, err := h.memberNames(ctx, circle)
+	if err != nil {
+		fmt.Printf("failed to get users for circle %s: %v\n", circle.Name, err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	title := fmt.Sprintf("👥 Circle: %s\n🚷 Exclusions keep an angel from ever being given a certain mortal.", circle.Name)
+	if len(circle.Exclusions) == 0 {
+		title += "\n\nThere are no exclusions yet."
+	} else {
+		title += "\nPress one to remove it."
+	}
+	if note != "" {
+		title = note + "\n\n" + title
+	}
+
+	exclusionsMenu := ui.Menu{
+		Title:   title,
+		Buttons: [][]ui.MenuButton{},
+	}
+	for _, e := range circle.Exclusions {
+		exclusionsMenu.AddButtonRow(
+			fmt.Sprintf("❌ %s ↛ %s", names[e.AngelId], names[e.MortalId]),
+			commands.Encode(commands.RemoveExclusionCommand, circle.ID, e.AngelId, e.MortalId),
+		)
+	}
+	exclusionsMenu.AddButtonRow("➕ Add exclusion", commands.Encode(commands.AddExclusionCommand, circle.ID))
+	exclusionsMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, circle.ID))
+	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, exclusionsMenu)
+}
+
+func (h *Handlers) ManageExclusionsCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Manage exclusions")
+
+	_, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	h.showExclusions(ctx, b, update, chatID, circle, "")
+}
+
+// AddExclusionCommandHandler walks the owner through adding an exclusion one
+// button press at a time. args grows with each step: the angel, then the
+// mortal, then whether the exclusion applies both ways.
+func (h *Handlers) AddExclusionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, args []int64) {
+	fmt.Println("Add exclusion")
+
+	_, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	for _, id := range args[:min(len(args), 2)] {
+		if !slices.Contains(circle.Members, id) {
+			utils.SendCustomErrorMessage(ctx, b, chatID, "That person is no longer a member of this circle.")
+			return
+		}
+	}
+
+	names, err := h.memberNames(ctx, circle)
+	if err != nil {
+		fmt.Printf("failed to get users for circle %s: %v\n", circle.Name, err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	stepMenu := ui.Menu{Buttons: [][]ui.MenuButton{}}
+
+	switch len(args) {
+	case 0:
+		stepMenu.Title = fmt.Sprintf("👥 Circle: %s\nWho should NOT be the angel?", circle.Name)
+		for _, id := range circle.Members {
+			stepMenu.AddButtonRow(names[id], commands.Encode(commands.AddExclusionCommand, circle.ID, id))
+		}
+	case 1:
+		angelId := args[0]
+		stepMenu.Title = fmt.Sprintf("👥 Circle: %s\nWho should %s never get as their mortal?", circle.Name, names[angelId])
+		for _, id := range circle.Members {
+			if id != angelId {
+				stepMenu.AddButtonRow(names[id], commands.Encode(commands.AddExclusionCommand, circle.ID, angelId, id))
+			}
+		}
+	case 2:
+		angelId, mortalId := args[0], args[1]
+		stepMenu.Title = fmt.Sprintf("👥 Circle: %s\nShould this apply both ways?", circle.Name)
+		stepMenu.AddButtonRow(
+			fmt.Sprintf("%s ↛ %s only", names[angelId], names[mortalId]),
+			commands.Encode(commands.AddExclusionCommand, circle.ID, angelId, mortalId, exclusionOneWay),
+		)
+		stepMenu.AddButtonRow(
+			fmt.Sprintf("Both ways (%s ↮ %s)", names[angelId], names[mortalId]),
+			commands.Encode(commands.AddExclusionCommand, circle.ID, angelId, mortalId, exclusionMutual),
+		)
+	default:
+		angelId, mortalId := args[0], args[1]
+		if angelId == mortalId {
+			utils.SendCustomErrorMessage(ctx, b, chatID, "Nobody can be their own mortal anyway!")
+			return
+		}
+
+		exclusions := []appModels.Exclusion{{AngelId: angelId, MortalId: mortalId}}
+		if args[2] == exclusionMutual {
+			exclusions = append(exclusions, appModels.Exclusion{AngelId: mortalId, MortalId: angelId})
+		}
+
+		updatedCircle, addErr := h.store.AddCircleExclusions(ctx, circle.ID, exclusions)
+		if addErr != nil {
+			fmt.Printf("failed to add exclusions for circle %s: %v\n", circle.Name, addErr)
+			utils.SendErrorMessage(ctx, b, chatID)
+			return
+		}
+
+		h.showExclusions(ctx, b, update, chatID, updatedCircle, "✅ Exclusion added.")
+		return
+	}
+
+	stepMenu.AddButtonRow("Back", commands.Encode(commands.ManageExclusionsCommand, circle.ID))
+	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, stepMenu)
+}
+
+func (h *Handlers) RemoveExclusionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, angelId, mortalId int64) {
+	fmt.Println("Remove exclusion")
+
+	_, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	updatedCircle, removeErr := h.store.RemoveCircleExclusion(ctx, circle.ID, appModels.Exclusion{AngelId: angelId, MortalId: mortalId})
+	if removeErr != nil {
+		fmt.Printf("failed to remove exclusion for circle %s: %v\n", circle.Name, removeErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	h.showExclusions(ctx, b, update, chatID, updatedCircle, "🗑 Exclusion removed.")
+}
@@ -6,19 +6,21 @@ import (
 	"fmt"
 	"grandfather/internal/commands.go"
 	"grandfather/internal/db"
+	"grandfather/internal/matching"
 	"grandfather/internal/ui"
 	"grandfather/utils"
-	"slices"
+	"html"
 	"strings"
+	"time"
 
 	appModels "grandfather/internal/models"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
-	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
-func MainMenuCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+func (h *Handlers) MainMenuCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	fmt.Println("main menu")
 	_, chatID, extractErr := utils.ExtractUserAndChat(update)
 
@@ -41,7 +43,7 @@ func MainMenuCommandHandler(ctx context.Context, b *bot.Bot, update *models.Upda
 	utils.SendErrorMessage(ctx, b, chatID)
 }
 
-func StartCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+func (h *Handlers) StartCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	fmt.Println("start")
 
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
@@ -52,7 +54,7 @@ func StartCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update)
 		return
 	}
 
-	_, err, alreadyCreatedUser := db.CreateUser(ctx, user, chatID)
+	_, err, alreadyCreatedUser := h.store.CreateUser(ctx, user, chatID)
 	if err != nil {
 		fmt.Printf("failed to create user: %v\n", err)
 		utils.SendErrorMessage(ctx, b, chatID)
@@ -72,6 +74,12 @@ func StartCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update)
 		})
 	}
 
+	// Invite links open the bot with "/start join_<code>".
+	if _, payload, ok := strings.Cut(update.Message.Text, " "); ok && strings.HasPrefix(payload, appModels.InvitePayloadPrefix) {
+		h.joinCircleByInvite(ctx, b, chatID, user, parseInviteCode(payload))
+		return
+	}
+
 	mainMenu, _ := ui.GetMenu(ui.MenuNameMain)
 
 	b.SendMessage(ctx, &bot.SendMessageParams{
@@ -81,7 +89,7 @@ func StartCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update)
 	})
 }
 
-func StartNewCircleCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+func (h *Handlers) StartNewCircleCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	fmt.Println("Start new circle")
 	user, chatID, err := utils.ExtractUserAndChat(update)
 	if err != nil {
@@ -90,7 +98,7 @@ func StartNewCircleCommandHandler(ctx context.Context, b *bot.Bot, update *model
 		return
 	}
 
-	updateUserStateErr := db.UpdateState(ctx, user.ID, appModels.StateWaitingCircleName)
+	updateUserStateErr := h.store.UpdateState(ctx, user.ID, appModels.StateWaitingCircleName)
 
 	if updateUserStateErr != nil {
 		fmt.Println("Error updating user state:", err)
@@ -104,7 +112,7 @@ func StartNewCircleCommandHandler(ctx context.Context, b *bot.Bot, update *model
 	})
 }
 
-func StartNewCircleWithNameCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+func (h *Handlers) StartNewCircleWithNameCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	fmt.Println("Start new circle with name")
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
 	if extractErr != nil {
@@ -119,16 +127,19 @@ func StartNewCircleWithNameCommandHandler(ctx context.Context, b *bot.Bot, updat
 		return
 	}
 
-	circle, err := db.CreateCircle(ctx, circleName, user.ID)
+	circle, err := h.store.CreateCircle(ctx, circleName, user.ID)
 
-	// TODO: Give custom message when we see duplicate key error
+	if errors.Is(err, db.ErrDuplicate) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, fmt.Sprintf("There is already a circle called %q. Please pick another name!", circleName))
+		return
+	}
 	if err != nil {
 		fmt.Printf("failed to create circle %s: %v\n", circleName, err)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
-	updateUserStateErr := db.UpdateState(ctx, user.ID, appModels.StateNone)
+	updateUserStateErr := h.store.UpdateState(ctx, user.ID, appModels.StateNone)
 
 	if updateUserStateErr != nil {
 		fmt.Println("Error updating user state:", err)
@@ -147,7 +158,7 @@ func StartNewCircleWithNameCommandHandler(ctx context.Context, b *bot.Bot, updat
 
 }
 
-func JoinCircleCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+func (h *Handlers) JoinCircleCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	fmt.Println("Joining circle")
 
 	user, chatID, err := utils.ExtractUserAndChat(update)
@@ -157,7 +168,7 @@ func JoinCircleCommandHandler(ctx context.Context, b *bot.Bot, update *models.Up
 		return
 	}
 
-	updateUserStateErr := db.UpdateState(ctx, user.ID, appModels.StateWaitingJoinCircleName)
+	updateUserStateErr := h.store.UpdateState(ctx, user.ID, appModels.StateWaitingJoinInviteCode)
 
 	if updateUserStateErr != nil {
 		fmt.Println("Error updating user state:", err)
@@ -167,12 +178,12 @@ func JoinCircleCommandHandler(ctx context.Context, b *bot.Bot, update *models.Up
 
 	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: chatID,
-		Text:   "Great! What is the name of the circle you want to join?",
+		Text:   "Great! Send me the invite link you got from the circle owner.",
 	})
 }
 
-func JoinCircleWithNameCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	fmt.Println("Joining circle with name")
+func (h *Handlers) JoinCircleWithInviteCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	fmt.Println("Joining circle with invite")
 
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
 
@@ -182,46 +193,18 @@ func JoinCircleWithNameCommandHandler(ctx context.Context, b *bot.Bot, update *m
 		return
 	}
 
-	circleName := update.Message.Text
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
-
-	// TODO: Give custom message when we see not found key error
-	if getCircleErr != nil {
-		if errors.Is(getCircleErr, mongo.ErrNoDocuments) {
-			// Custom user-friendly message
-			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-				ChatID: chatID,
-				Text:   fmt.Sprintf("No circle found with the name '%s'.", circleName),
-			})
-
-			if menu, ok := ui.GetMenu(ui.MenuNameMain); ok {
-				utils.SendMenu(ctx, b, chatID, menu)
-			}
-			return
-		}
-		fmt.Printf("failed to get circle %s: %v\n", circleName, getCircleErr)
-		utils.SendErrorMessage(ctx, b, chatID)
-		return
-	}
+	updateUserStateErr := h.store.UpdateState(ctx, user.ID, appModels.StateNone)
 
-	updatedCircle, updateCircleErr := db.AddUserToCircle(ctx, circle.ID, user.ID)
-	if updateCircleErr != nil {
-		fmt.Printf("failed to update circle %s: %v\n", circleName, updateCircleErr)
+	if updateUserStateErr != nil {
+		fmt.Println("Error updating user state:", updateUserStateErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
-	b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: update.Message.Chat.ID,
-		Text:   fmt.Sprintf("You have joined the circle %s", updatedCircle.Name),
-	})
-
-	circleMenu := circle.ToMenu(user.ID)
-
-	utils.SendMenu(ctx, b, chatID, circleMenu)
+	h.joinCircleByInvite(ctx, b, chatID, user, parseInviteCode(update.Message.Text))
 }
 
-func ListCirclesCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+func (h *Handlers) ListCirclesCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	fmt.Println("Listing circles")
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
 	if extractErr != nil {
@@ -229,7 +212,7 @@ func ListCirclesCommandHandler(ctx context.Context, b *bot.Bot, update *models.U
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
-	circles, getCirclesErr := db.GetCircles(ctx, user.ID)
+	circles, getCirclesErr := h.store.GetCircles(ctx, user.ID)
 
 	if getCirclesErr != nil {
 		fmt.Printf("Error getting circles for user: %d\n", user.ID)
@@ -238,13 +221,13 @@ func ListCirclesCommandHandler(ctx context.Context, b *bot.Bot, update *models.U
 
 	circlesMenu, _ := ui.GetMenu("circles")
 	for _, circle := range circles {
-		circlesMenu.PrependButtonRow(circle.Name, string(commands.GetCircleCommand)+"@"+circle.Name)
+		circlesMenu.PrependButtonRow(circle.Name, commands.Encode(commands.GetCircleCommand, circle.ID))
 	}
 
 	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, circlesMenu)
 }
 
-func GetCircleDetailsHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string) {
+func (h *Handlers) GetCircleDetailsHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
 	fmt.Println("Getting details of a circle")
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
 	if extractErr != nil {
@@ -253,7 +236,7 @@ func GetCircleDetailsHandler(ctx context.Context, b *bot.Bot, update *models.Upd
 		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	if getCircleErr != nil {
 		fmt.Println("Could not find the circle specified.")
@@ -261,19 +244,12 @@ func GetCircleDetailsHandler(ctx context.Context, b *bot.Bot, update *models.Upd
 		return
 	}
 
-	memberIds := circle.Members
-	if !slices.Contains(memberIds, user.ID) {
-		fmt.Println("User is not a member of the circle.")
-		utils.SendCustomErrorMessage(ctx, b, chatID, "You don't seem to be a part of this circle!")
-		return
-	}
-
 	circleMenu := circle.ToMenu(user.ID)
 
 	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, circleMenu)
 }
 
-func GetMemberListCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string) {
+func (h *Handlers) GetMemberListCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
 	fmt.Println("Getting member list of a circle")
 
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
@@ -283,23 +259,18 @@ func GetMemberListCommandHandler(ctx context.Context, b *bot.Bot, update *models
 		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	// TODO: Give custom message when we see not found key error
 	if getCircleErr != nil {
-		fmt.Printf("failed to get circle %s: %v\n", circleName, getCircleErr)
-		utils.SendCustomErrorMessage(ctx, b, chatID, fmt.Sprintf("Circle %s was not found!", circleName))
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This circle was not found!")
 		return
 	}
 
-	memberIds := circle.Members
-	if !slices.Contains(memberIds, user.ID) {
-		fmt.Println("User is not a member of the circle.")
-		utils.SendCustomErrorMessage(ctx, b, chatID, "You don't seem to be a part of this circle!")
-		return
-	}
+	circleName := circle.Name
 
-	members, getUsersErr := db.GetUsers(ctx, circle.Members)
+	members, getUsersErr := h.store.GetUsers(ctx, circle.Members)
 
 	if getUsersErr != nil {
 		fmt.Printf("failed to get users for circle %s: %v\n", circleName, getUsersErr)
@@ -324,12 +295,14 @@ func GetMemberListCommandHandler(ctx context.Context, b *bot.Bot, update *models
 		Title:   title,
 		Buttons: [][]ui.MenuButton{},
 	}
-	membersMenu.AddButtonRow("Remove Member", string(commands.RemoveUserCommand)+"@"+circle.Name)
-	membersMenu.AddButtonRow("Back", string(commands.GetCircleCommand)+"@"+circle.Name)
+	if circle.RoleOf(user.ID) >= appModels.RoleAdmin {
+		membersMenu.AddButtonRow("Remove Member", commands.Encode(commands.RemoveUserCommand, circle.ID))
+	}
+	membersMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, circle.ID))
 	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, membersMenu)
 }
 
-func RemoveUserCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string) {
+func (h *Handlers) RemoveUserCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
 	fmt.Println("Remove user")
 
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
@@ -339,23 +312,18 @@ func RemoveUserCommandHandler(ctx context.Context, b *bot.Bot, update *models.Up
 		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	// TODO: Give custom message when we see not found key error
 	if getCircleErr != nil {
-		fmt.Printf("failed to get circle %s: %v\n", circleName, getCircleErr)
-		utils.SendCustomErrorMessage(ctx, b, chatID, fmt.Sprintf("Circle %s was not found!", circleName))
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This circle was not found!")
 		return
 	}
 
-	ownerId := circle.OwnerId
-	if ownerId != user.ID {
-		fmt.Printf("Non-owner tried to remove member %s: %v\n", circleName, user.Username)
-		utils.SendCustomErrorMessage(ctx, b, chatID, fmt.Sprintf("You cannot carry out this action. It doesn't seem like you are the owner of the circle %s!", circleName))
-		return
-	}
+	circleName := circle.Name
 
-	members, getUsersErr := db.GetUsers(ctx, circle.Members)
+	members, getUsersErr := h.store.GetUsers(ctx, circle.Members)
 
 	if getUsersErr != nil {
 		fmt.Printf("failed to get users for circle %s: %v\n", circleName, getUsersErr)
@@ -371,13 +339,16 @@ func RemoveUserCommandHandler(ctx context.Context, b *bot.Bot, update *models.Up
 	}
 
 	for _, member := range members {
-		removeMembersMenu.AddButtonRow(fmt.Sprintf("%s %s @%s", member.FirstName, member.LastName, member.UserHandle), fmt.Sprintf("%s@%s@%d", string(commands.RemoveSpecificUserCommand), circleName, member.ID))
+		if !canRemove(circle, user.ID, member.ID) {
+			continue
+		}
+		removeMembersMenu.AddButtonRow(fmt.Sprintf("%s %s @%s", member.FirstName, member.LastName, member.UserHandle), commands.Encode(commands.RemoveSpecificUserCommand, circle.ID, member.ID))
 	}
-	removeMembersMenu.AddButtonRow("Back", string(commands.GetCircleCommand)+"@"+circle.Name)
+	removeMembersMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, circle.ID))
 	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, removeMembersMenu)
 }
 
-func RemoveSpecificUserCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string, userIdToRemove int64) {
+func (h *Handlers) RemoveSpecificUserCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, userIdToRemove int64) {
 	fmt.Println("Removing specific user")
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
 	if extractErr != nil {
@@ -386,23 +357,18 @@ func RemoveSpecificUserCommandHandler(ctx context.Context, b *bot.Bot, update *m
 		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	// TODO: Give custom message when we see not found key error
 	if getCircleErr != nil {
-		fmt.Printf("failed to get circle %s: %v\n", circleName, getCircleErr)
-		utils.SendCustomErrorMessage(ctx, b, chatID, fmt.Sprintf("Circle %s was not found!", circleName))
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This circle was not found!")
 		return
 	}
 
-	ownerId := circle.OwnerId
-	if ownerId != user.ID {
-		fmt.Printf("Non-owner tried to remove member %s: %v\n", circleName, user.Username)
-		utils.SendCustomErrorMessage(ctx, b, chatID, fmt.Sprintf("You cannot carry out this action. It doesn't seem like you are the owner of the circle %s!", circleName))
-		return
-	}
+	circleName := circle.Name
 
-	if userIdToRemove == ownerId {
+	if userIdToRemove == circle.OwnerId {
 		fmt.Printf("Owner tried to remove themselves %s: %v\n", circleName, user.Username)
 		utils.SendCustomErrorMessage(ctx, b, chatID, "The owner cannot be removed from the circle!")
 		circleMenu := circle.ToMenu(user.ID)
@@ -410,7 +376,13 @@ func RemoveSpecificUserCommandHandler(ctx context.Context, b *bot.Bot, update *m
 		return
 	}
 
-	_, updatedCircleErr := db.RemoveUserFromCircle(ctx, circle.ID, userIdToRemove)
+	if !canRemove(circle, user.ID, userIdToRemove) {
+		fmt.Printf("%s tried to remove an admin of %s\n", user.Username, circleName)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "Only the owner can remove an admin from the circle!")
+		return
+	}
+
+	_, updatedCircleErr := h.store.RemoveUserFromCircle(ctx, circle.ID, userIdToRemove)
 
 	if updatedCircleErr != nil {
 		fmt.Printf("failed to remove user for circle %s: %v\n", circleName, updatedCircleErr)
@@ -424,10 +396,61 @@ func RemoveSpecificUserCommandHandler(ctx context.Context, b *bot.Bot, update *m
 	utils.SendMenu(ctx, b, chatID, circleMenu)
 }
 
-func StartNewSessionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string) {
+// canRemove reports whether userId may remove memberId from the circle.
+// Admins can only remove ordinary members; the owner can remove anyone but
+// themselves.
+func canRemove(circle *appModels.Circle, userId, memberId int64) bool {
+	return memberId != circle.OwnerId && circle.RoleOf(memberId) < circle.RoleOf(userId)
+}
+
+// sessionLengths are the deadlines an owner or admin can pick when starting a session.
+var sessionLengths = []struct {
+	label string
+	days  int64
+}{
+	{"No deadline", 0},
+	{"1 week", 7},
+	{"2 weeks", 14},
+	{"4 weeks", 28},
+}
+
+func (h *Handlers) ChooseSessionLengthCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Choosing session length")
+
+	_, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
+
+	if getCircleErr != nil {
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This circle was not found!")
+		return
+	}
+
+	lengthMenu := ui.Menu{
+		Title:   fmt.Sprintf("👥 Circle: %s\nHow long should the new session run?", circle.Name),
+		Buttons: [][]ui.MenuButton{},
+	}
+	for _, length := range sessionLengths {
+		lengthMenu.AddButtonRow(length.label, commands.Encode(commands.StartNewSessionCommand, circle.ID, length.days))
+	}
+	lengthMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, circle.ID))
+	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, lengthMenu)
+}
+
+const sessionActiveMessage = "There’s already an active session running for this circle. You can’t start a new one until it ends."
+
+// StartNewSessionCommandHandler starts a session that should end after
+// deadlineDays, or has no deadline when deadlineDays is 0.
+func (h *Handlers) StartNewSessionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, deadlineDays int64) {
 	fmt.Println("Starting new session")
 
-	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	_, chatID, extractErr := utils.ExtractUserAndChat(update)
 
 	if extractErr != nil {
 		fmt.Println("Error extracting user/chat:", extractErr)
@@ -435,14 +458,14 @@ func StartNewSessionCommandHandler(ctx context.Context, b *bot.Bot, update *mode
 		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	if getCircleErr != nil {
-		if errors.Is(getCircleErr, mongo.ErrNoDocuments) {
+		if errors.Is(getCircleErr, db.ErrNotFound) {
 			// Custom user-friendly message
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
-				Text:   fmt.Sprintf("No circle found with the name '%s'.", circleName),
+				Text:   "This circle no longer exists.",
 			})
 
 			if menu, ok := ui.GetMenu(ui.MenuNameMain); ok {
@@ -450,77 +473,91 @@ func StartNewSessionCommandHandler(ctx context.Context, b *bot.Bot, update *mode
 			}
 			return
 		}
-		fmt.Printf("failed to get circle %s: %v\n", circleName, getCircleErr)
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
-	if !slices.Contains(circle.Members, user.ID) {
-		fmt.Println("User is not a member of the circle.")
-		utils.SendCustomErrorMessage(ctx, b, chatID, "You don't seem to be a part of this circle!")
+	circleName := circle.Name
+
+	// StartSession checks again, but this spares matching members for
+	// nothing.
+	if session, err := h.activeSession(ctx, circle); err == nil && session != nil {
+		utils.SendCustomErrorMessage(ctx, b, chatID, sessionActiveMessage)
 		return
 	}
 
-	if circle.CurrentSession != nil {
-		if s, err := db.GetSession(ctx, *circle.CurrentSession); err == nil {
-			if s.State == appModels.StateActive {
-				_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-					ChatID: chatID,
-					Text:   "There’s already an active session running for this circle. You can’t start a new one until it ends.",
-				})
-				return
-			}
-		}
+	forbidden := make([]matching.Pair, 0, len(circle.Exclusions))
+	for _, e := range circle.Exclusions {
+		forbidden = append(forbidden, matching.Pair{Angel: e.AngelId, Mortal: e.MortalId})
 	}
 
-	session, createSessionErr := db.CreateSession(ctx, circle.ID, circle.Members)
-
-	if createSessionErr != nil {
-		fmt.Printf("failed to create sessions for circle %s: %v\n", circleName, createSessionErr)
+	history, historyErr := h.pairingHistory(ctx, circle)
+	if historyErr != nil {
+		fmt.Printf("failed to load pairing history for circle %s: %v\n", circleName, historyErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
-	// TODO: create matches
-	memberIds := circle.Members
+	constraints := matching.Constraints{Forbidden: forbidden, Penalties: history.penalties}
+	pairs, matchErr := matching.Match(circle.Members, constraints, nil)
+	if errors.Is(matchErr, matching.ErrTooFewMembers) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "A session needs at least two members. Share the invite link to get more people in!")
+		return
+	}
+	if errors.Is(matchErr, matching.ErrNoValidAssignment) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "Nobody can be paired up without breaking one of this circle's exclusions. Remove some from \"Manage exclusions\" and try again.")
+		return
+	}
+	if matchErr != nil {
+		fmt.Printf("failed to match members for circle %s: %v\n", circleName, matchErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
 
-	utils.ShuffleInt64(memberIds)
+	var deadline *time.Time
+	if deadlineDays > 0 {
+		d := time.Now().AddDate(0, 0, int(deadlineDays))
+		deadline = &d
+	}
 
-	matches := make([]*appModels.Match, 0, len(memberIds))
-	for i, angel := range memberIds {
-		mortal := memberIds[(i+1)%len(memberIds)]
+	matches := make([]*appModels.Match, 0, len(pairs))
+	for _, pair := range pairs {
 		matches = append(matches, &appModels.Match{
-			SessionId: session.ID,
-			AngelId:   angel,
-			MortalId:  mortal,
+			AngelId:  pair.Angel,
+			MortalId: pair.Mortal,
 		})
 	}
 
-	if _, createMatchesErr := db.CreateMatches(ctx, matches, session.ID); createMatchesErr != nil {
-		// clean up
-		_, _ = db.DeleteSessionByID(ctx, session.ID)
-		// (optional) unset circle.currentSession if you set it earlier
-		_, _ = db.UnsetCircleCurrentSession(ctx, circle.ID, session.ID)
-
-		fmt.Printf("failed to create matches for circle %s: %v\n", circleName, createMatchesErr)
+	notifications, notificationsErr := h.sessionStartNotifications(ctx, circle, deadline, matches)
+	if notificationsErr != nil {
+		fmt.Printf("failed to build session start notifications for circle %s: %v\n", circleName, notificationsErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
-	if setSessionErr := db.SetCircleCurrentSession(ctx, circle.ID, session.ID); setSessionErr != nil {
-		fmt.Printf("failed to set session for circle %s: %v\n", circleName, setSessionErr)
+	// The session, its matches, the circle pointing at it and the
+	// announcements are written together, so nobody ever sees half a
+	// session or misses hearing about it.
+	_, startSessionErr := h.store.StartSession(ctx, circle.ID, circle.Members, deadline, matches, notifications)
+	if errors.Is(startSessionErr, db.ErrSessionActive) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, sessionActiveMessage)
+		return
+	}
+	if startSessionErr != nil {
+		fmt.Printf("failed to start session for circle %s: %v\n", circleName, startSessionErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
 	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: chatID,
-		Text:   "Your session has been started. Enjoy yourself! 🎉",
+		Text:   "Your session has been started. Enjoy yourself! 🎉\nEvery member will get a private message with their mortal." + history.repeatsReport(pairs),
 	})
 
 }
 
-func RevealMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string) {
+func (h *Handlers) RevealMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
 	fmt.Println("Reveal mortal")
 
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
@@ -530,14 +567,14 @@ func RevealMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.
 		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	if getCircleErr != nil {
-		if errors.Is(getCircleErr, mongo.ErrNoDocuments) {
+		if errors.Is(getCircleErr, db.ErrNotFound) {
 			// Custom user-friendly message
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
-				Text:   fmt.Sprintf("No circle found with the name '%s'.", circleName),
+				Text:   "This circle no longer exists.",
 			})
 
 			if menu, ok := ui.GetMenu(ui.MenuNameMain); ok {
@@ -545,7 +582,7 @@ func RevealMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.
 			}
 			return
 		}
-		fmt.Printf("failed to get circle %s: %v\n", circleName, getCircleErr)
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
@@ -555,9 +592,9 @@ func RevealMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.
 		return
 	}
 
-	session, getSessErr := db.GetSession(ctx, *circle.CurrentSession)
+	session, getSessErr := h.store.GetSession(ctx, *circle.CurrentSession)
 	if getSessErr != nil {
-		if errors.Is(getSessErr, mongo.ErrNoDocuments) || session == nil {
+		if errors.Is(getSessErr, db.ErrNotFound) {
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
 				Text:   "You don't seem to have an active session.",
@@ -572,10 +609,10 @@ func RevealMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.
 		return
 	}
 
-	match, getMatchErr := db.GetMortalMatch(ctx, session.ID, user.ID)
+	match, getMatchErr := h.store.GetMortalMatch(ctx, session.ID, user.ID)
 
 	if getMatchErr != nil {
-		if errors.Is(getMatchErr, mongo.ErrNoDocuments) || session == nil {
+		if errors.Is(getMatchErr, db.ErrNotFound) {
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
 				Text:   "You don't seem to have an active session.",
@@ -585,14 +622,14 @@ func RevealMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.
 			}
 			return
 		}
-		fmt.Println("failed to fetch match:", getSessErr)
+		fmt.Println("failed to fetch match:", getMatchErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
-	mortal, getUserErr := db.GetUser(ctx, match.MortalId)
+	mortal, getUserErr := h.store.GetUser(ctx, match.MortalId)
 	if getUserErr != nil {
-		if errors.Is(getUserErr, mongo.ErrNoDocuments) || session == nil {
+		if errors.Is(getUserErr, db.ErrNotFound) {
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
 				Text:   "You don't seem to have an active session.",
@@ -607,15 +644,7 @@ func RevealMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.
 		return
 	}
 
-	fullName := mortal.FirstName
-	if mortal.LastName != "" {
-		fullName += " " + mortal.LastName
-	}
-
-	mortalInfo := fullName
-	if mortal.UserHandle != "" {
-		mortalInfo += fmt.Sprintf(" (@%s)", mortal.UserHandle)
-	}
+	mortalInfo := html.EscapeString(mortal.DisplayName())
 
 	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: chatID,
@@ -625,7 +654,7 @@ func RevealMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.
 	})
 }
 
-func RevealAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string) {
+func (h *Handlers) RevealAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
 	fmt.Println("Reveal angel")
 
 	user, chatID, extractErr := utils.ExtractUserAndChat(update)
@@ -635,14 +664,14 @@ func RevealAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.U
 		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	if getCircleErr != nil {
-		if errors.Is(getCircleErr, mongo.ErrNoDocuments) {
+		if errors.Is(getCircleErr, db.ErrNotFound) {
 			// Custom user-friendly message
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
-				Text:   fmt.Sprintf("No circle found with the name '%s'.", circleName),
+				Text:   "This circle no longer exists.",
 			})
 
 			if menu, ok := ui.GetMenu(ui.MenuNameMain); ok {
@@ -650,7 +679,7 @@ func RevealAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.U
 			}
 			return
 		}
-		fmt.Printf("failed to get circle %s: %v\n", circleName, getCircleErr)
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
@@ -660,9 +689,9 @@ func RevealAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.U
 		return
 	}
 
-	session, getSessErr := db.GetSession(ctx, *circle.CurrentSession)
+	session, getSessErr := h.store.GetSession(ctx, *circle.CurrentSession)
 	if getSessErr != nil {
-		if errors.Is(getSessErr, mongo.ErrNoDocuments) || session == nil {
+		if errors.Is(getSessErr, db.ErrNotFound) {
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
 				Text:   "You don't seem to have an active session.",
@@ -683,10 +712,10 @@ func RevealAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.U
 		return
 	}
 
-	match, getMatchErr := db.GetAngelMatch(ctx, session.ID, user.ID)
+	match, getMatchErr := h.store.GetAngelMatch(ctx, session.ID, user.ID)
 
 	if getMatchErr != nil {
-		if errors.Is(getMatchErr, mongo.ErrNoDocuments) || session == nil {
+		if errors.Is(getMatchErr, db.ErrNotFound) {
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
 				Text:   "You don't seem to have an active session.",
@@ -696,14 +725,14 @@ func RevealAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.U
 			}
 			return
 		}
-		fmt.Println("failed to fetch match:", getSessErr)
+		fmt.Println("failed to fetch match:", getMatchErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
-	angel, getUserErr := db.GetUser(ctx, match.AngelId)
+	angel, getUserErr := h.store.GetUser(ctx, match.AngelId)
 	if getUserErr != nil {
-		if errors.Is(getUserErr, mongo.ErrNoDocuments) || session == nil {
+		if errors.Is(getUserErr, db.ErrNotFound) {
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
 				Text:   "You don't seem to have an active session.",
@@ -718,15 +747,7 @@ func RevealAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.U
 		return
 	}
 
-	fullName := angel.FirstName
-	if angel.LastName != "" {
-		fullName += " " + angel.LastName
-	}
-
-	angelInfo := fullName
-	if angel.UserHandle != "" {
-		angelInfo += fmt.Sprintf(" (@%s)", angel.UserHandle)
-	}
+	angelInfo := html.EscapeString(angel.DisplayName())
 
 	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID:    chatID,
@@ -735,31 +756,16 @@ func RevealAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.U
 	})
 }
 
-func SendMessageToAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string) {
-	fmt.Println("Start angel message process")
-
-	user, chatID, err := utils.ExtractUserAndChat(update)
-	if err != nil {
-		fmt.Println("Error extracting user/chat:", err)
-		utils.SendErrorMessage(ctx, b, chatID)
-		return
-	}
-
-	updateUserStateErr := db.UpdateStateWithCircle(ctx, user.ID, appModels.StateWaitingSendMessageToAngel, circleName)
-
-	if updateUserStateErr != nil {
-		fmt.Println("Error updating user state:", err)
-		utils.SendErrorMessage(ctx, b, chatID)
-		return
-	}
+// SendMessageToAngelCommandHandler opens a chat with the user's angel.
+func (h *Handlers) SendMessageToAngelCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Start chat with angel")
 
-	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: chatID,
-		Text:   "What would you like to send to your angel?",
-	})
+	h.startChat(ctx, b, update, circleId, appModels.StateChattingWithAngel)
 }
 
-func SendMessageToAngelWithMessageCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, user *appModels.User) {
+// SendMessageToAngelWithMessageCommandHandler sends a single message for users
+// who were prompted for one before chats replaced prompts.
+func (h *Handlers) SendMessageToAngelWithMessageCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, user *appModels.User) {
 	fmt.Println("Send angel message")
 
 	_, chatID, err := utils.ExtractUserAndChat(update)
@@ -769,28 +775,40 @@ func SendMessageToAngelWithMessageCommandHandler(ctx context.Context, b *bot.Bot
 		return
 	}
 
-	circleName := user.StateCircle
+	circleId := user.StateCircleId
 
-	if circleName == "" {
+	if circleId.IsZero() {
 		fmt.Printf("User had no state circle\n")
 		utils.SendErrorMessage(ctx, b, chatID)
+		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	if getCircleErr != nil {
-		fmt.Printf("There was an error getting circle %s: %s\n", circleName, getCircleErr)
+		fmt.Printf("There was an error getting circle %s: %s\n", circleId.Hex(), getCircleErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
-	if circle.CurrentSession == nil {
-		fmt.Printf("There is no currentSesssion for the circle %s\n", circleName)
+	circleName := circle.Name
+
+	session, getSessErr := h.activeSession(ctx, circle)
+	if getSessErr != nil {
+		fmt.Printf("failed to get the session of circle %s: %v\n", circleName, getSessErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+	if session == nil {
+		fmt.Printf("There is no active session for the circle %s\n", circleName)
+		if err := h.store.UpdateStateWithCircle(ctx, user.ID, appModels.StateNone, bson.ObjectID{}); err != nil {
+			fmt.Println("Error updating user state:", err)
+		}
 		utils.SendCustomErrorMessage(ctx, b, chatID, "There is no current active session for the circle")
 		return
 	}
 
-	match, getMatchErr := db.GetAngelMatch(ctx, *circle.CurrentSession, user.ID)
+	match, getMatchErr := h.store.GetAngelMatch(ctx, session.ID, user.ID)
 
 	if getMatchErr != nil {
 		fmt.Printf("There was an error to get the mortal for user %d: %s\n", user.ID, getMatchErr)
@@ -798,9 +816,20 @@ func SendMessageToAngelWithMessageCommandHandler(ctx context.Context, b *bot.Bot
 		return
 	}
 
-	message := update.Message.Text
+	payload, ok := relayablePayload(ctx, b, chatID, update.Message)
+	if !ok {
+		return
+	}
 
-	_, createMessageErr := db.CreateMessage(ctx, user.ID, match.AngelId, circleName, message, "mortal")
+	message, createMessageErr := h.store.CreateMessage(ctx, &appModels.Message{
+		SenderId:    user.ID,
+		RecepientId: match.AngelId,
+		CircleName:  circleName,
+		CircleId:    circle.ID,
+		SessionId:   session.ID,
+		Payload:     &payload,
+		SenderRole:  "mortal",
+	})
 
 	if createMessageErr != nil {
 		fmt.Printf("There was an error creating the message: %s\n", createMessageErr)
@@ -808,7 +837,7 @@ func SendMessageToAngelWithMessageCommandHandler(ctx context.Context, b *bot.Bot
 		return
 	}
 
-	updateUserStateErr := db.UpdateStateWithCircle(ctx, user.ID, appModels.StateNone, "")
+	updateUserStateErr := h.store.UpdateStateWithCircle(ctx, user.ID, appModels.StateNone, bson.ObjectID{})
 
 	if updateUserStateErr != nil {
 		fmt.Println("Error updating user state:", err)
@@ -816,37 +845,19 @@ func SendMessageToAngelWithMessageCommandHandler(ctx context.Context, b *bot.Bot
 		return
 	}
 
-	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: chatID,
-		Text:   "Your message has been sent!",
-	})
+	h.sendConfirmation(ctx, b, chatID, "", message)
 }
 
-func SendMessageToMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string) {
-	fmt.Println("Start send mortal message process")
+// SendMessageToMortalCommandHandler opens a chat with the user's mortal.
+func (h *Handlers) SendMessageToMortalCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Start chat with mortal")
 
-	user, chatID, err := utils.ExtractUserAndChat(update)
-	if err != nil {
-		fmt.Println("Error extracting user/chat:", err)
-		utils.SendErrorMessage(ctx, b, chatID)
-		return
-	}
-
-	updateUserStateErr := db.UpdateStateWithCircle(ctx, user.ID, appModels.StateWaitingSendMessageToMortal, circleName)
-
-	if updateUserStateErr != nil {
-		fmt.Println("Error updating user state:", err)
-		utils.SendErrorMessage(ctx, b, chatID)
-		return
-	}
-
-	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: chatID,
-		Text:   "What would you like to send to your mortal?",
-	})
+	h.startChat(ctx, b, update, circleId, appModels.StateChattingWithMortal)
 }
 
-func SendMessageToMortalWithMessageCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, user *appModels.User) {
+// SendMessageToMortalWithMessageCommandHandler is the mortal counterpart of
+// SendMessageToAngelWithMessageCommandHandler.
+func (h *Handlers) SendMessageToMortalWithMessageCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, user *appModels.User) {
 	fmt.Println("Send mortal message")
 
 	_, chatID, err := utils.ExtractUserAndChat(update)
@@ -856,28 +867,40 @@ func SendMessageToMortalWithMessageCommandHandler(ctx context.Context, b *bot.Bo
 		return
 	}
 
-	circleName := user.StateCircle
+	circleId := user.StateCircleId
 
-	if circleName == "" {
+	if circleId.IsZero() {
 		fmt.Printf("User had no state circle\n")
 		utils.SendErrorMessage(ctx, b, chatID)
+		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	if getCircleErr != nil {
-		fmt.Printf("There was an error getting circle %s: %s\n", circleName, getCircleErr)
+		fmt.Printf("There was an error getting circle %s: %s\n", circleId.Hex(), getCircleErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
-	if circle.CurrentSession == nil {
-		fmt.Printf("There is no currentSesssion for the circle %s\n", circleName)
+	circleName := circle.Name
+
+	session, getSessErr := h.activeSession(ctx, circle)
+	if getSessErr != nil {
+		fmt.Printf("failed to get the session of circle %s: %v\n", circleName, getSessErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+	if session == nil {
+		fmt.Printf("There is no active session for the circle %s\n", circleName)
+		if err := h.store.UpdateStateWithCircle(ctx, user.ID, appModels.StateNone, bson.ObjectID{}); err != nil {
+			fmt.Println("Error updating user state:", err)
+		}
 		utils.SendCustomErrorMessage(ctx, b, chatID, "There is no current active session for the circle")
 		return
 	}
 
-	match, getMatchErr := db.GetMortalMatch(ctx, *circle.CurrentSession, user.ID)
+	match, getMatchErr := h.store.GetMortalMatch(ctx, session.ID, user.ID)
 
 	if getMatchErr != nil {
 		fmt.Printf("There was an error to get the mortal for user %d: %s\n", user.ID, getMatchErr)
@@ -885,9 +908,20 @@ func SendMessageToMortalWithMessageCommandHandler(ctx context.Context, b *bot.Bo
 		return
 	}
 
-	message := update.Message.Text
+	payload, ok := relayablePayload(ctx, b, chatID, update.Message)
+	if !ok {
+		return
+	}
 
-	_, createMessageErr := db.CreateMessage(ctx, user.ID, match.MortalId, circleName, message, "angel")
+	message, createMessageErr := h.store.CreateMessage(ctx, &appModels.Message{
+		SenderId:    user.ID,
+		RecepientId: match.MortalId,
+		CircleName:  circleName,
+		CircleId:    circle.ID,
+		SessionId:   session.ID,
+		Payload:     &payload,
+		SenderRole:  "angel",
+	})
 
 	if createMessageErr != nil {
 		fmt.Printf("There was an error creating the message: %s\n", createMessageErr)
@@ -895,7 +929,7 @@ func SendMessageToMortalWithMessageCommandHandler(ctx context.Context, b *bot.Bo
 		return
 	}
 
-	updateUserStateErr := db.UpdateStateWithCircle(ctx, user.ID, appModels.StateNone, "")
+	updateUserStateErr := h.store.UpdateStateWithCircle(ctx, user.ID, appModels.StateNone, bson.ObjectID{})
 
 	if updateUserStateErr != nil {
 		fmt.Println("Error updating user state:", err)
@@ -903,13 +937,44 @@ func SendMessageToMortalWithMessageCommandHandler(ctx context.Context, b *bot.Bo
 		return
 	}
 
-	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID: chatID,
-		Text:   "Your message has been sent!",
-	})
+	h.sendConfirmation(ctx, b, chatID, "", message)
 }
 
-func EndSessionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleName string) {
+// Reveal modes an owner or admin can pick when ending a session.
+const (
+	RevealPrivate int64 = 0
+	RevealPublic  int64 = 1
+)
+
+func (h *Handlers) ChooseRevealModeCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Choosing reveal mode")
+
+	_, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	revealMenu := ui.Menu{
+		Title:   fmt.Sprintf("👥 Circle: %s\nHow should angels be revealed when the session ends?", circle.Name),
+		Buttons: [][]ui.MenuButton{},
+	}
+	revealMenu.AddButtonRow("🤫 Private reveal only", commands.Encode(commands.EndSessionCommand, circle.ID, RevealPrivate))
+	revealMenu.AddButtonRow("📣 Public chain reveal", commands.Encode(commands.EndSessionCommand, circle.ID, RevealPublic))
+	revealMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, circle.ID))
+	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, revealMenu)
+}
+
+// EndSessionCommandHandler finishes the circle's session and tells every
+// member who their angel was. With RevealPublic the whole chain is also
+// posted to everyone.
+func (h *Handlers) EndSessionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, revealMode int64) {
 	fmt.Println("End Session")
 
 	_, chatID, extractErr := utils.ExtractUserAndChat(update)
@@ -919,14 +984,14 @@ func EndSessionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Up
 		return
 	}
 
-	circle, getCircleErr := db.GetCircle(ctx, circleName)
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
 
 	if getCircleErr != nil {
-		if errors.Is(getCircleErr, mongo.ErrNoDocuments) {
+		if errors.Is(getCircleErr, db.ErrNotFound) {
 			// Custom user-friendly message
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
-				Text:   fmt.Sprintf("No circle found with the name '%s'.", circleName),
+				Text:   "This circle no longer exists.",
 			})
 
 			if menu, ok := ui.GetMenu(ui.MenuNameMain); ok {
@@ -934,7 +999,7 @@ func EndSessionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Up
 			}
 			return
 		}
-		fmt.Printf("failed to get circle %s: %v\n", circleName, getCircleErr)
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
@@ -944,9 +1009,9 @@ func EndSessionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Up
 		return
 	}
 
-	session, getSessErr := db.GetSession(ctx, *circle.CurrentSession)
+	session, getSessErr := h.store.GetSession(ctx, *circle.CurrentSession)
 	if getSessErr != nil {
-		if errors.Is(getSessErr, mongo.ErrNoDocuments) || session == nil {
+		if errors.Is(getSessErr, db.ErrNotFound) {
 			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 				ChatID: chatID,
 				Text:   "You don't seem to have an active session.",
@@ -967,19 +1032,28 @@ func EndSessionCommandHandler(ctx context.Context, b *bot.Bot, update *models.Up
 		return
 	}
 
-	// Mark session as finished
-	updated, finishErr := db.UpdateSessionToFinished(ctx, session.ID)
+	// Mark session as finished. Only one of several admins ending it at once
+	// gets it back, so the reveals are sent once.
+	updated, finishErr := h.store.UpdateSessionToFinished(ctx, session.ID)
+	if errors.Is(finishErr, db.ErrNotFound) {
+		fmt.Println("Session was finished concurrently:", session.ID)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "Session has already been completed!")
+		return
+	}
 	if finishErr != nil {
 		fmt.Println("failed to finish session:", finishErr)
 		utils.SendErrorMessage(ctx, b, chatID)
 		return
 	}
 
+	if notifyErr := h.notifySessionEnd(ctx, circle, updated, revealMode == RevealPublic); notifyErr != nil {
+		// Members can still press "Reveal angel" themselves.
+		fmt.Printf("failed to queue session end notifications for circle %s: %v\n", circle.Name, notifyErr)
+	}
+
 	// Success message
 	_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: chatID,
-		Text:   "Your session has been ended. Thanks for playing! 🎉",
+		Text:   "Your session has been ended. Thanks for playing! 🎉\nEvery member will get a private message revealing their angel.",
 	})
-
-	_ = updated
 }
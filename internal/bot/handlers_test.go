@@ -0,0 +1,1311 @@
+package handlers_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	handlers "grandfather/internal/bot"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/config"
+	"grandfather/internal/db"
+	appModels "grandfather/internal/models"
+	"grandfather/internal/outbox"
+	"grandfather/internal/telegramtest"
+	"grandfather/internal/ui"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+var (
+	alice = telegramtest.NewUser(1001, "Alice", "alice")
+	bob   = telegramtest.NewUser(1002, "Bob", "bob")
+	carol = telegramtest.NewUser(1003, "Carol", "carol")
+)
+
+func newTestBot(t *testing.T) (*telegramtest.Harness, *db.MemoryStore) {
+	t.Helper()
+
+	th, store, _ := newTestBotWithConfig(t, config.Default().Bot)
+	return th, store
+}
+
+func newTestBotWithConfig(t *testing.T, cfg config.BotConfig) (*telegramtest.Harness, *db.MemoryStore, *handlers.Handlers) {
+	t.Helper()
+
+	ui.RegisterMenus()
+	store := db.NewMemoryStore()
+	h := handlers.New(store, cfg)
+
+	th := telegramtest.New(t, bot.WithDefaultHandler(h.DefaultHandler))
+	h.Register(th.Bot)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	outboxCfg := config.Default().Outbox
+	outboxCfg.PollInterval = 10 * time.Millisecond
+	outboxCfg.RetryBaseDelay = 10 * time.Millisecond
+	ob := outbox.NewOutbox(ctx, th.Bot, store, outboxCfg)
+	t.Cleanup(func() {
+		ob.Stop()
+		cancel()
+	})
+
+	return th, store, h
+}
+
+func expectReply(t *testing.T, th *telegramtest.Harness, user models.User, want string) {
+	t.Helper()
+
+	texts := th.TextsSinceLastAction(user)
+	for _, text := range texts {
+		if strings.Contains(text, want) {
+			return
+		}
+	}
+	t.Fatalf("messages to %s since their last action = %q, want one containing %q", user.FirstName, texts, want)
+}
+
+// inviteLink has owner open the circle's invite screen and returns the link.
+func inviteLink(t *testing.T, th *telegramtest.Harness, owner models.User) string {
+	t.Helper()
+
+	th.PressButton(owner, "Share invite link")
+	for _, line := range strings.Split(th.LastText(owner), "\n") {
+		if strings.HasPrefix(line, "https://t.me/") {
+			return line
+		}
+	}
+	t.Fatalf("no invite link in %q", th.LastText(owner))
+	return ""
+}
+
+func startPayload(link string) string {
+	_, payload, _ := strings.Cut(link, "?start=")
+	return "/start " + payload
+}
+
+// setUpCircle registers every user and has the first one create "Book Club"
+// which the rest join through its invite link.
+func setUpCircle(t *testing.T, th *telegramtest.Harness, owner models.User, members ...models.User) {
+	t.Helper()
+
+	th.Send(owner, "/start")
+	th.PressButton(owner, "Start new circle")
+	expectReply(t, th, owner, "What would you like to name your circle?")
+	th.Send(owner, "Book Club")
+	expectReply(t, th, owner, "Circle: Book Club")
+
+	link := inviteLink(t, th, owner)
+	th.PressButton(owner, "Back")
+
+	for _, m := range members {
+		th.Send(m, startPayload(link))
+		expectReply(t, th, m, "Circle: Book Club")
+	}
+}
+
+func startSession(t *testing.T, th *telegramtest.Harness, owner models.User, length string) {
+	t.Helper()
+
+	th.PressButton(owner, "Start session")
+	expectReply(t, th, owner, "How long should the new session run?")
+	th.PressButton(owner, length)
+	expectReply(t, th, owner, "Your session has been started")
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+
+	startSession(t, th, alice, "No deadline")
+
+	circle, err := store.GetCircle(ctx, "Book Club")
+	if err != nil || circle.CurrentSession == nil {
+		t.Fatalf("circle has no current session: %+v, %v", circle, err)
+	}
+	angelMatch, err := store.GetAngelMatch(ctx, *circle.CurrentSession, bob.ID)
+	if err != nil {
+		t.Fatalf("bob has no angel: %v", err)
+	}
+
+	th.PressButton(bob, "💬 Chat with angel")
+	expectReply(t, th, bob, "You're now chatting with your angel")
+	th.Send(bob, "thanks for the snacks")
+	expectReply(t, th, bob, "Queued for your angel")
+
+	_, delivered := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.Method == "sendMessage" && c.ChatID() == angelMatch.AngelId && strings.Contains(c.Text(), "thanks for the snacks")
+	})
+	if !delivered {
+		t.Fatalf("message was never relayed to bob's angel %d", angelMatch.AngelId)
+	}
+
+	th.PressButton(bob, "Reveal angel")
+	expectReply(t, th, bob, "The session is not yet over!")
+
+	th.PressButton(alice, "End session")
+	expectReply(t, th, alice, "How should angels be revealed")
+	th.PressButton(alice, "🤫 Private reveal only")
+	expectReply(t, th, alice, "Your session has been ended")
+
+	angel, _ := store.GetUser(ctx, angelMatch.AngelId)
+	call, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == bob.ID && strings.Contains(c.Text(), "has ended")
+	})
+	if !ok {
+		t.Fatal("bob was not told the session ended")
+	}
+	if want := `<span class="tg-spoiler">` + angel.FirstName; !strings.Contains(call.Text(), want) {
+		t.Errorf("bob's end notification %q does not reveal his angel %s", call.Text(), angel.FirstName)
+	}
+
+	th.PressButton(bob, "Reveal angel")
+	expectReply(t, th, bob, "Your angel is: ")
+	expectReply(t, th, bob, angel.FirstName)
+}
+
+func TestSessionCannotStartTwice(t *testing.T) {
+	th, _ := newTestBot(t)
+
+	setUpCircle(t, th, alice, bob)
+
+	startSession(t, th, alice, "No deadline")
+
+	th.PressButton(alice, "Back")
+	th.PressButton(alice, "Start session")
+	th.PressButton(alice, "No deadline")
+	expectReply(t, th, alice, "There’s already an active session running for this circle")
+}
+
+func TestConcurrentStartsMakeOneSession(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+	th.PressButton(alice, "Start session")
+
+	var start telegramtest.Call
+	for _, c := range th.Server.CallsTo("editMessageText", alice.ID) {
+		if _, ok := c.Button("No deadline"); ok {
+			start = c
+		}
+	}
+	data, _ := start.Button("No deadline")
+
+	// Impatient owners tap more than once.
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			th.Press(alice, data, start.MessageID)
+		}()
+	}
+	wg.Wait()
+
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	sessions, err := store.GetCircleSessions(ctx, circle.ID)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("sessions = %d (%v), want exactly one", len(sessions), err)
+	}
+	if circle.CurrentSession == nil || *circle.CurrentSession != sessions[0].ID {
+		t.Errorf("current session = %v, want %s", circle.CurrentSession, sessions[0].ID.Hex())
+	}
+	matches, _ := store.GetMatches(ctx, sessions[0].ID)
+	if len(matches) != 3 {
+		t.Errorf("matches = %d, want one per member", len(matches))
+	}
+}
+
+func TestConcurrentEndsRevealOnce(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	if _, err := store.AddCircleAdmin(ctx, circle.ID, bob.ID); err != nil {
+		t.Fatalf("AddCircleAdmin: %v", err)
+	}
+	startSession(t, th, alice, "No deadline")
+
+	// The owner and an admin both end the session at the same moment.
+	var wg sync.WaitGroup
+	for i := range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user := []models.User{alice, bob}[i%2]
+			th.Press(user, commands.Encode(commands.EndSessionCommand, circle.ID, handlers.RevealPrivate), th.Server.NextMessageID())
+		}()
+	}
+	wg.Wait()
+
+	for {
+		pending, _ := store.GetUndeliveredMessages(ctx)
+		if len(pending) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, member := range []models.User{alice, bob, carol} {
+		reveals := 0
+		for _, c := range th.Server.CallsTo("sendMessage", member.ID) {
+			if strings.Contains(c.Text(), "has ended") {
+				reveals++
+			}
+		}
+		if reveals != 1 {
+			t.Errorf("%s was told their angel %d times, want once", member.FirstName, reveals)
+		}
+	}
+}
+
+func TestCircleNamesAreUnique(t *testing.T) {
+	th, _ := newTestBot(t)
+
+	setUpCircle(t, th, alice)
+
+	th.Send(bob, "/start")
+	th.PressButton(bob, "Start new circle")
+	th.Send(bob, "Book Club")
+	expectReply(t, th, bob, `There is already a circle called "Book Club"`)
+
+	// bob is still asked for a name, so another one works.
+	th.Send(bob, "Chess Club")
+	expectReply(t, th, bob, "Circle: Chess Club")
+}
+
+func TestJoinWithPastedInviteLink(t *testing.T) {
+	th, store := newTestBot(t)
+
+	setUpCircle(t, th, alice)
+	link := inviteLink(t, th, alice)
+
+	th.Send(bob, "/start")
+	th.PressButton(bob, "Join circle")
+	th.Send(bob, link)
+	expectReply(t, th, bob, "Circle: Book Club")
+
+	circle, _ := store.GetCircle(context.Background(), "Book Club")
+	if len(circle.Members) != 2 {
+		t.Fatalf("members = %v, want alice and bob", circle.Members)
+	}
+}
+
+func TestUsersLeftWaitingForACircleNameAreAskedForAnInvite(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice)
+	th.Send(bob, "/start")
+	if err := store.UpdateState(ctx, bob.ID, appModels.StateWaitingJoinCircleName); err != nil {
+		t.Fatalf("UpdateState: %v", err)
+	}
+
+	th.Send(bob, "Book Club")
+	expectReply(t, th, bob, "invalid or has been disabled")
+
+	user, _ := store.GetUser(ctx, bob.ID)
+	if user.State != appModels.StateNone {
+		t.Errorf("bob's state = %q, want it cleared", user.State)
+	}
+}
+
+func TestJoinWithInvalidInvite(t *testing.T) {
+	th, _ := newTestBot(t)
+
+	th.Send(bob, "/start join_nope")
+
+	if calls := th.Server.CallsTo("sendMessage", bob.ID); !strings.Contains(calls[len(calls)-2].Text(), "invalid or has been disabled") {
+		t.Fatalf("expected an invalid-invite reply, got %q", calls[len(calls)-2].Text())
+	}
+	expectReply(t, th, bob, "Welcome! Choose an option:")
+}
+
+func TestRotatedAndDisabledInvitesAreRejected(t *testing.T) {
+	th, _ := newTestBot(t)
+
+	setUpCircle(t, th, alice)
+	oldLink := inviteLink(t, th, alice)
+
+	th.PressButton(alice, "Rotate link")
+	newLink := inviteLink(t, th, alice)
+	if newLink == oldLink {
+		t.Fatalf("rotating kept the same link %s", oldLink)
+	}
+
+	th.Send(bob, startPayload(oldLink))
+	expectReply(t, th, bob, "Welcome! Choose an option:")
+
+	th.PressButton(alice, "Disable link")
+	expectReply(t, th, alice, "The invite link has been disabled")
+
+	th.Send(carol, startPayload(newLink))
+	expectReply(t, th, carol, "Welcome! Choose an option:")
+}
+
+func TestUnregisteredUserIsAskedToStart(t *testing.T) {
+	th, _ := newTestBot(t)
+
+	th.Send(carol, "hello?")
+	expectReply(t, th, carol, "run the /start command")
+}
+
+func TestLegacyCallbackDataStillWorks(t *testing.T) {
+	th, _ := newTestBot(t)
+
+	setUpCircle(t, th, alice, bob)
+
+	th.Press(bob, "getMemberListCommand@Book Club", 1)
+	expectReply(t, th, bob, "Members: @alice, @bob")
+}
+
+func TestSessionStartNotifiesEveryMember(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+	startSession(t, th, alice, "2 weeks")
+
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	deadline := time.Now().AddDate(0, 0, 14).Format("Mon, 2 Jan 2006")
+
+	for _, member := range []models.User{alice, bob, carol} {
+		match, err := store.GetMortalMatch(ctx, *circle.CurrentSession, member.ID)
+		if err != nil {
+			t.Fatalf("%s has no mortal: %v", member.FirstName, err)
+		}
+		mortal, _ := store.GetUser(ctx, match.MortalId)
+
+		call, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+			return c.ChatID() == member.ID && strings.Contains(c.Text(), "A new session has started")
+		})
+		if !ok {
+			t.Fatalf("%s was not told the session started", member.FirstName)
+		}
+		if want := `<span class="tg-spoiler">` + mortal.FirstName; !strings.Contains(call.Text(), want) {
+			t.Errorf("%s's announcement %q does not reveal their mortal %s", member.FirstName, call.Text(), mortal.FirstName)
+		}
+		if !strings.Contains(call.Text(), deadline) {
+			t.Errorf("%s's announcement %q does not mention the deadline %s", member.FirstName, call.Text(), deadline)
+		}
+		if _, ok := call.Button("💌 Message my mortal"); !ok {
+			t.Errorf("%s's announcement has no button to message their mortal", member.FirstName)
+		}
+	}
+}
+
+func TestSessionStartSkipsUnregisteredMembers(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	const ghost = 4242
+	if _, err := store.AddUserToCircle(ctx, circle.ID, ghost); err != nil {
+		t.Fatalf("AddUserToCircle: %v", err)
+	}
+	startSession(t, th, alice, "No deadline")
+
+	circle, _ = store.GetCircle(ctx, "Book Club")
+	ghostsAngel, _ := store.GetAngelMatch(ctx, *circle.CurrentSession, ghost)
+	for _, member := range []models.User{alice, bob, carol} {
+		if member.ID == ghostsAngel.AngelId {
+			continue
+		}
+		if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+			return c.ChatID() == member.ID && strings.Contains(c.Text(), "A new session has started")
+		}); !ok {
+			t.Errorf("%s was not told the session started", member.FirstName)
+		}
+	}
+}
+
+func TestPublicRevealPostsChainToEveryone(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+	startSession(t, th, alice, "No deadline")
+
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	first, _ := store.GetMortalMatch(ctx, *circle.CurrentSession, alice.ID)
+	second, _ := store.GetMortalMatch(ctx, *circle.CurrentSession, first.MortalId)
+	var chain []string
+	for _, id := range []int64{alice.ID, first.MortalId, second.MortalId, alice.ID} {
+		u, _ := store.GetUser(ctx, id)
+		chain = append(chain, u.DisplayName())
+	}
+	want := strings.Join(chain, " → ")
+
+	th.PressButton(alice, "End session")
+	th.PressButton(alice, "📣 Public chain reveal")
+	expectReply(t, th, alice, "Your session has been ended")
+
+	for _, member := range []models.User{alice, bob, carol} {
+		call, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+			return c.ChatID() == member.ID && strings.Contains(c.Text(), "was paired")
+		})
+		if !ok {
+			t.Fatalf("%s did not get the reveal chain", member.FirstName)
+		}
+		if !strings.Contains(call.Text(), want) {
+			t.Errorf("%s's chain %q does not contain %q", member.FirstName, call.Text(), want)
+		}
+	}
+}
+
+func TestNonOwnerCannotEndSession(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	th.Press(bob, commands.Encode(commands.EndSessionCommand, circle.ID, handlers.RevealPublic), th.Server.NextMessageID())
+	expectReply(t, th, bob, "It doesn't seem like you are an admin")
+
+	session, _ := store.GetSession(ctx, *circle.CurrentSession)
+	if session.State == appModels.StateFinished {
+		t.Fatal("a member was able to end the owner's session")
+	}
+}
+
+func TestForgedCallbacksAreRefusedAndAudited(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	var audit bytes.Buffer
+	log.SetOutput(&audit)
+	defer log.SetOutput(os.Stderr)
+
+	setUpCircle(t, th, alice, bob)
+	th.Send(carol, "/start")
+
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	th.Press(bob, commands.Encode(commands.StartNewSessionCommand, circle.ID, 0), th.Server.NextMessageID())
+	expectReply(t, th, bob, "It doesn't seem like you are an admin")
+
+	th.Press(carol, commands.Encode(commands.GetCircleCommand, circle.ID), th.Server.NextMessageID())
+	expectReply(t, th, carol, "You don't seem to be a part of this circle!")
+
+	circle, _ = store.GetCircle(ctx, "Book Club")
+	if circle.CurrentSession != nil {
+		t.Fatal("a member was able to start a session")
+	}
+
+	log.SetOutput(os.Stderr)
+	for _, want := range []string{
+		fmt.Sprintf("user %d (@bob): needs admin, is member", bob.ID),
+		fmt.Sprintf("user %d (@carol): needs member, is non-member", carol.ID),
+	} {
+		if !strings.Contains(audit.String(), want) {
+			t.Errorf("audit log %q is missing %q", audit.String(), want)
+		}
+	}
+}
+
+func TestAdminsCanRunSessionsAndRemoveMembers(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+
+	th.PressButton(alice, "Manage admins")
+	th.PressButton(alice, "Bob (@bob)")
+	expectReply(t, th, alice, "✅ Admin added.")
+	if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == bob.ID && strings.Contains(c.Text(), "You are now an admin of circle")
+	}); !ok {
+		t.Fatal("bob was not told he is an admin")
+	}
+
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	th.Press(bob, commands.Encode(commands.GetCircleCommand, circle.ID), th.Server.NextMessageID())
+	startSession(t, th, bob, "No deadline")
+
+	// Admins don't get the owner's tools.
+	th.Press(bob, commands.Encode(commands.ManageAdminsCommand, circle.ID), th.Server.NextMessageID())
+	expectReply(t, th, bob, "It doesn't seem like you are the owner")
+	th.Press(bob, commands.Encode(commands.RemoveSpecificUserCommand, circle.ID, alice.ID), th.Server.NextMessageID())
+	expectReply(t, th, bob, "The owner cannot be removed from the circle!")
+
+	th.Press(bob, commands.Encode(commands.RemoveUserCommand, circle.ID), th.Server.NextMessageID())
+	th.PressButton(bob, "Carol  @carol")
+	expectReply(t, th, bob, "User has been removed from Book Club")
+
+	circle, _ = store.GetCircle(ctx, "Book Club")
+	if circle.RoleOf(carol.ID) != appModels.RoleNone {
+		t.Errorf("carol is still %s of the circle", circle.RoleOf(carol.ID))
+	}
+
+	th.PressButton(alice, "⭐ Bob (@bob)")
+	expectReply(t, th, alice, "🗑 Admin removed.")
+	th.Press(bob, commands.Encode(commands.ChooseRevealModeCommand, circle.ID), th.Server.NextMessageID())
+	expectReply(t, th, bob, "It doesn't seem like you are an admin")
+}
+
+func TestOwnershipTransferNeedsAcceptance(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+	circle, _ := store.GetCircle(ctx, "Book Club")
+
+	// Nobody can take a circle that wasn't offered to them.
+	th.Press(carol, commands.Encode(commands.AcceptOwnershipCommand, circle.ID), th.Server.NextMessageID())
+	expectReply(t, th, carol, "This offer has been withdrawn or has already been answered.")
+
+	th.PressButton(alice, "Transfer ownership")
+	th.PressButton(alice, "Bob (@bob)")
+	expectReply(t, th, alice, "You stay the owner until they accept")
+
+	offer, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == bob.ID && strings.Contains(c.Text(), "would like you to take over")
+	})
+	if !ok {
+		t.Fatal("bob was not offered the circle")
+	}
+	if circle, _ = store.GetCircle(ctx, "Book Club"); circle.OwnerId != alice.ID {
+		t.Fatal("the circle changed hands before bob accepted")
+	}
+
+	th.Press(carol, commands.Encode(commands.AcceptOwnershipCommand, circle.ID), th.Server.NextMessageID())
+	expectReply(t, th, carol, "This offer has been withdrawn or has already been answered.")
+
+	accept, _ := offer.Button("✅ Accept")
+	th.Press(bob, accept, offer.MessageID)
+	expectReply(t, th, bob, "You are now the owner of Book Club!")
+	th.PressButton(bob, "Transfer ownership")
+	expectReply(t, th, bob, "Who should become the new owner?")
+
+	circle, _ = store.GetCircle(ctx, "Book Club")
+	if circle.RoleOf(bob.ID) != appModels.RoleOwner || circle.RoleOf(alice.ID) != appModels.RoleAdmin {
+		t.Fatalf("after the transfer bob is %s and alice is %s; want owner and admin", circle.RoleOf(bob.ID), circle.RoleOf(alice.ID))
+	}
+	if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == alice.ID && strings.Contains(c.Text(), "is now the owner of circle")
+	}); !ok {
+		t.Error("alice was not told bob accepted")
+	}
+
+	// The offer can't be accepted twice.
+	th.Press(bob, accept, offer.MessageID)
+	expectReply(t, th, bob, "This offer has been withdrawn or has already been answered.")
+}
+
+func TestExclusionsShapeMatching(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob)
+
+	th.PressButton(alice, "Manage exclusions")
+	expectReply(t, th, alice, "There are no exclusions yet.")
+	th.PressButton(alice, "➕ Add exclusion")
+	th.PressButton(alice, "Alice (@alice)")
+	th.PressButton(alice, "Bob (@bob)")
+	th.PressButton(alice, "Both ways (Alice (@alice) ↮ Bob (@bob))")
+	expectReply(t, th, alice, "Exclusion added.")
+
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	if len(circle.Exclusions) != 2 {
+		t.Fatalf("circle has exclusions %+v, want both directions", circle.Exclusions)
+	}
+
+	th.PressButton(alice, "Back")
+	th.PressButton(alice, "Start session")
+	th.PressButton(alice, "No deadline")
+	expectReply(t, th, alice, "Nobody can be paired up")
+	if circle, _ := store.GetCircle(ctx, "Book Club"); circle.CurrentSession != nil {
+		t.Fatal("a session was started despite the exclusions")
+	}
+
+	th.PressButton(alice, "Manage exclusions")
+	th.PressButton(alice, "❌ Bob (@bob) ↛ Alice (@alice)")
+	expectReply(t, th, alice, "Exclusion removed.")
+	th.PressButton(alice, "❌ Alice (@alice) ↛ Bob (@bob)")
+	expectReply(t, th, alice, "There are no exclusions yet.")
+
+	th.PressButton(alice, "Back")
+	startSession(t, th, alice, "No deadline")
+}
+
+func TestExclusionsAreRespectedWhenMatching(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+
+	th.PressButton(alice, "Manage exclusions")
+	th.PressButton(alice, "➕ Add exclusion")
+	th.PressButton(alice, "Alice (@alice)")
+	th.PressButton(alice, "Bob (@bob)")
+	th.PressButton(alice, "Alice (@alice) ↛ Bob (@bob) only")
+	th.PressButton(alice, "Back")
+
+	for range 5 {
+		startSession(t, th, alice, "No deadline")
+
+		circle, _ := store.GetCircle(ctx, "Book Club")
+		match, err := store.GetMortalMatch(ctx, *circle.CurrentSession, alice.ID)
+		if err != nil {
+			t.Fatalf("alice has no mortal: %v", err)
+		}
+		if match.MortalId == bob.ID {
+			t.Fatal("alice was given bob despite the exclusion")
+		}
+
+		th.PressButton(alice, "End session")
+		th.PressButton(alice, "🤫 Private reveal only")
+		expectReply(t, th, alice, "Your session has been ended")
+	}
+}
+
+func TestNewSessionsAvoidPreviousPairings(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+
+	mortals := func() map[int64]int64 {
+		circle, _ := store.GetCircle(ctx, "Book Club")
+		matches, err := store.GetMatches(ctx, *circle.CurrentSession)
+		if err != nil {
+			t.Fatalf("get matches: %v", err)
+		}
+		m := map[int64]int64{}
+		for _, match := range matches {
+			m[match.AngelId] = match.MortalId
+		}
+		return m
+	}
+	endSession := func() {
+		th.PressButton(alice, "End session")
+		th.PressButton(alice, "🤫 Private reveal only")
+		expectReply(t, th, alice, "Your session has been ended")
+	}
+
+	startSession(t, th, alice, "No deadline")
+	first := mortals()
+	endSession()
+
+	startSession(t, th, alice, "No deadline")
+	second := mortals()
+	for angel, mortal := range second {
+		if first[angel] == mortal {
+			t.Errorf("%d was given %d again although another pairing was possible", angel, mortal)
+		}
+	}
+	endSession()
+
+	// Three people only have two possible chains, so now every pairing repeats.
+	startSession(t, th, alice, "No deadline")
+	expectReply(t, th, alice, "3 pairings from the last 2 sessions could not be avoided")
+}
+
+func TestMediaIsRelayedAnonymously(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	match, _ := store.GetAngelMatch(ctx, *circle.CurrentSession, alice.ID)
+	angel := match.AngelId
+
+	th.PressButton(alice, "💬 Chat with angel")
+	relay := func(msg models.Message) {
+		t.Helper()
+		th.SendMessage(alice, msg)
+		expectReply(t, th, alice, "Queued for your angel")
+	}
+	waitFor := func(method string) telegramtest.Call {
+		t.Helper()
+		call, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+			return c.Method == method && c.ChatID() == angel
+		})
+		if !ok {
+			t.Fatalf("no %s to alice's angel", method)
+		}
+		return call
+	}
+
+	relay(models.Message{
+		Photo:   []models.PhotoSize{{FileID: "small-photo"}, {FileID: "large-photo"}},
+		Caption: "look at this cake",
+	})
+	photo := waitFor("sendPhoto")
+	if photo.Params["photo"] != "large-photo" {
+		t.Errorf("sent photo %q, want the largest size", photo.Params["photo"])
+	}
+	if caption := photo.Params["caption"]; !strings.Contains(caption, "from your mortal") || !strings.Contains(caption, "look at this cake") {
+		t.Errorf("photo caption = %q, want the header and the original caption", caption)
+	}
+
+	relay(models.Message{Sticker: &models.Sticker{FileID: "sticker-id"}})
+	if sticker := waitFor("sendSticker"); sticker.Params["sticker"] != "sticker-id" {
+		t.Errorf("sent sticker %q, want sticker-id", sticker.Params["sticker"])
+	}
+
+	relay(models.Message{Location: &models.Location{Latitude: 1.29, Longitude: 103.85}})
+	if location := waitFor("sendLocation"); location.Params["latitude"] != "1.29" {
+		t.Errorf("sent location %v, want latitude 1.29", location.Params)
+	}
+
+	relay(models.Message{Audio: &models.Audio{FileID: "audio-id"}})
+	if copied := waitFor("copyMessage"); copied.Params["from_chat_id"] != fmt.Sprint(alice.ID) {
+		t.Errorf("copied from %q, want alice's chat", copied.Params["from_chat_id"])
+	}
+
+	for _, c := range th.Server.Calls() {
+		if c.ChatID() == angel && c.Method == "forwardMessage" {
+			t.Fatal("a relay was forwarded, which reveals the sender")
+		}
+	}
+}
+
+func TestOverlongMessagesAreRefused(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	match, _ := store.GetAngelMatch(ctx, *circle.CurrentSession, alice.ID)
+
+	// Premium users can write captions longer than a bot may send.
+	th.PressButton(alice, "💬 Chat with angel")
+	th.SendMessage(alice, models.Message{
+		Photo:   []models.PhotoSize{{FileID: "photo"}},
+		Caption: strings.Repeat("a", appModels.MaxCaptionLength+1),
+	})
+	expectReply(t, th, alice, "Sorry, that's too long to send")
+
+	if calls := th.Server.CallsTo("sendPhoto", match.AngelId); len(calls) != 0 {
+		t.Errorf("the photo was relayed %d times, want none", len(calls))
+	}
+}
+
+func TestChatModeRelaysUntilExit(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob, carol)
+	startSession(t, th, alice, "No deadline")
+	circle, _ := store.GetCircle(ctx, "Book Club")
+	angelMatch, _ := store.GetAngelMatch(ctx, *circle.CurrentSession, bob.ID)
+	mortalMatch, _ := store.GetMortalMatch(ctx, *circle.CurrentSession, bob.ID)
+
+	th.PressButton(bob, "💬 Chat with angel")
+	expectReply(t, th, bob, "You're now chatting with your angel in Book Club")
+	for _, text := range []string{"first", "second"} {
+		th.Send(bob, text)
+		expectReply(t, th, bob, "Chatting with your angel in Book Club")
+		if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+			return c.ChatID() == angelMatch.AngelId && strings.HasSuffix(c.Text(), text)
+		}); !ok {
+			t.Fatalf("%q never reached bob's angel", text)
+		}
+	}
+
+	th.PressButton(bob, "🔄 Switch to my mortal")
+	expectReply(t, th, bob, "You're now chatting with your mortal")
+	th.Send(bob, "hello mortal")
+	if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == mortalMatch.MortalId && strings.Contains(c.Text(), "from your angel") && strings.HasSuffix(c.Text(), "hello mortal")
+	}); !ok {
+		t.Fatal("message never reached bob's mortal")
+	}
+
+	th.Send(bob, "/exit")
+	expectReply(t, th, bob, "You've left the chat with your mortal.")
+	th.Send(bob, "not relayed")
+	expectReply(t, th, bob, "Use /start to load up the menu!")
+}
+
+func TestIdleChatsTimeOut(t *testing.T) {
+	cfg := config.Default().Bot
+	cfg.ChatTimeout = 50 * time.Millisecond
+	th, store, h := newTestBotWithConfig(t, cfg)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	// A message sent after the timeout is not relayed.
+	th.PressButton(bob, "💬 Chat with angel")
+	time.Sleep(2 * cfg.ChatTimeout)
+	th.Send(bob, "too late")
+	expectReply(t, th, bob, "timed out, so this message was not sent")
+	if user, _ := store.GetUser(ctx, bob.ID); user.State != appModels.StateNone {
+		t.Fatalf("bob is still in state %q", user.State)
+	}
+
+	// The sweeper closes chats nobody writes in and tells the user.
+	th.PressButton(alice, "💬 Chat with mortal")
+	time.Sleep(2 * cfg.ChatTimeout)
+	if err := h.ExpireIdleChats(ctx); err != nil {
+		t.Fatalf("ExpireIdleChats: %v", err)
+	}
+	if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == alice.ID && strings.Contains(c.Text(), "Your chat with your mortal in <b>Book Club</b> was closed")
+	}); !ok {
+		t.Fatal("alice was not told her chat was closed")
+	}
+	if user, _ := store.GetUser(ctx, alice.ID); user.State != appModels.StateNone {
+		t.Fatalf("alice is still in state %q", user.State)
+	}
+}
+
+func TestNativeRepliesThreadAnonymously(t *testing.T) {
+	th, store := newTestBot(t)
+
+	// With two members, alice and bob are each other's angel and mortal.
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	delivered := func(to models.User, text string) telegramtest.Call {
+		t.Helper()
+		call, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+			return c.ChatID() == to.ID && strings.HasSuffix(c.Text(), text)
+		})
+		if !ok {
+			t.Fatalf("%q never reached %s", text, to.FirstName)
+		}
+		// Replies are matched by the delivered message IDs, which the outbox
+		// stores right after sending.
+		for {
+			pending, _ := store.GetUndeliveredMessages(context.Background())
+			if len(pending) == 0 {
+				return call
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	th.PressButton(alice, "💬 Chat with angel")
+	th.SendMessage(alice, models.Message{ID: 500, Text: "who are you?"})
+	question := delivered(bob, "who are you?")
+
+	// bob isn't chatting, but replying to the relay answers alice.
+	th.SendMessage(bob, models.Message{ID: 600, Text: "wouldn't you like to know", ReplyToMessage: &models.Message{ID: question.MessageID}})
+	expectReply(t, th, bob, "Queued for your mortal")
+
+	answer := delivered(alice, "wouldn't you like to know")
+	if !strings.Contains(answer.Text(), "from your angel") {
+		t.Errorf("answer %q should come from alice's angel", answer.Text())
+	}
+	if !strings.Contains(answer.Params["reply_parameters"], `"message_id":500`) {
+		t.Errorf("answer reply_parameters = %q, want it to reply to alice's message 500", answer.Params["reply_parameters"])
+	}
+
+	th.SendMessage(alice, models.Message{ID: 501, Text: "fine, keep your secrets", ReplyToMessage: &models.Message{ID: answer.MessageID}})
+	expectReply(t, th, alice, "Queued for your angel")
+	if back := delivered(bob, "fine, keep your secrets"); !strings.Contains(back.Params["reply_parameters"], `"message_id":600`) {
+		t.Errorf("second reply_parameters = %q, want it to reply to bob's message 600", back.Params["reply_parameters"])
+	}
+}
+
+func TestEndingTheSessionClosesOpenChats(t *testing.T) {
+	th, store := newTestBot(t)
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	th.PressButton(alice, "💬 Chat with angel")
+	circle, _ := store.GetCircle(context.Background(), "Book Club")
+	th.Press(alice, commands.Encode(commands.EndSessionCommand, circle.ID, handlers.RevealPrivate), th.Server.NextMessageID())
+
+	th.Send(alice, "are you still there?")
+	expectReply(t, th, alice, "The session has ended, so your chat was closed.")
+
+	if _, ok := th.Server.WaitFor(100*time.Millisecond, func(c telegramtest.Call) bool {
+		return c.ChatID() == bob.ID && strings.HasSuffix(c.Text(), "are you still there?")
+	}); ok {
+		t.Fatal("a chat message was relayed after the session ended")
+	}
+	if user, _ := store.GetUser(context.Background(), alice.ID); user.State != appModels.StateNone {
+		t.Errorf("alice's state = %q, want the chat closed", user.State)
+	}
+}
+
+func TestRepliesAfterTheSessionEndedAreRefused(t *testing.T) {
+	th, store := newTestBot(t)
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	th.PressButton(alice, "💬 Chat with angel")
+	th.SendMessage(alice, models.Message{ID: 500, Text: "who are you?"})
+	question, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == bob.ID && strings.HasSuffix(c.Text(), "who are you?")
+	})
+	if !ok {
+		t.Fatal("the relay never reached bob")
+	}
+	for {
+		pending, _ := store.GetUndeliveredMessages(context.Background())
+		if len(pending) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	circle, _ := store.GetCircle(context.Background(), "Book Club")
+	th.Press(alice, commands.Encode(commands.EndSessionCommand, circle.ID, handlers.RevealPrivate), th.Server.NextMessageID())
+
+	th.SendMessage(bob, models.Message{ID: 600, Text: "too late", ReplyToMessage: &models.Message{ID: question.MessageID}})
+	expectReply(t, th, bob, "has ended, so you can't reply to it")
+
+	if _, ok := th.Server.WaitFor(100*time.Millisecond, func(c telegramtest.Call) bool {
+		return c.ChatID() == alice.ID && strings.HasSuffix(c.Text(), "too late")
+	}); ok {
+		t.Fatal("a reply to a finished session's relay was delivered")
+	}
+}
+
+func TestEditsReachDeliveredCopy(t *testing.T) {
+	th, store := newTestBot(t)
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	th.PressButton(alice, "💬 Chat with angel")
+	th.SendMessage(alice, models.Message{ID: 700, Text: "see you at 7"})
+	sent, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.Method == "sendMessage" && c.ChatID() == bob.ID && strings.HasSuffix(c.Text(), "see you at 7")
+	})
+	if !ok {
+		t.Fatal("the message never reached bob")
+	}
+
+	// The delivered ID to edit is stored right after sending.
+	for {
+		pending, _ := store.GetUndeliveredMessages(context.Background())
+		if len(pending) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Formatting characters in the edit are shown as typed.
+	th.EditMessage(alice, models.Message{ID: 700, Text: "see you at 8_ish"})
+	edit, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.Method == "editMessageText" && c.ChatID() == bob.ID && !c.Failed
+	})
+	if !ok {
+		t.Fatal("bob's copy was never edited")
+	}
+	if edit.MessageID != sent.MessageID {
+		t.Errorf("edited message %d, want bob's copy %d", edit.MessageID, sent.MessageID)
+	}
+	if !strings.HasSuffix(edit.Text(), "see you at 8_ish") || !strings.Contains(edit.Text(), "from your mortal") {
+		t.Errorf("edited text = %q, want the relay header and the new text", edit.Text())
+	}
+}
+
+// unsendButton returns the callback data of the unsend button on the latest
+// confirmation in user's chat.
+func unsendButton(th *telegramtest.Harness, user models.User) (string, bool) {
+	calls := th.Server.CallsTo("sendMessage", user.ID)
+	for i := len(calls) - 1; i >= 0; i-- {
+		if data, ok := calls[i].Button("↩️ Unsend"); ok {
+			return data, true
+		}
+	}
+	return "", false
+}
+
+func TestUnsendDeletesDeliveredCopy(t *testing.T) {
+	th, store := newTestBot(t)
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	th.PressButton(alice, "💬 Chat with angel")
+	th.Send(alice, "oops, wrong chat")
+	expectReply(t, th, alice, "Queued for your angel")
+	sent, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == bob.ID && strings.HasSuffix(c.Text(), "oops, wrong chat")
+	})
+	if !ok {
+		t.Fatal("the message never reached bob")
+	}
+	// The delivered IDs to delete are stored right after sending.
+	for {
+		pending, _ := store.GetUndeliveredMessages(context.Background())
+		if len(pending) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	data, ok := unsendButton(th, alice)
+	if !ok {
+		t.Fatal("the confirmation has no unsend button")
+	}
+
+	// bob can't take back alice's message.
+	th.Press(bob, data, 1)
+	expectReply(t, th, bob, "You can only unsend your own messages.")
+
+	th.PressButton(alice, "↩️ Unsend")
+	expectReply(t, th, alice, "↩️ Message unsent.")
+
+	deletes := th.Server.CallsTo("deleteMessages", bob.ID)
+	if len(deletes) != 1 || !strings.Contains(deletes[0].Params["message_ids"], strconv.Itoa(sent.MessageID)) {
+		t.Fatalf("deleteMessages calls = %v, want one deleting bob's copy %d", deletes, sent.MessageID)
+	}
+
+	th.Press(alice, data, 1)
+	expectReply(t, th, alice, "This message has already been unsent.")
+}
+
+func TestUnsendWindow(t *testing.T) {
+	cfg := config.Default().Bot
+	cfg.UnsendWindow = time.Nanosecond
+	th, _, _ := newTestBotWithConfig(t, cfg)
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	th.PressButton(alice, "💬 Chat with angel")
+	th.Send(alice, "hello")
+	th.PressButton(alice, "↩️ Unsend")
+	expectReply(t, th, alice, "It's too late to unsend this message.")
+
+	// A zero window turns unsending off altogether.
+	cfg.UnsendWindow = 0
+	th, _, _ = newTestBotWithConfig(t, cfg)
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	th.PressButton(alice, "💬 Chat with angel")
+	th.Send(alice, "hello")
+	expectReply(t, th, alice, "Queued for your angel")
+	if _, ok := unsendButton(th, alice); ok {
+		t.Error("the confirmation offers unsending while it is disabled")
+	}
+}
+
+func TestReceiptsUpdateTheConfirmation(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	edited := func(want string) {
+		t.Helper()
+		if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+			return c.Method == "editMessageText" && c.ChatID() == alice.ID && strings.Contains(c.Text(), want)
+		}); !ok {
+			t.Fatalf("alice's confirmation was never edited to %q", want)
+		}
+	}
+	delivered := func(text string) telegramtest.Call {
+		t.Helper()
+		sent, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+			return c.ChatID() == bob.ID && strings.HasSuffix(c.Text(), text)
+		})
+		if !ok {
+			t.Fatalf("%q never reached bob", text)
+		}
+		// Receipts look the message up by its stored delivered IDs.
+		for {
+			pending, _ := store.GetUndeliveredMessages(ctx)
+			if len(pending) == 0 {
+				return sent
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	th.PressButton(alice, "💬 Chat with angel")
+	th.SendMessage(alice, models.Message{ID: 1000, Text: "guess who"})
+	expectReply(t, th, alice, "🕓 Queued for your angel")
+	sent := delivered("guess who")
+	edited("✅ Delivered to your angel")
+
+	data, ok := sent.Button("👀 Mark read")
+	if !ok {
+		t.Fatal("the delivered copy has no mark read button")
+	}
+	// Only the recipient can say they saw it.
+	th.Press(alice, data, 1)
+	if message, _ := store.GetMessageBySource(ctx, alice.ID, 1000); !message.SeenAt.IsZero() {
+		t.Fatal("the sender marked their own message as seen")
+	}
+
+	th.Press(bob, data, sent.MessageID)
+	edited("👀 Seen by your angel")
+	if calls := th.Server.CallsTo("editMessageReplyMarkup", bob.ID); len(calls) != 1 || len(calls[0].Keyboard()) != 0 {
+		t.Errorf("editMessageReplyMarkup calls = %v, want one removing bob's mark read button", calls)
+	}
+
+	// Reacting counts as having seen it too.
+	th.SendMessage(alice, models.Message{ID: 1001, Text: "still there?"})
+	sent = delivered("still there?")
+	th.React(bob, sent.MessageID, "👍")
+
+	message, err := store.GetMessageBySource(ctx, alice.ID, 1001)
+	if err != nil {
+		t.Fatalf("GetMessageBySource: %v", err)
+	}
+	if message.SeenAt.IsZero() {
+		t.Error("reacting didn't mark the message as seen")
+	}
+	if calls := th.Server.CallsTo("editMessageReplyMarkup", bob.ID); len(calls) != 2 {
+		t.Errorf("editMessageReplyMarkup calls = %v, want the second button removed too", calls)
+	}
+}
+
+func TestMessageHistoryPagesAnonymously(t *testing.T) {
+	th, store := newTestBot(t)
+
+	setUpCircle(t, th, alice, bob)
+	// Relays from before they recorded their session have none.
+	circle, _ := store.GetCircle(context.Background(), "Book Club")
+	if _, err := store.CreateMessage(context.Background(), &appModels.Message{
+		SenderId:    alice.ID,
+		RecepientId: bob.ID,
+		CircleId:    circle.ID,
+		CircleName:  circle.Name,
+		SenderRole:  "mortal",
+		Payload:     &appModels.Payload{Type: appModels.PayloadText, Text: "from long ago"},
+	}); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	startSession(t, th, alice, "No deadline")
+
+	// Confirmations are still being edited as the notes are delivered, so
+	// the page is looked for among everything shown since.
+	historyPage := func() string {
+		t.Helper()
+		texts := th.TextsSinceLastAction(alice)
+		for i := len(texts) - 1; i >= 0; i-- {
+			if strings.Contains(texts[i], "📜 Message history") {
+				return texts[i]
+			}
+		}
+		t.Fatalf("no history page among %q", texts)
+		return ""
+	}
+
+	th.PressButton(alice, "💬 Chat with angel")
+	for i := 1; i <= 11; i++ {
+		th.Send(alice, fmt.Sprintf("note %02d", i))
+	}
+	th.PressButton(bob, "💬 Chat with mortal")
+	th.Send(bob, "hello from your angel")
+
+	th.PressButton(alice, "📜 Message history")
+	page := historyPage()
+	for _, want := range []string{"— Current session —", "⬅️ From your angel", "hello from your angel", "➡️ To your angel", "note 11", "note 03"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("first page = %q, want it to contain %q", page, want)
+		}
+	}
+	if strings.Contains(page, "note 02") {
+		t.Errorf("first page = %q, want only the ten newest messages", page)
+	}
+	for _, name := range []string{alice.FirstName, bob.FirstName} {
+		if strings.Contains(page, name) {
+			t.Errorf("first page = %q, want no names in it", page)
+		}
+	}
+
+	th.PressButton(alice, "Older ➡️")
+	page = historyPage()
+	if !strings.Contains(page, "note 02") || !strings.Contains(page, "note 01") || strings.Contains(page, "note 03") {
+		t.Errorf("second page = %q, want the two oldest notes", page)
+	}
+	if !strings.Contains(page, "— Earlier messages —\n➡️ To your angel") || strings.Contains(page, "1970") {
+		t.Errorf("second page = %q, want the message without a session under a heading of its own", page)
+	}
+
+	th.PressButton(alice, "⬅️ Newer")
+	expectReply(t, th, alice, "note 11")
+}
+
+func TestOutboxRetriesFailedSends(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	// Telegram is having a bad moment, so the first sends to bob fail.
+	th.Server.FailSends(bob.ID, 500, "Internal Server Error")
+	th.PressButton(alice, "💬 Chat with angel")
+	th.SendMessage(alice, models.Message{ID: 800, Text: "are you there?"})
+
+	if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.Failed && c.ChatID() == bob.ID && strings.HasSuffix(c.Text(), "are you there?")
+	}); !ok {
+		t.Fatal("the outbox never tried to send the message")
+	}
+	th.Server.FailSends(bob.ID, 0, "")
+
+	if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return !c.Failed && c.ChatID() == bob.ID && strings.HasSuffix(c.Text(), "are you there?")
+	}); !ok {
+		t.Fatal("the message was not retried")
+	}
+
+	message, err := store.GetMessageBySource(ctx, alice.ID, 800)
+	if err != nil {
+		t.Fatalf("GetMessageBySource: %v", err)
+	}
+	if message.Attempts == 0 || message.LastError == "" {
+		t.Errorf("attempts = %d, last error = %q, want the failed attempts recorded", message.Attempts, message.LastError)
+	}
+}
+
+func TestOutboxGivesUpOnBlockedRecipients(t *testing.T) {
+	th, store := newTestBot(t)
+	ctx := context.Background()
+
+	setUpCircle(t, th, alice, bob)
+	startSession(t, th, alice, "No deadline")
+
+	th.Server.FailSends(bob.ID, 403, "Forbidden: bot was blocked by the user")
+	th.PressButton(alice, "💬 Chat with angel")
+	th.SendMessage(alice, models.Message{ID: 900, Text: "hello?"})
+
+	if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == alice.ID && strings.Contains(c.Text(), "Your message to your angel in circle <b>Book Club</b> could not be delivered")
+	}); !ok {
+		t.Fatal("alice was not told her message could not be delivered")
+	}
+
+	message, err := store.GetMessageBySource(ctx, alice.ID, 900)
+	if err != nil {
+		t.Fatalf("GetMessageBySource: %v", err)
+	}
+	if message.MessageState != appModels.Failed || message.Attempts != 1 {
+		t.Errorf("state = %q after %d attempts, want %q after 1", message.MessageState, message.Attempts, appModels.Failed)
+	}
+	attempts := 0
+	for _, c := range th.Server.CallsTo("sendMessage", bob.ID) {
+		if c.Failed && strings.HasSuffix(c.Text(), "hello?") {
+			attempts++
+		}
+	}
+	if attempts != 1 {
+		t.Errorf("tried to send to bob %d times, want a single attempt", attempts)
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/ui"
+	"grandfather/utils"
+	"strings"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// historyPageSize is how many messages one page of the history shows.
+const historyPageSize = 10
+
+// historyExcerptLength keeps a full page within Telegram's message length.
+const historyExcerptLength = 200
+
+// MessageHistoryCommandHandler shows a page of the messages the user
+// exchanged with their angels and mortals in the circle, newest first.
+// Entries only ever name roles, so the history gives away no more than the
+// chats themselves did.
+func (h *Handlers) MessageHistoryCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID, page int64) {
+	fmt.Println("Message history")
+
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
+	if getCircleErr != nil {
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This circle was not found!")
+		return
+	}
+
+	page = max(page, 0)
+	// One more than fits tells whether there is an older page.
+	messages, getHistoryErr := h.store.GetMessageHistory(ctx, circle.ID, user.ID, int(page)*historyPageSize, historyPageSize+1)
+	if getHistoryErr != nil {
+		fmt.Printf("failed to get message history of user %d in circle %s: %v\n", user.ID, circle.Name, getHistoryErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+	hasOlder := len(messages) > historyPageSize
+	messages = messages[:min(len(messages), historyPageSize)]
+
+	historyMenu := ui.Menu{
+		Title:   historyTitle(circle, user.ID, messages, page),
+		Buttons: [][]ui.MenuButton{},
+	}
+
+	var navigation []ui.MenuButton
+	if page > 0 {
+		navigation = append(navigation, ui.MenuButton{Text: "⬅️ Newer", Command: commands.Encode(commands.MessageHistoryCommand, circle.ID, page-1)})
+	}
+	if hasOlder {
+		navigation = append(navigation, ui.MenuButton{Text: "Older ➡️", Command: commands.Encode(commands.MessageHistoryCommand, circle.ID, page+1)})
+	}
+	if len(navigation) > 0 {
+		historyMenu.AddRow(navigation...)
+	}
+	historyMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, circle.ID))
+	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, historyMenu)
+}
+
+// historyTitle lists messages under a heading for each session they were
+// sent in.
+func historyTitle(circle *appModels.Circle, userID int64, messages []*appModels.Message, page int64) string {
+	var title strings.Builder
+	fmt.Fprintf(&title, "👥 Circle: %s\n📜 Message history", circle.Name)
+	if page > 0 {
+		fmt.Fprintf(&title, " · page %d", page+1)
+	}
+
+	if len(messages) == 0 {
+		if page == 0 {
+			title.WriteString("\n\nYou haven't sent or received any messages in this circle yet.")
+		} else {
+			title.WriteString("\n\nThere are no older messages.")
+		}
+		return title.String()
+	}
+
+	var session bson.ObjectID
+	for i, message := range messages {
+		if i == 0 || message.SessionId != session {
+			session = message.SessionId
+			title.WriteString("\n\n" + sessionHeading(circle, session))
+		}
+
+		sentAt := message.ID.Timestamp().Format("2 Jan 15:04")
+		if message.SenderId == userID {
+			fmt.Fprintf(&title, "\n➡️ To your %s · %s", message.RecipientRole(), sentAt)
+			if message.MessageState == appModels.Failed {
+				title.WriteString(" · ⚠️ not delivered")
+			}
+		} else {
+			fmt.Fprintf(&title, "\n⬅️ From your %s · %s", message.SenderRole, sentAt)
+		}
+		title.WriteString("\n" + utils.Excerpt(messageSummary(message), historyExcerptLength))
+	}
+	return title.String()
+}
+
+// sessionHeading names the session a message was sent in. Sessions are told
+// apart by when they started, which their IDs record. Messages from before
+// relays recorded their session have none.
+func sessionHeading(circle *appModels.Circle, session bson.ObjectID) string {
+	if session.IsZero() {
+		return "— Earlier messages —"
+	}
+	if circle.CurrentSession != nil && *circle.CurrentSession == session {
+		return "— Current session —"
+	}
+	return fmt.Sprintf("— Session from %s —", session.Timestamp().Format("Mon, 2 Jan 2006"))
+}
+
+// messageSummary is the plain text of a relay.
+func messageSummary(message *appModels.Message) string {
+	if message.Payload != nil {
+		return message.Payload.Summary()
+	}
+	return message.Message
+}
@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/db"
+	"grandfather/internal/ui"
+	"grandfather/utils"
+	"slices"
+	"strings"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// botUsername returns the bot's @username, used to build t.me invite links.
+func (h *Handlers) botUsername(ctx context.Context, b *bot.Bot) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.username != "" {
+		return h.username, nil
+	}
+
+	me, err := b.GetMe(ctx)
+	if err != nil {
+		return "", err
+	}
+	h.username = me.Username
+	return h.username, nil
+}
+
+// parseInviteCode accepts a full invite link, a "join_<code>" payload or a
+// bare code and returns the code.
+func parseInviteCode(text string) string {
+	text = strings.TrimSpace(text)
+	if _, after, found := strings.Cut(text, "start="); found {
+		text = after
+	}
+	return strings.TrimPrefix(text, appModels.InvitePayloadPrefix)
+}
+
+// joinCircleByInvite adds user to the circle behind inviteCode and shows them
+// the circle menu.
+func (h *Handlers) joinCircleByInvite(ctx context.Context, b *bot.Bot, chatID int64, user *models.User, inviteCode string) {
+	circle, getCircleErr := h.store.GetCircleByInviteCode(ctx, inviteCode)
+
+	if inviteCode == "" || errors.Is(getCircleErr, db.ErrNotFound) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This invite link is invalid or has been disabled. Ask the circle owner for a new one.")
+		if menu, ok := ui.GetMenu(ui.MenuNameMain); ok {
+			utils.SendMenu(ctx, b, chatID, menu)
+		}
+		return
+	}
+	if getCircleErr != nil {
+		fmt.Printf("failed to get circle by invite code: %v\n", getCircleErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	if slices.Contains(circle.Members, user.ID) {
+		utils.SendCustomErrorMessage(ctx, b, chatID, fmt.Sprintf("You are already a member of %s", circle.Name))
+		utils.SendMenu(ctx, b, chatID, circle.ToMenu(user.ID))
+		return
+	}
+
+	updatedCircle, updateCircleErr := h.store.AddUserToCircle(ctx, circle.ID, user.ID)
+	if updateCircleErr != nil {
+		fmt.Printf("failed to update circle %s: %v\n", circle.Name, updateCircleErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: chatID,
+		Text:   fmt.Sprintf("You have joined the circle %s", updatedCircle.Name),
+	})
+
+	utils.SendMenu(ctx, b, chatID, updatedCircle.ToMenu(user.ID))
+}
+
+// getCircle loads the circle, replying to the user and returning false if it
+// can't. The router has already checked the user's role in it.
+func (h *Handlers) getCircle(ctx context.Context, b *bot.Bot, chatID int64, circleId bson.ObjectID) (*appModels.Circle, bool) {
+	circle, getCircleErr := h.store.GetCircleByID(ctx, circleId)
+
+	if getCircleErr != nil {
+		fmt.Printf("failed to get circle %s: %v\n", circleId.Hex(), getCircleErr)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This circle was not found!")
+		return nil, false
+	}
+
+	return circle, true
+}
+
+func (h *Handlers) showInviteLink(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, circle *appModels.Circle) {
+	username, err := h.botUsername(ctx, b)
+	if err != nil {
+		fmt.Println("failed to get bot username:", err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	title := fmt.Sprintf("🔗 Invite link for %s:\n%s\n\nAnyone with this link can join the circle.", circle.Name, circle.InviteLink(username))
+
+	inviteMenu := ui.Menu{
+		Title:   title,
+		Buttons: [][]ui.MenuButton{},
+	}
+	inviteMenu.AddButtonRow("Rotate link", commands.Encode(commands.RotateInviteLinkCommand, circle.ID))
+	inviteMenu.AddButtonRow("Disable link", commands.Encode(commands.DisableInviteLinkCommand, circle.ID))
+	inviteMenu.AddButtonRow("Back", commands.Encode(commands.GetCircleCommand, circle.ID))
+	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, inviteMenu)
+}
+
+func (h *Handlers) ShareInviteLinkCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Share invite link")
+
+	_, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	// Sharing a disabled link turns invites back on with a fresh code.
+	if circle.InviteCode == "" {
+		updatedCircle, err := h.store.SetCircleInviteCode(ctx, circle.ID, db.NewInviteCode())
+		if err != nil {
+			fmt.Printf("failed to set invite code for circle %s: %v\n", circle.Name, err)
+			utils.SendErrorMessage(ctx, b, chatID)
+			return
+		}
+		circle = updatedCircle
+	}
+
+	h.showInviteLink(ctx, b, update, chatID, circle)
+}
+
+func (h *Handlers) RotateInviteLinkCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Rotate invite link")
+
+	_, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	updatedCircle, err := h.store.SetCircleInviteCode(ctx, circle.ID, db.NewInviteCode())
+	if err != nil {
+		fmt.Printf("failed to rotate invite code for circle %s: %v\n", circle.Name, err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	h.showInviteLink(ctx, b, update, chatID, updatedCircle)
+}
+
+func (h *Handlers) DisableInviteLinkCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, circleId bson.ObjectID) {
+	fmt.Println("Disable invite link")
+
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circle, ok := h.getCircle(ctx, b, chatID, circleId)
+	if !ok {
+		return
+	}
+
+	updatedCircle, err := h.store.SetCircleInviteCode(ctx, circle.ID, "")
+	if err != nil {
+		fmt.Printf("failed to disable invite code for circle %s: %v\n", circle.Name, err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	circleMenu := updatedCircle.ToMenu(user.ID)
+	circleMenu.Title = "🚫 The invite link has been disabled. Share it again to create a new one.\n\n" + circleMenu.Title
+	utils.EditToMenu(ctx, b, update.CallbackQuery.Message.Message.ID, chatID, circleMenu)
+}
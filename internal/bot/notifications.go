@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/ui"
+	"html"
+	"strings"
+	"time"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// sessionStartNotifications builds a private announcement for every angel
+// in matches telling them who their mortal is. They are queued together
+// with the session, and delivered through the outbox so they survive
+// restarts. Angels who aren't registered, or whose mortal isn't, are
+// skipped.
+func (h *Handlers) sessionStartNotifications(ctx context.Context, circle *appModels.Circle, deadline *time.Time, matches []*appModels.Match) ([]*appModels.Message, error) {
+	users, err := h.store.GetUsers(ctx, circle.Members)
+	if err != nil {
+		return nil, err
+	}
+
+	usersById := make(map[int64]*appModels.User, len(users))
+	for _, u := range users {
+		usersById[u.ID] = u
+	}
+
+	deadlineText := ""
+	if deadline != nil {
+		deadlineText = fmt.Sprintf("\n⏰ The session ends on <b>%s</b>.", deadline.Format("Mon, 2 Jan 2006"))
+	}
+
+	notifications := make([]*appModels.Message, 0, len(matches))
+	for _, match := range matches {
+		_, angelOk := usersById[match.AngelId]
+		mortal, mortalOk := usersById[match.MortalId]
+		if !angelOk || !mortalOk {
+			fmt.Printf("not announcing the mortal %d of angel %d in circle %s, one of them is not registered\n", match.MortalId, match.AngelId, circle.Name)
+			continue
+		}
+
+		text := fmt.Sprintf(
+			"🎉 A new session has started in circle <b>%s</b>!\n\nYour mortal is: <span class=\"tg-spoiler\">%s</span>%s\n\nTake good care of them. They won't know it's you until the session ends.",
+			html.EscapeString(circle.Name),
+			html.EscapeString(mortal.DisplayName()),
+			deadlineText,
+		)
+
+		notifications = append(notifications, &appModels.Message{
+			RecepientId: match.AngelId,
+			CircleName:  circle.Name,
+			Message:     text,
+			ParseMode:   string(models.ParseModeHTML),
+			Buttons: [][]ui.MenuButton{
+				{{Text: "💌 Message my mortal", Command: commands.Encode(commands.SendMessageCommandToMortal, circle.ID)}},
+			},
+		})
+	}
+	return notifications, nil
+}
+
+// notifySessionEnd queues a message for every member revealing their angel.
+// When public is set, everyone also gets the full angel → mortal chain.
+func (h *Handlers) notifySessionEnd(ctx context.Context, circle *appModels.Circle, session *appModels.Session, public bool) error {
+	matches, err := h.store.GetMatches(ctx, session.ID)
+	if err != nil {
+		return err
+	}
+
+	users, err := h.store.GetUsers(ctx, session.Members)
+	if err != nil {
+		return err
+	}
+
+	namesById := make(map[int64]string, len(users))
+	for _, u := range users {
+		namesById[u.ID] = html.EscapeString(u.DisplayName())
+	}
+	nameOf := func(id int64) string {
+		if name, ok := namesById[id]; ok {
+			return name
+		}
+		return "a former member"
+	}
+
+	circleName := html.EscapeString(circle.Name)
+	notifications := make([]*appModels.Message, 0, 2*len(matches))
+
+	for _, match := range matches {
+		notifications = append(notifications, &appModels.Message{
+			RecepientId: match.MortalId,
+			CircleName:  circle.Name,
+			Message: fmt.Sprintf(
+				"🏁 The session in circle <b>%s</b> has ended!\n\nYour angel was: <span class=\"tg-spoiler\">%s</span>",
+				circleName,
+				nameOf(match.AngelId),
+			),
+			ParseMode: string(models.ParseModeHTML),
+		})
+	}
+
+	if public {
+		var chainText strings.Builder
+		for _, chain := range appModels.BuildChains(session.Members, matches) {
+			names := make([]string, 0, len(chain)+1)
+			for _, id := range chain {
+				names = append(names, nameOf(id))
+			}
+			// Close the loop so it reads A → B → C → A.
+			names = append(names, nameOf(chain[0]))
+			chainText.WriteString("\n" + strings.Join(names, " → "))
+		}
+
+		for _, memberId := range session.Members {
+			notifications = append(notifications, &appModels.Message{
+				RecepientId: memberId,
+				CircleName:  circle.Name,
+				Message:     fmt.Sprintf("🔗 Here is how everyone in <b>%s</b> was paired (angel → mortal):\n%s", circleName, chainText.String()),
+				ParseMode:   string(models.ParseModeHTML),
+			})
+		}
+	}
+
+	return h.store.CreateNotifications(ctx, notifications)
+}
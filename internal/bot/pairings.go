@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"grandfather/internal/matching"
+
+	appModels "grandfather/internal/models"
+)
+
+// pairingHistory is what the circle's earlier sessions mean for matching.
+type pairingHistory struct {
+	// penalties makes the matcher avoid earlier pairings. One repeat from a
+	// recent session costs more than repeating every older pairing at once.
+	penalties map[matching.Pair]int
+	recent    map[matching.Pair]bool
+	// recentSessions is how many sessions count as recent.
+	recentSessions int
+}
+
+func (h *Handlers) pairingHistory(ctx context.Context, circle *appModels.Circle) (*pairingHistory, error) {
+	sessions, err := h.store.GetCircleSessions(ctx, circle.ID)
+	if err != nil {
+		return nil, fmt.Errorf("get sessions: %w", err)
+	}
+
+	history := &pairingHistory{
+		penalties:      map[matching.Pair]int{},
+		recent:         map[matching.Pair]bool{},
+		recentSessions: min(h.cfg.AvoidRecentSessions, len(sessions)),
+	}
+	recentPenalty := len(circle.Members) + 1
+
+	for i, session := range sessions {
+		matches, err := h.store.GetMatches(ctx, session.ID)
+		if err != nil {
+			return nil, fmt.Errorf("get matches for session %s: %w", session.ID.Hex(), err)
+		}
+
+		for _, m := range matches {
+			pair := matching.Pair{Angel: m.AngelId, Mortal: m.MortalId}
+			if i < history.recentSessions {
+				history.recent[pair] = true
+				history.penalties[pair] = recentPenalty
+			} else if !history.recent[pair] {
+				history.penalties[pair] = 1
+			}
+		}
+	}
+
+	return history, nil
+}
+
+// repeats counts how many of pairs were used in recent and in older sessions.
+func (history *pairingHistory) repeats(pairs []matching.Pair) (recent, older int) {
+	for _, pair := range pairs {
+		switch {
+		case history.recent[pair]:
+			recent++
+		case history.penalties[pair] > 0:
+			older++
+		}
+	}
+	return recent, older
+}
+
+// repeatsReport tells the owner which pairings could not be kept fresh, or
+// returns an empty string when there were none.
+func (history *pairingHistory) repeatsReport(pairs []matching.Pair) string {
+	recent, older := history.repeats(pairs)
+
+	report := ""
+	if recent > 0 {
+		sessions := "session"
+		if history.recentSessions > 1 {
+			sessions = fmt.Sprintf("%d sessions", history.recentSessions)
+		}
+		report += fmt.Sprintf("\n⚠️ %s from the last %s could not be avoided with this circle's members and exclusions.", countPairings(recent), sessions)
+	}
+	if older > 0 {
+		report += fmt.Sprintf("\n🔁 %s from older sessions had to be repeated.", countPairings(older))
+	}
+	return report
+}
+
+func countPairings(n int) string {
+	if n == 1 {
+		return "1 pairing"
+	}
+	return fmt.Sprintf("%d pairings", n)
+}
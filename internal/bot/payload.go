@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	appModels "grandfather/internal/models"
+	"grandfather/utils"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// payloadFromMessage extracts what msg contains so the outbox can send it on
+// without revealing who wrote it. It returns false for messages that cannot
+// be relayed, such as service messages.
+func payloadFromMessage(msg *models.Message) (appModels.Payload, bool) {
+	payload, ok := contentOf(msg)
+	payload.SourceChatID = msg.Chat.ID
+	payload.SourceMessageID = msg.ID
+	return payload, ok
+}
+
+// relayablePayload is payloadFromMessage for a message the user is about to
+// send. When it can't be relayed, the user is told why and it returns false.
+func relayablePayload(ctx context.Context, b *bot.Bot, chatID int64, msg *models.Message) (appModels.Payload, bool) {
+	payload, ok := payloadFromMessage(msg)
+	if !ok {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "Sorry, this kind of message can't be sent. Try text, a photo, a sticker, a voice note, a video, a file or a location.")
+		return payload, false
+	}
+	if payload.TooLong() {
+		utils.SendCustomErrorMessage(ctx, b, chatID, fmt.Sprintf("Sorry, that's too long to send. Keep messages to %d characters and captions to %d.", appModels.MaxTextLength, appModels.MaxCaptionLength))
+		return payload, false
+	}
+	return payload, true
+}
+
+func contentOf(msg *models.Message) (appModels.Payload, bool) {
+	switch {
+	case msg.Text != "":
+		return appModels.Payload{Type: appModels.PayloadText, Text: msg.Text}, true
+	case len(msg.Photo) > 0:
+		// Sizes are sorted from smallest to largest.
+		largest := msg.Photo[len(msg.Photo)-1]
+		return appModels.Payload{Type: appModels.PayloadPhoto, FileID: largest.FileID, Caption: msg.Caption}, true
+	case msg.Sticker != nil:
+		return appModels.Payload{Type: appModels.PayloadSticker, FileID: msg.Sticker.FileID}, true
+	case msg.Voice != nil:
+		return appModels.Payload{Type: appModels.PayloadVoice, FileID: msg.Voice.FileID, Caption: msg.Caption}, true
+	case msg.Video != nil:
+		return appModels.Payload{Type: appModels.PayloadVideo, FileID: msg.Video.FileID, Caption: msg.Caption}, true
+	// Animations also fill in Document, so they must be copied instead.
+	case msg.Document != nil && msg.Animation == nil:
+		return appModels.Payload{Type: appModels.PayloadDocument, FileID: msg.Document.FileID, Caption: msg.Caption}, true
+	// Venues also fill in Location; copying keeps their title and address.
+	case msg.Location != nil && msg.Venue == nil:
+		return appModels.Payload{Type: appModels.PayloadLocation, Latitude: msg.Location.Latitude, Longitude: msg.Location.Longitude}, true
+	case msg.Animation != nil, msg.Audio != nil, msg.VideoNote != nil, msg.Contact != nil,
+		msg.Poll != nil, msg.Dice != nil, msg.Venue != nil:
+		return appModels.Payload{Type: appModels.PayloadCopy, Caption: msg.Caption}, true
+	}
+	return appModels.Payload{}, false
+}
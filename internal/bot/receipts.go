@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grandfather/internal/db"
+	"grandfather/internal/ui"
+	"grandfather/utils"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// AllowedUpdates are the kinds of update the bot asks Telegram for.
+// Reactions are only sent when asked for explicitly.
+var AllowedUpdates = bot.AllowedUpdates{
+	models.AllowedUpdateMessage,
+	models.AllowedUpdateEditedMessage,
+	models.AllowedUpdateCallbackQuery,
+	models.AllowedUpdateMessageReaction,
+}
+
+// MarkReadCommandHandler records that the recipient of a relay saw it, when
+// they tap the button under it.
+func (h *Handlers) MarkReadCommandHandler(ctx context.Context, b *bot.Bot, update *models.Update, messageId bson.ObjectID) {
+	fmt.Println("Mark read")
+
+	user, chatID, extractErr := utils.ExtractUserAndChat(update)
+	if extractErr != nil {
+		fmt.Println("Error extracting user/chat:", extractErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return
+	}
+
+	message, getMessageErr := h.store.GetMessage(ctx, messageId)
+	if getMessageErr != nil {
+		fmt.Printf("failed to get message %s: %v\n", messageId.Hex(), getMessageErr)
+		utils.SendCustomErrorMessage(ctx, b, chatID, "This message was not found!")
+		return
+	}
+
+	if message.RecepientId != user.ID {
+		fmt.Printf("User %d tried to mark message %s they didn't receive as read\n", user.ID, messageId.Hex())
+		return
+	}
+
+	h.markSeen(ctx, b, message, chatID)
+}
+
+// MessageReactionHandler counts a reaction to a delivered relay as the
+// recipient having seen it.
+func (h *Handlers) MessageReactionHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	reaction := update.MessageReaction
+	// Removing a reaction, or reacting anonymously, says nothing.
+	if reaction.User == nil || len(reaction.NewReaction) == 0 {
+		return
+	}
+
+	message, getMessageErr := h.store.GetMessageByDeliveredId(ctx, reaction.User.ID, reaction.MessageID)
+	if errors.Is(getMessageErr, db.ErrNotFound) {
+		return
+	}
+	if getMessageErr != nil {
+		fmt.Printf("failed to look up message %d user %d reacted to: %v\n", reaction.MessageID, reaction.User.ID, getMessageErr)
+		return
+	}
+	if message.Kind != appModels.KindRelay {
+		return
+	}
+
+	h.markSeen(ctx, b, message, reaction.Chat.ID)
+}
+
+// markSeen marks message as seen, tells its sender and takes the mark read
+// button off the recipient's copy in chatID.
+func (h *Handlers) markSeen(ctx context.Context, b *bot.Bot, message *appModels.Message, chatID int64) {
+	seen, markErr := h.store.MarkMessageSeen(ctx, message.ID)
+	if errors.Is(markErr, db.ErrNotFound) {
+		// Already seen, or not delivered (anymore).
+		return
+	}
+	if markErr != nil {
+		fmt.Printf("failed to mark message %s as seen: %v\n", message.ID.Hex(), markErr)
+		return
+	}
+
+	utils.EditConfirmation(ctx, b, seen)
+
+	if len(seen.DeliveredMessageIds) == 0 {
+		return
+	}
+	// The button is on the content, which is always the last message sent.
+	_, editErr := b.EditMessageReplyMarkup(ctx, &bot.EditMessageReplyMarkupParams{
+		ChatID:      chatID,
+		MessageID:   seen.DeliveredMessageIds[len(seen.DeliveredMessageIds)-1],
+		ReplyMarkup: ui.Menu{Buttons: seen.RecipientButtons()}.ToInlineKeyboard(),
+	})
+	if editErr != nil {
+		fmt.Printf("failed to remove mark read button of message %s: %v\n", seen.ID.Hex(), editErr)
+	}
+}
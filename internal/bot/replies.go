@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grandfather/internal/db"
+	"grandfather/utils"
+
+	appModels "grandfather/internal/models"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// ReplyHandler relays a native Telegram reply to a delivered relay back to
+// whoever sent it, keeping both sides anonymous. It returns false when the
+// message doesn't answer a relay, so the update can be handled as usual.
+func (h *Handlers) ReplyHandler(ctx context.Context, b *bot.Bot, update *models.Update, user *appModels.User) bool {
+	chatID := update.Message.Chat.ID
+
+	original, getMessageErr := h.store.GetMessageByDeliveredId(ctx, user.ID, update.Message.ReplyToMessage.ID)
+	if errors.Is(getMessageErr, db.ErrNotFound) {
+		return false
+	}
+	if getMessageErr != nil {
+		fmt.Printf("failed to look up replied message for user %d: %v\n", user.ID, getMessageErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return true
+	}
+	if original.Kind != appModels.KindRelay {
+		return false
+	}
+
+	// Pairings end with their session, and relays without a known session
+	// are from sessions long over.
+	session, getSessErr := h.store.GetSession(ctx, original.SessionId)
+	if getSessErr != nil && !errors.Is(getSessErr, db.ErrNotFound) {
+		fmt.Printf("failed to get session %s: %v\n", original.SessionId.Hex(), getSessErr)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return true
+	}
+	if getSessErr != nil || session.State == appModels.StateFinished {
+		utils.SendCustomErrorMessage(ctx, b, chatID, "The session this message was sent in has ended, so you can't reply to it.")
+		return true
+	}
+
+	payload, ok := relayablePayload(ctx, b, chatID, update.Message)
+	if !ok {
+		return true
+	}
+
+	// Whoever wrote as the angel is answered by their mortal and vice versa.
+	reply := &appModels.Message{
+		SenderId:    user.ID,
+		RecepientId: original.SenderId,
+		CircleName:  original.CircleName,
+		CircleId:    original.CircleId,
+		SessionId:   original.SessionId,
+		Payload:     &payload,
+		SenderRole:  original.RecipientRole(),
+		ReplyToId:   &original.ID,
+	}
+	if original.Payload != nil {
+		reply.ReplyToMessageId = original.Payload.SourceMessageID
+	}
+
+	created, err := h.store.CreateMessage(ctx, reply)
+	if err != nil {
+		fmt.Printf("There was an error creating the reply: %s\n", err)
+		utils.SendErrorMessage(ctx, b, chatID)
+		return true
+	}
+
+	h.sendConfirmation(ctx, b, chatID, "", created)
+	return true
+}
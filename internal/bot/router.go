@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/config"
+	"grandfather/internal/db"
+	"log"
+	"sync"
+
+	appModels "grandfather/internal/models"
+	"grandfather/utils"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// Handlers holds the dependencies shared by every update handler.
+type Handlers struct {
+	store  db.Store
+	cfg    config.BotConfig
+	router map[commands.Command]commands.CommandHandler
+
+	mu       sync.Mutex
+	username string
+}
+
+func New(store db.Store, cfg config.BotConfig) *Handlers {
+	h := &Handlers{store: store, cfg: cfg}
+	h.router = map[commands.Command]commands.CommandHandler{
+		commands.MainMenuCommand:       h.MainMenuCommandHandler,
+		commands.StartNewCircleCommand: h.StartNewCircleCommandHandler,
+		commands.JoinCircleCommand:     h.JoinCircleCommandHandler,
+		commands.ListCirclesCommand:    h.ListCirclesCommandHandler,
+		commands.ExitChatCommand:       h.ExitChatCommandHandler,
+	}
+	return h
+}
+
+// Register wires the command and callback handlers into b. The default
+// handler is passed to bot.New separately via bot.WithDefaultHandler.
+func (h *Handlers) Register(b *bot.Bot) {
+	b.RegisterHandler(bot.HandlerTypeMessageText, "start", bot.MatchTypeCommandStartOnly, h.StartCommandHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "exit", bot.MatchTypeCommandStartOnly, h.ExitChatCommandHandler)
+
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, "", bot.MatchTypePrefix, h.CallbackHandler)
+}
+
+func (h *Handlers) CallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.CallbackQuery == nil {
+		return
+	}
+
+	cb, decodeErr := commands.Decode(update.CallbackQuery.Data)
+	if decodeErr != nil {
+		fmt.Printf("Invalid callback data %q: %v\n", update.CallbackQuery.Data, decodeErr)
+		h.answerUnknownAction(ctx, b, update)
+		return
+	}
+
+	if cb.ID.IsZero() && cb.LegacyCircleName == "" {
+		fmt.Printf("Normal command received: %s\n", cb.Command)
+		// Check if we have a registered handler
+		if handler, ok := h.router[cb.Command]; ok {
+			handler(ctx, b, update)
+			return
+		}
+
+		h.answerUnknownAction(ctx, b, update)
+		return
+	}
+	fmt.Printf("Dynamic command received: %s\n", cb.Command)
+
+	// Buttons sent before callbacks carried IDs still name the circle.
+	if cb.LegacyCircleName != "" {
+		circle, err := h.store.GetCircle(ctx, cb.LegacyCircleName)
+		if err != nil {
+			fmt.Printf("failed to resolve legacy circle %q: %v\n", cb.LegacyCircleName, err)
+			if _, chatID, extractErr := utils.ExtractUserAndChat(update); extractErr == nil {
+				utils.SendCustomErrorMessage(ctx, b, chatID, "This button has expired. Please open the circle from \"My circles\" again.")
+			}
+			h.answerCallback(ctx, b, update)
+			return
+		}
+		cb.ID = circle.ID
+	}
+
+	circleId := cb.ID
+
+	if !messageCommands[cb.Command] && !h.authorize(ctx, b, update, cb.Command, circleId) {
+		h.answerCallback(ctx, b, update)
+		return
+	}
+
+	switch cb.Command {
+	case commands.GetCircleCommand:
+		h.GetCircleDetailsHandler(ctx, b, update, circleId)
+	case commands.RemoveUserCommand:
+		h.RemoveUserCommandHandler(ctx, b, update, circleId)
+	case commands.RemoveSpecificUserCommand:
+		userIdToRemove := cb.Arg(0)
+		if userIdToRemove == 0 {
+			// Invalid payload, bail out gracefully
+			if _, chatID, extractErr := utils.ExtractUserAndChat(update); extractErr == nil {
+				utils.SendCustomErrorMessage(ctx, b, chatID, "❌ Invalid user ID.")
+			}
+			break
+		}
+		h.RemoveSpecificUserCommandHandler(ctx, b, update, circleId, userIdToRemove)
+	case commands.GetMemberListCommand:
+		h.GetMemberListCommandHandler(ctx, b, update, circleId)
+	case commands.StartNewSessionCommand:
+		h.StartNewSessionCommandHandler(ctx, b, update, circleId, cb.Arg(0))
+	case commands.ChooseSessionLengthCommand:
+		h.ChooseSessionLengthCommandHandler(ctx, b, update, circleId)
+	case commands.EndSessionCommand:
+		h.EndSessionCommandHandler(ctx, b, update, circleId, cb.Arg(0))
+	case commands.ChooseRevealModeCommand:
+		h.ChooseRevealModeCommandHandler(ctx, b, update, circleId)
+	case commands.RevealMortalCommand:
+		h.RevealMortalCommandHandler(ctx, b, update, circleId)
+	case commands.RevealAngelCommand:
+		h.RevealAngelCommandHandler(ctx, b, update, circleId)
+	case commands.SendMessageCommandToAngel:
+		h.SendMessageToAngelCommandHandler(ctx, b, update, circleId)
+	case commands.SendMessageCommandToMortal:
+		h.SendMessageToMortalCommandHandler(ctx, b, update, circleId)
+	case commands.ShareInviteLinkCommand:
+		h.ShareInviteLinkCommandHandler(ctx, b, update, circleId)
+	case commands.RotateInviteLinkCommand:
+		h.RotateInviteLinkCommandHandler(ctx, b, update, circleId)
+	case commands.DisableInviteLinkCommand:
+		h.DisableInviteLinkCommandHandler(ctx, b, update, circleId)
+	case commands.ManageExclusionsCommand:
+		h.ManageExclusionsCommandHandler(ctx, b, update, circleId)
+	case commands.AddExclusionCommand:
+		h.AddExclusionCommandHandler(ctx, b, update, circleId, cb.Args)
+	case commands.RemoveExclusionCommand:
+		h.RemoveExclusionCommandHandler(ctx, b, update, circleId, cb.Arg(0), cb.Arg(1))
+	case commands.UnsendMessageCommand:
+		h.UnsendMessageCommandHandler(ctx, b, update, cb.ID)
+	case commands.MarkReadCommand:
+		h.MarkReadCommandHandler(ctx, b, update, cb.ID)
+	case commands.MessageHistoryCommand:
+		h.MessageHistoryCommandHandler(ctx, b, update, circleId, cb.Arg(0))
+	case commands.ManageAdminsCommand:
+		h.ManageAdminsCommandHandler(ctx, b, update, circleId)
+	case commands.PromoteAdminCommand:
+		h.PromoteAdminCommandHandler(ctx, b, update, circleId, cb.Arg(0))
+	case commands.DemoteAdminCommand:
+		h.DemoteAdminCommandHandler(ctx, b, update, circleId, cb.Arg(0))
+	case commands.TransferOwnershipCommand:
+		h.TransferOwnershipCommandHandler(ctx, b, update, circleId, cb.Arg(0))
+	case commands.AcceptOwnershipCommand:
+		h.AcceptOwnershipCommandHandler(ctx, b, update, circleId)
+	case commands.DeclineOwnershipCommand:
+		h.DeclineOwnershipCommandHandler(ctx, b, update, circleId)
+	default:
+		h.answerUnknownAction(ctx, b, update)
+		return
+	}
+
+	h.answerCallback(ctx, b, update)
+}
+
+func (h *Handlers) answerCallback(ctx context.Context, b *bot.Bot, update *models.Update) {
+	_, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: update.CallbackQuery.ID,
+	})
+
+	if err != nil {
+		log.Println("answer callback error:", err)
+	}
+}
+
+func (h *Handlers) answerUnknownAction(ctx context.Context, b *bot.Bot, update *models.Update) {
+	b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: update.CallbackQuery.ID,
+		Text:            "Unknown action",
+		ShowAlert:       false,
+	})
+}
+
+func (h *Handlers) DefaultHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.EditedMessage != nil {
+		h.EditedMessageHandler(ctx, b, update)
+		return
+	}
+	if update.MessageReaction != nil {
+		h.MessageReactionHandler(ctx, b, update)
+		return
+	}
+	if update.Message == nil {
+		return
+	}
+
+	userID := update.Message.From.ID
+	user, getUserErr := h.store.GetUser(ctx, userID)
+
+	if getUserErr != nil || user == nil {
+		fmt.Printf("failed to get user %d: %v\n", userID, getUserErr)
+		_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: update.Message.Chat.ID,
+			Text:   "Have you been registered? If you haven't, run the /start command to begin!",
+		})
+		return
+	}
+
+	// Replying to a relayed message answers its sender, whatever the state.
+	if update.Message.ReplyToMessage != nil && h.ReplyHandler(ctx, b, update, user) {
+		return
+	}
+
+	state := user.State
+
+	switch state {
+	case appModels.StateWaitingCircleName:
+		h.StartNewCircleWithNameCommandHandler(ctx, b, update)
+	case appModels.StateWaitingJoinInviteCode, appModels.StateWaitingJoinCircleName:
+		h.JoinCircleWithInviteCommandHandler(ctx, b, update)
+	case appModels.StateWaitingSendMessageToAngel:
+		h.SendMessageToAngelWithMessageCommandHandler(ctx, b, update, user)
+	case appModels.StateWaitingSendMessageToMortal:
+		h.SendMessageToMortalWithMessageCommandHandler(ctx, b, update, user)
+	case appModels.StateChattingWithAngel, appModels.StateChattingWithMortal:
+		h.ChatMessageHandler(ctx, b, update, user)
+	default:
+
+		fmt.Println("ChatID:", update.Message.Chat.ID)
+		fmt.Println("Text:", update.Message.Text)
+
+		user := update.Message.From
+		fmt.Println("User ID:", user.ID)        // unique int64 ID
+		fmt.Println("Username:", user.Username) // may be empty
+		fmt.Println("First name:", user.FirstName)
+		fmt.Println("Last name:", user.LastName)
+
+		_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID: update.Message.Chat.ID,
+			Text:   "Use /start to load up the menu!",
+		})
+	}
+}
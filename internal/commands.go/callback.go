@@ -0,0 +1,153 @@
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// MaxCallbackDataLen is Telegram's limit on a button's callback_data.
+const MaxCallbackDataLen = 64
+
+// callbackPrefix marks callback data produced by Encode. Legacy data is
+// "<command>@<circle name>[@<arg>...]" and never starts with it.
+const callbackPrefix = "~"
+
+// commandCodes assigns every dynamic command a one-byte code for Encode.
+// Codes are stored in buttons of messages users already received, so never
+// reuse or renumber an entry; only append new ones.
+var commandCodes = map[Command]byte{
+	GetCircleCommand:           1,
+	RemoveUserCommand:          2,
+	RemoveSpecificUserCommand:  3,
+	StartNewSessionCommand:     4,
+	RevealMortalCommand:        5,
+	RevealAngelCommand:         6,
+	SendMessageCommandToMortal: 7,
+	SendMessageCommandToAngel:  8,
+	EndSessionCommand:          9,
+	GetMemberListCommand:       10,
+	ShareInviteLinkCommand:     11,
+	RotateInviteLinkCommand:    12,
+	DisableInviteLinkCommand:   13,
+	ChooseSessionLengthCommand: 14,
+	ChooseRevealModeCommand:    15,
+	ManageExclusionsCommand:    16,
+	AddExclusionCommand:        17,
+	RemoveExclusionCommand:     18,
+	UnsendMessageCommand:       19,
+	MarkReadCommand:            20,
+	MessageHistoryCommand:      21,
+	ManageAdminsCommand:        22,
+	PromoteAdminCommand:        23,
+	DemoteAdminCommand:         24,
+	TransferOwnershipCommand:   25,
+	AcceptOwnershipCommand:     26,
+	DeclineOwnershipCommand:    27,
+}
+
+var commandsByCode = func() map[byte]Command {
+	m := make(map[byte]Command, len(commandCodes))
+	for cmd, code := range commandCodes {
+		m[code] = cmd
+	}
+	return m
+}()
+
+var ErrInvalidCallback = errors.New("invalid callback data")
+
+// Callback is the decoded form of a button's callback data.
+type Callback struct {
+	Command Command
+	// ID is the object the command acts on: a circle, or for
+	// UnsendMessageCommand and MarkReadCommand a message.
+	ID   bson.ObjectID
+	Args []int64
+	// LegacyCircleName is set instead of ID for buttons created before
+	// callbacks carried ObjectIDs. The caller must resolve it by name.
+	LegacyCircleName string
+}
+
+// Arg returns the i-th argument, or 0 when there are fewer arguments.
+func (c Callback) Arg(i int) int64 {
+	if i < len(c.Args) {
+		return c.Args[i]
+	}
+	return 0
+}
+
+// Encode packs a dynamic command, the ID it acts on and optional integer
+// arguments into callback data that fits Telegram's 64 byte limit.
+func Encode(cmd Command, id bson.ObjectID, args ...int64) string {
+	code, ok := commandCodes[cmd]
+	if !ok {
+		panic(fmt.Sprintf("commands: %q has no callback code", cmd))
+	}
+
+	buf := make([]byte, 0, 1+len(id)+len(args)*binary.MaxVarintLen64)
+	buf = append(buf, code)
+	buf = append(buf, id[:]...)
+	for _, arg := range args {
+		buf = binary.AppendVarint(buf, arg)
+	}
+
+	data := callbackPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	if len(data) > MaxCallbackDataLen {
+		panic(fmt.Sprintf("commands: callback data for %q is %d bytes, over Telegram's limit", cmd, len(data)))
+	}
+	return data
+}
+
+// Decode parses callback data. Static commands such as MainMenuCommand come
+// back with a zero ID; legacy "<command>@<name>" data sets LegacyCircleName.
+func Decode(data string) (Callback, error) {
+	if encoded, ok := strings.CutPrefix(data, callbackPrefix); ok {
+		return decodeBinary(encoded)
+	}
+
+	if !strings.Contains(data, "@") {
+		return Callback{Command: Command(data)}, nil
+	}
+
+	parts := strings.Split(data, "@")
+	cb := Callback{Command: Command(parts[0]), LegacyCircleName: parts[1]}
+	for _, raw := range parts[2:] {
+		arg, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return Callback{}, fmt.Errorf("%w: %q", ErrInvalidCallback, data)
+		}
+		cb.Args = append(cb.Args, arg)
+	}
+	return cb, nil
+}
+
+func decodeBinary(encoded string) (Callback, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(buf) < 1+len(bson.ObjectID{}) {
+		return Callback{}, ErrInvalidCallback
+	}
+
+	cmd, ok := commandsByCode[buf[0]]
+	if !ok {
+		return Callback{}, fmt.Errorf("%w: unknown command code %d", ErrInvalidCallback, buf[0])
+	}
+
+	cb := Callback{Command: cmd}
+	copy(cb.ID[:], buf[1:])
+
+	rest := buf[1+len(cb.ID):]
+	for len(rest) > 0 {
+		arg, n := binary.Varint(rest)
+		if n <= 0 {
+			return Callback{}, ErrInvalidCallback
+		}
+		cb.Args = append(cb.Args, arg)
+		rest = rest[n:]
+	}
+	return cb, nil
+}
@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	id := bson.NewObjectID()
+
+	for cmd := range commandCodes {
+		for _, args := range [][]int64{nil, {42}, {math.MaxInt64, -1, 7}} {
+			data := Encode(cmd, id, args...)
+			if len(data) > MaxCallbackDataLen {
+				t.Fatalf("%s with %v encodes to %d bytes", cmd, args, len(data))
+			}
+
+			cb, err := Decode(data)
+			if err != nil {
+				t.Fatalf("decode %q: %v", data, err)
+			}
+			if cb.Command != cmd || cb.ID != id || !slices.Equal(cb.Args, args) {
+				t.Fatalf("round trip of %s %v gave %+v", cmd, args, cb)
+			}
+		}
+	}
+}
+
+func TestDecodeLegacyAndStatic(t *testing.T) {
+	cb, err := Decode("removeSpecificUserCommand@Book Club@1002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cb.Command != RemoveSpecificUserCommand || cb.LegacyCircleName != "Book Club" || cb.Arg(0) != 1002 || !cb.ID.IsZero() {
+		t.Fatalf("unexpected legacy decode %+v", cb)
+	}
+
+	cb, err = Decode("listCircles")
+	if err != nil || cb.Command != ListCirclesCommand || !cb.ID.IsZero() || cb.LegacyCircleName != "" {
+		t.Fatalf("unexpected static decode %+v, %v", cb, err)
+	}
+}
+
+func TestDecodeRejectsGarbage(t *testing.T) {
+	for _, data := range []string{"~", "~!!!", "~AA", "getCircle@x@notanumber"} {
+		if _, err := Decode(data); !errors.Is(err, ErrInvalidCallback) {
+			t.Errorf("Decode(%q) error = %v, want ErrInvalidCallback", data, err)
+		}
+	}
+}
@@ -24,8 +24,24 @@ const (
 	SendMessageCommandToAngel  Command = "sendMessageCommandToAngel"
 	EndSessionCommand          Command = "endSessionCommand"
 	GetMemberListCommand       Command = "getMemberListCommand"
+	ShareInviteLinkCommand     Command = "shareInviteLinkCommand"
+	RotateInviteLinkCommand    Command = "rotateInviteLinkCommand"
+	DisableInviteLinkCommand   Command = "disableInviteLinkCommand"
+	ChooseSessionLengthCommand Command = "chooseSessionLengthCommand"
+	ChooseRevealModeCommand    Command = "chooseRevealModeCommand"
+	ManageExclusionsCommand    Command = "manageExclusionsCommand"
+	AddExclusionCommand        Command = "addExclusionCommand"
+	RemoveExclusionCommand     Command = "removeExclusionCommand"
+	ExitChatCommand            Command = "exitChat"
+	UnsendMessageCommand       Command = "unsendMessageCommand"
+	MarkReadCommand            Command = "markReadCommand"
+	MessageHistoryCommand      Command = "messageHistoryCommand"
+	ManageAdminsCommand        Command = "manageAdminsCommand"
+	PromoteAdminCommand        Command = "promoteAdminCommand"
+	DemoteAdminCommand         Command = "demoteAdminCommand"
+	TransferOwnershipCommand   Command = "transferOwnershipCommand"
+	AcceptOwnershipCommand     Command = "acceptOwnershipCommand"
+	DeclineOwnershipCommand    Command = "declineOwnershipCommand"
 )
 
 type CommandHandler func(ctx context.Context, b *bot.Bot, update *models.Update)
-
-var Router = map[Command]CommandHandler{}
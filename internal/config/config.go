@@ -0,0 +1,431 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to every environment variable the config reads,
+// e.g. GRANDFATHER_TELEGRAM_TOKEN.
+const EnvPrefix = "GRANDFATHER_"
+
+type Config struct {
+	Telegram TelegramConfig `yaml:"telegram" toml:"telegram"`
+	// Storage is either "mongo" or "sqlite".
+	Storage string       `yaml:"storage" toml:"storage"`
+	Mongo   MongoConfig  `yaml:"mongo" toml:"mongo"`
+	SQLite  SQLiteConfig `yaml:"sqlite" toml:"sqlite"`
+	Outbox  OutboxConfig `yaml:"outbox" toml:"outbox"`
+	Bot     BotConfig    `yaml:"bot" toml:"bot"`
+}
+
+const (
+	ModePolling = "polling"
+	ModeWebhook = "webhook"
+)
+
+type TelegramConfig struct {
+	Token string `yaml:"token" toml:"token"`
+	// Mode is either "polling" (getUpdates) or "webhook".
+	Mode      string          `yaml:"mode" toml:"mode"`
+	Webhook   WebhookConfig   `yaml:"webhook" toml:"webhook"`
+	RateLimit RateLimitConfig `yaml:"rateLimit" toml:"rateLimit"`
+}
+
+// RateLimitConfig keeps the bot under Telegram's flood limits. A zero value
+// turns the respective limit off.
+type RateLimitConfig struct {
+	// GlobalPerSecond caps the messages sent per second across all chats.
+	GlobalPerSecond int `yaml:"globalPerSecond" toml:"globalPerSecond"`
+	// ChatInterval is the average gap between messages to the same chat,
+	// which may send up to ChatBurst messages back to back.
+	ChatInterval time.Duration `yaml:"chatInterval" toml:"chatInterval"`
+	ChatBurst    int           `yaml:"chatBurst" toml:"chatBurst"`
+}
+
+type WebhookConfig struct {
+	// URL is the public HTTPS address Telegram posts updates to.
+	URL string `yaml:"url" toml:"url"`
+	// ListenAddr is the local address of the built-in HTTP server.
+	ListenAddr string `yaml:"listenAddr" toml:"listenAddr"`
+	// Path the updates are served on. Defaults to the path of URL.
+	Path        string `yaml:"path" toml:"path"`
+	SecretToken string `yaml:"secretToken" toml:"secretToken"`
+	// TLSCertFile and TLSKeyFile make the server terminate TLS itself. Leave
+	// both empty when running behind a reverse proxy or ingress.
+	TLSCertFile string `yaml:"tlsCertFile" toml:"tlsCertFile"`
+	TLSKeyFile  string `yaml:"tlsKeyFile" toml:"tlsKeyFile"`
+	// SelfSigned uploads TLSCertFile to Telegram with setWebhook.
+	SelfSigned     bool `yaml:"selfSigned" toml:"selfSigned"`
+	MaxConnections int  `yaml:"maxConnections" toml:"maxConnections"`
+	// DeleteOnShutdown removes the webhook when the bot stops. Disable it when
+	// several replicas share the same webhook URL.
+	DeleteOnShutdown bool `yaml:"deleteOnShutdown" toml:"deleteOnShutdown"`
+}
+
+type MongoConfig struct {
+	URI      string `yaml:"uri" toml:"uri"`
+	Database string `yaml:"database" toml:"database"`
+}
+
+const (
+	StorageMongo  = "mongo"
+	StorageSQLite = "sqlite"
+)
+
+// SQLiteConfig keeps everything in one file, for deployments too small to
+// be worth running MongoDB for. Only one bot instance should use the file.
+type SQLiteConfig struct {
+	// Path is the database file, which is created if it doesn't exist.
+	Path string `yaml:"path" toml:"path"`
+}
+
+type OutboxConfig struct {
+	PollInterval time.Duration `yaml:"pollInterval" toml:"pollInterval"`
+	// MaxAttempts is how many times a message is sent before the outbox
+	// gives up on it.
+	MaxAttempts int `yaml:"maxAttempts" toml:"maxAttempts"`
+	// Failed deliveries are retried after RetryBaseDelay, doubling with every
+	// attempt up to RetryMaxDelay.
+	RetryBaseDelay time.Duration `yaml:"retryBaseDelay" toml:"retryBaseDelay"`
+	RetryMaxDelay  time.Duration `yaml:"retryMaxDelay" toml:"retryMaxDelay"`
+	// LeaseDuration is how long a claim on a message lasts. The instance
+	// sending it renews the claim until it is done, so other instances only
+	// take the message over once it stopped, e.g. because it crashed.
+	LeaseDuration time.Duration `yaml:"leaseDuration" toml:"leaseDuration"`
+}
+
+// BotConfig tunes how the bot runs circles and sessions.
+type BotConfig struct {
+	// AvoidRecentSessions is how many of a circle's latest sessions the
+	// matcher tries hardest not to repeat pairings from. Pairings from older
+	// sessions are still avoided, but with lower priority.
+	AvoidRecentSessions int `yaml:"avoidRecentSessions" toml:"avoidRecentSessions"`
+	// ChatTimeout ends a chat with an angel or mortal after this long
+	// without a message.
+	ChatTimeout time.Duration `yaml:"chatTimeout" toml:"chatTimeout"`
+	// UnsendWindow is how long after sending a message its sender can still
+	// take it back. Zero turns unsending off.
+	UnsendWindow time.Duration `yaml:"unsendWindow" toml:"unsendWindow"`
+}
+
+func Default() Config {
+	return Config{
+		Telegram: TelegramConfig{
+			Mode: ModePolling,
+			Webhook: WebhookConfig{
+				ListenAddr:       ":8080",
+				DeleteOnShutdown: true,
+			},
+			RateLimit: RateLimitConfig{
+				GlobalPerSecond: 30,
+				ChatInterval:    time.Second,
+				ChatBurst:       3,
+			},
+		},
+		Storage: StorageMongo,
+		Mongo: MongoConfig{
+			URI:      "mongodb://127.0.0.1:27017/?directConnection=true",
+			Database: "grandfather",
+		},
+		SQLite: SQLiteConfig{
+			Path: "grandfather.db",
+		},
+		Outbox: OutboxConfig{
+			PollInterval:   5 * time.Second,
+			MaxAttempts:    8,
+			RetryBaseDelay: 10 * time.Second,
+			RetryMaxDelay:  time.Hour,
+			LeaseDuration:  time.Minute,
+		},
+		Bot: BotConfig{
+			AvoidRecentSessions: 3,
+			ChatTimeout:         30 * time.Minute,
+			UnsendWindow:        15 * time.Minute,
+		},
+	}
+}
+
+// Load builds the config from, in increasing order of precedence: the
+// defaults, the YAML or TOML file at path (skipped when path is empty),
+// environment variables and finally *_FILE environment variables pointing
+// at secret files.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// loadFile reads a YAML or TOML file, picked by its extension. Both reject
+// keys the config doesn't have, so typos don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".yaml", ".yml", ".toml":
+	default:
+		return fmt.Errorf("config file %s: only YAML (.yaml or .yml) and TOML (.toml) are supported", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("open config file: %w", err)
+	}
+	defer f.Close()
+
+	if ext == ".toml" {
+		meta, err := toml.NewDecoder(f).Decode(c)
+		if err != nil {
+			return fmt.Errorf("parse config file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("parse config file %s: field %s not found", path, undecoded[0])
+		}
+		return nil
+	}
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+type envBinding struct {
+	name string
+	set  func(c *Config, value string) error
+}
+
+func stringBinding(name string, field func(c *Config) *string) envBinding {
+	return envBinding{name: name, set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func durationBinding(name string, field func(c *Config) *time.Duration) envBinding {
+	return envBinding{name: name, set: func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}}
+}
+
+func boolBinding(name string, field func(c *Config) *bool) envBinding {
+	return envBinding{name: name, set: func(c *Config, value string) error {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = v
+		return nil
+	}}
+}
+
+func intBinding(name string, field func(c *Config) *int) envBinding {
+	return envBinding{name: name, set: func(c *Config, value string) error {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = v
+		return nil
+	}}
+}
+
+var envBindings = []envBinding{
+	stringBinding("TELEGRAM_TOKEN", func(c *Config) *string { return &c.Telegram.Token }),
+	stringBinding("TELEGRAM_MODE", func(c *Config) *string { return &c.Telegram.Mode }),
+	stringBinding("TELEGRAM_WEBHOOK_URL", func(c *Config) *string { return &c.Telegram.Webhook.URL }),
+	stringBinding("TELEGRAM_WEBHOOK_LISTEN_ADDR", func(c *Config) *string { return &c.Telegram.Webhook.ListenAddr }),
+	stringBinding("TELEGRAM_WEBHOOK_PATH", func(c *Config) *string { return &c.Telegram.Webhook.Path }),
+	stringBinding("TELEGRAM_WEBHOOK_SECRET_TOKEN", func(c *Config) *string { return &c.Telegram.Webhook.SecretToken }),
+	stringBinding("TELEGRAM_WEBHOOK_TLS_CERT_FILE", func(c *Config) *string { return &c.Telegram.Webhook.TLSCertFile }),
+	stringBinding("TELEGRAM_WEBHOOK_TLS_KEY_FILE", func(c *Config) *string { return &c.Telegram.Webhook.TLSKeyFile }),
+	boolBinding("TELEGRAM_WEBHOOK_SELF_SIGNED", func(c *Config) *bool { return &c.Telegram.Webhook.SelfSigned }),
+	intBinding("TELEGRAM_WEBHOOK_MAX_CONNECTIONS", func(c *Config) *int { return &c.Telegram.Webhook.MaxConnections }),
+	boolBinding("TELEGRAM_WEBHOOK_DELETE_ON_SHUTDOWN", func(c *Config) *bool { return &c.Telegram.Webhook.DeleteOnShutdown }),
+	intBinding("TELEGRAM_RATE_LIMIT_GLOBAL_PER_SECOND", func(c *Config) *int { return &c.Telegram.RateLimit.GlobalPerSecond }),
+	durationBinding("TELEGRAM_RATE_LIMIT_CHAT_INTERVAL", func(c *Config) *time.Duration { return &c.Telegram.RateLimit.ChatInterval }),
+	intBinding("TELEGRAM_RATE_LIMIT_CHAT_BURST", func(c *Config) *int { return &c.Telegram.RateLimit.ChatBurst }),
+	stringBinding("STORAGE", func(c *Config) *string { return &c.Storage }),
+	stringBinding("MONGO_URI", func(c *Config) *string { return &c.Mongo.URI }),
+	stringBinding("MONGO_DATABASE", func(c *Config) *string { return &c.Mongo.Database }),
+	stringBinding("SQLITE_PATH", func(c *Config) *string { return &c.SQLite.Path }),
+	durationBinding("OUTBOX_POLL_INTERVAL", func(c *Config) *time.Duration { return &c.Outbox.PollInterval }),
+	intBinding("OUTBOX_MAX_ATTEMPTS", func(c *Config) *int { return &c.Outbox.MaxAttempts }),
+	durationBinding("OUTBOX_RETRY_BASE_DELAY", func(c *Config) *time.Duration { return &c.Outbox.RetryBaseDelay }),
+	durationBinding("OUTBOX_RETRY_MAX_DELAY", func(c *Config) *time.Duration { return &c.Outbox.RetryMaxDelay }),
+	durationBinding("OUTBOX_LEASE_DURATION", func(c *Config) *time.Duration { return &c.Outbox.LeaseDuration }),
+	intBinding("BOT_AVOID_RECENT_SESSIONS", func(c *Config) *int { return &c.Bot.AvoidRecentSessions }),
+	durationBinding("BOT_CHAT_TIMEOUT", func(c *Config) *time.Duration { return &c.Bot.ChatTimeout }),
+	durationBinding("BOT_UNSEND_WINDOW", func(c *Config) *time.Duration { return &c.Bot.UnsendWindow }),
+}
+
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	for _, binding := range envBindings {
+		key := EnvPrefix + binding.name
+
+		if value, ok := lookup(key); ok {
+			if err := binding.set(c, value); err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+		}
+
+		// Secrets mounted as files (docker/k8s secrets) win over plain values.
+		if secretPath, ok := lookup(key + "_FILE"); ok {
+			raw, err := os.ReadFile(secretPath)
+			if err != nil {
+				return fmt.Errorf("read %s_FILE: %w", key, err)
+			}
+			if err := binding.set(c, strings.TrimSpace(string(raw))); err != nil {
+				return fmt.Errorf("invalid %s_FILE: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.Telegram.Token == "" {
+		errs = append(errs, errors.New("telegram.token is required"))
+	} else if !strings.Contains(c.Telegram.Token, ":") {
+		errs = append(errs, errors.New("telegram.token does not look like a bot token"))
+	}
+
+	switch c.Telegram.Mode {
+	case ModePolling:
+	case ModeWebhook:
+		errs = append(errs, c.Telegram.Webhook.validate()...)
+	default:
+		errs = append(errs, fmt.Errorf("telegram.mode must be %q or %q, got %q", ModePolling, ModeWebhook, c.Telegram.Mode))
+	}
+	if c.Telegram.RateLimit.GlobalPerSecond < 0 {
+		errs = append(errs, errors.New("telegram.rateLimit.globalPerSecond cannot be negative"))
+	}
+	if c.Telegram.RateLimit.ChatInterval < 0 {
+		errs = append(errs, errors.New("telegram.rateLimit.chatInterval cannot be negative"))
+	}
+	if c.Telegram.RateLimit.ChatInterval > 0 && c.Telegram.RateLimit.ChatBurst < 1 {
+		errs = append(errs, errors.New("telegram.rateLimit.chatBurst must be at least 1"))
+	}
+
+	switch c.Storage {
+	case StorageMongo:
+		if !strings.HasPrefix(c.Mongo.URI, "mongodb://") && !strings.HasPrefix(c.Mongo.URI, "mongodb+srv://") {
+			errs = append(errs, fmt.Errorf("mongo.uri must start with mongodb:// or mongodb+srv://, got %q", c.Mongo.URI))
+		}
+		if c.Mongo.Database == "" {
+			errs = append(errs, errors.New("mongo.database is required"))
+		}
+	case StorageSQLite:
+		if c.SQLite.Path == "" {
+			errs = append(errs, errors.New("sqlite.path is required"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage must be %q or %q, got %q", StorageMongo, StorageSQLite, c.Storage))
+	}
+
+	if c.Outbox.PollInterval <= 0 {
+		errs = append(errs, errors.New("outbox.pollInterval must be positive"))
+	}
+	if c.Outbox.MaxAttempts < 1 {
+		errs = append(errs, errors.New("outbox.maxAttempts must be at least 1"))
+	}
+	if c.Outbox.RetryBaseDelay <= 0 {
+		errs = append(errs, errors.New("outbox.retryBaseDelay must be positive"))
+	}
+	if c.Outbox.RetryMaxDelay < c.Outbox.RetryBaseDelay {
+		errs = append(errs, errors.New("outbox.retryMaxDelay cannot be shorter than outbox.retryBaseDelay"))
+	}
+	if c.Outbox.LeaseDuration <= 0 {
+		errs = append(errs, errors.New("outbox.leaseDuration must be positive"))
+	}
+
+	if c.Bot.AvoidRecentSessions < 0 {
+		errs = append(errs, errors.New("bot.avoidRecentSessions cannot be negative"))
+	}
+	if c.Bot.ChatTimeout <= 0 {
+		errs = append(errs, errors.New("bot.chatTimeout must be positive"))
+	}
+	if c.Bot.UnsendWindow < 0 {
+		errs = append(errs, errors.New("bot.unsendWindow cannot be negative"))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Telegram only accepts 1-256 characters from this set as a secret token.
+var secretTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+func (w WebhookConfig) validate() []error {
+	var errs []error
+
+	u, err := url.Parse(w.URL)
+	if w.URL == "" || err != nil || u.Scheme != "https" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("telegram.webhook.url must be an absolute https URL, got %q", w.URL))
+	}
+	if w.ListenAddr == "" {
+		errs = append(errs, errors.New("telegram.webhook.listenAddr is required"))
+	}
+	if w.Path != "" && !strings.HasPrefix(w.Path, "/") {
+		errs = append(errs, fmt.Errorf("telegram.webhook.path must start with /, got %q", w.Path))
+	}
+	if !secretTokenPattern.MatchString(w.SecretToken) {
+		errs = append(errs, errors.New("telegram.webhook.secretToken is required and may only contain A-Z, a-z, 0-9, _ and -"))
+	}
+	if (w.TLSCertFile == "") != (w.TLSKeyFile == "") {
+		errs = append(errs, errors.New("telegram.webhook.tlsCertFile and tlsKeyFile must be set together"))
+	}
+	if w.SelfSigned && w.TLSCertFile == "" {
+		errs = append(errs, errors.New("telegram.webhook.selfSigned requires tlsCertFile"))
+	}
+	if w.MaxConnections < 0 || w.MaxConnections > 100 {
+		errs = append(errs, errors.New("telegram.webhook.maxConnections must be between 0 and 100"))
+	}
+
+	return errs
+}
+
+// ServePath returns the HTTP path updates are served on.
+func (w WebhookConfig) ServePath() string {
+	if w.Path != "" {
+		return w.Path
+	}
+	if u, err := url.Parse(w.URL); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return "/"
+}
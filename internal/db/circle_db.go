@@ -6,6 +6,7 @@ import (
 	"grandfather/internal/models"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
@@ -13,20 +14,21 @@ var (
 	circleCollectionName = "circles"
 )
 
-func CreateCircle(ctx context.Context, circleName string, circleOwner int64) (*models.Circle, error) {
-	coll, collErr := GetCollection(circleCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
+func (s *MongoStore) CreateCircle(ctx context.Context, circleName string, circleOwner int64) (*models.Circle, error) {
+	coll := s.collection(circleCollectionName)
 
 	circle := models.Circle{
-		Name:    circleName,
-		OwnerId: circleOwner,
-		Members: []int64{circleOwner},
+		Name:       circleName,
+		OwnerId:    circleOwner,
+		Members:    []int64{circleOwner},
+		InviteCode: NewInviteCode(),
 	}
 
 	res, err := coll.InsertOne(ctx, circle)
 
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrDuplicate
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -41,11 +43,8 @@ func CreateCircle(ctx context.Context, circleName string, circleOwner int64) (*m
 	return &circle, nil
 }
 
-func GetCircle(ctx context.Context, circleName string) (*models.Circle, error) {
-	coll, collErr := GetCollection(circleCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
+func (s *MongoStore) GetCircle(ctx context.Context, circleName string) (*models.Circle, error) {
+	coll := s.collection(circleCollectionName)
 
 	filter := bson.M{
 		"name": circleName,
@@ -54,7 +53,7 @@ func GetCircle(ctx context.Context, circleName string) (*models.Circle, error) {
 	var circle models.Circle
 	res := coll.FindOne(ctx, filter)
 	if err := res.Err(); err != nil {
-		return nil, err
+		return nil, notFound(err)
 	}
 
 	// Decode the found document into our struct
@@ -65,11 +64,19 @@ func GetCircle(ctx context.Context, circleName string) (*models.Circle, error) {
 	return &circle, nil
 }
 
-func GetCircles(ctx context.Context, userId int64) ([]models.Circle, error) {
-	coll, collErr := GetCollection(circleCollectionName)
-	if collErr != nil {
-		return nil, collErr
+func (s *MongoStore) GetCircleByID(ctx context.Context, circleId bson.ObjectID) (*models.Circle, error) {
+	coll := s.collection(circleCollectionName)
+
+	var circle models.Circle
+	if err := coll.FindOne(ctx, bson.M{"_id": circleId}).Decode(&circle); err != nil {
+		return nil, notFound(err)
 	}
+
+	return &circle, nil
+}
+
+func (s *MongoStore) GetCircles(ctx context.Context, userId int64) ([]models.Circle, error) {
+	coll := s.collection(circleCollectionName)
 	filter := bson.M{
 		"members": userId,
 	}
@@ -88,11 +95,8 @@ func GetCircles(ctx context.Context, userId int64) ([]models.Circle, error) {
 	return circles, nil
 }
 
-func AddUserToCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
-	coll, collErr := GetCollection(circleCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
+func (s *MongoStore) AddUserToCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	coll := s.collection(circleCollectionName)
 	fmt.Printf("%s\n", circleId)
 
 	filter := bson.M{"_id": circleId}
@@ -103,22 +107,27 @@ func AddUserToCircle(ctx context.Context, circleId bson.ObjectID, userId int64)
 	var updatedCircle models.Circle
 	err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updatedCircle)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	}
 
 	return &updatedCircle, nil
 }
 
-func RemoveUserFromCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+func (s *MongoStore) RemoveUserFromCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
 
-	coll, collErr := GetCollection(circleCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
+	coll := s.collection(circleCollectionName)
 
 	// Build filter and update
 	filter := bson.M{"_id": circleId}
-	update := bson.M{"$pull": bson.M{"members": userId}}
+	// Exclusions involving the member no longer apply.
+	update := bson.M{"$pull": bson.M{
+		"members": userId,
+		"admins":  userId,
+		"exclusions": bson.M{"$or": bson.A{
+			bson.M{"angelId": userId},
+			bson.M{"mortalId": userId},
+		}},
+	}}
 
 	// Return the updated document
 	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
@@ -126,37 +135,26 @@ func RemoveUserFromCircle(ctx context.Context, circleId bson.ObjectID, userId in
 	var updatedCircle models.Circle
 	err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updatedCircle)
 	if err != nil {
-		return nil, err
-	}
-
-	return &updatedCircle, nil
-}
-
-func SetCircleCurrentSession(ctx context.Context, circleId bson.ObjectID, sessionId bson.ObjectID) error {
-	coll, collErr := GetCollection(circleCollectionName)
-	if collErr != nil {
-		return collErr
-	}
-
-	update := bson.M{
-		"$set": bson.M{
-			"currentSession": sessionId,
-		},
+		return nil, notFound(err)
 	}
 
-	_, err := coll.UpdateByID(ctx, circleId, update)
-	if err != nil {
-		return err
+	// An offer of the circle to the member lapses with their membership.
+	if updatedCircle.PendingOwnerId == userId {
+		_, err := coll.UpdateOne(ctx,
+			bson.M{"_id": circleId, "pendingOwnerId": userId},
+			bson.M{"$unset": bson.M{"pendingOwnerId": ""}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		updatedCircle.PendingOwnerId = 0
 	}
 
-	return nil
+	return &updatedCircle, nil
 }
 
-func UnsetCircleCurrentSession(ctx context.Context, circleId, sessionId bson.ObjectID) (bool, error) {
-	coll, collErr := GetCollection(circleCollectionName)
-	if collErr != nil {
-		return false, collErr
-	}
+func (s *MongoStore) UnsetCircleCurrentSession(ctx context.Context, circleId, sessionId bson.ObjectID) (bool, error) {
+	coll := s.collection(circleCollectionName)
 
 	// Only unset if the currentSession matches the given sessionId
 	filter := bson.M{
@@ -177,3 +175,129 @@ func UnsetCircleCurrentSession(ctx context.Context, circleId, sessionId bson.Obj
 	// MatchedCount == 1 means we successfully unset
 	return result.MatchedCount == 1, nil
 }
+
+func (s *MongoStore) GetCircleByInviteCode(ctx context.Context, inviteCode string) (*models.Circle, error) {
+	coll := s.collection(circleCollectionName)
+
+	var circle models.Circle
+	err := coll.FindOne(ctx, bson.M{"inviteCode": inviteCode}).Decode(&circle)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &circle, nil
+}
+
+func (s *MongoStore) SetCircleInviteCode(ctx context.Context, circleId bson.ObjectID, inviteCode string) (*models.Circle, error) {
+	coll := s.collection(circleCollectionName)
+
+	update := bson.M{"$set": bson.M{"inviteCode": inviteCode}}
+	if inviteCode == "" {
+		update = bson.M{"$unset": bson.M{"inviteCode": ""}}
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updatedCircle models.Circle
+	err := coll.FindOneAndUpdate(ctx, bson.M{"_id": circleId}, update, opts).Decode(&updatedCircle)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &updatedCircle, nil
+}
+
+func (s *MongoStore) AddCircleExclusions(ctx context.Context, circleId bson.ObjectID, exclusions []models.Exclusion) (*models.Circle, error) {
+	coll := s.collection(circleCollectionName)
+
+	update := bson.M{"$addToSet": bson.M{"exclusions": bson.M{"$each": exclusions}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updatedCircle models.Circle
+	err := coll.FindOneAndUpdate(ctx, bson.M{"_id": circleId}, update, opts).Decode(&updatedCircle)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &updatedCircle, nil
+}
+
+func (s *MongoStore) RemoveCircleExclusion(ctx context.Context, circleId bson.ObjectID, exclusion models.Exclusion) (*models.Circle, error) {
+	coll := s.collection(circleCollectionName)
+
+	update := bson.M{"$pull": bson.M{"exclusions": bson.M{"angelId": exclusion.AngelId, "mortalId": exclusion.MortalId}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updatedCircle models.Circle
+	err := coll.FindOneAndUpdate(ctx, bson.M{"_id": circleId}, update, opts).Decode(&updatedCircle)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &updatedCircle, nil
+}
+
+// updateCircleWhere applies update to the circle if it also matches filter,
+// and returns ErrNotFound if it doesn't.
+func (s *MongoStore) updateCircleWhere(ctx context.Context, circleId bson.ObjectID, filter bson.M, update any) (*models.Circle, error) {
+	coll := s.collection(circleCollectionName)
+
+	filter["_id"] = circleId
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updatedCircle models.Circle
+	err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updatedCircle)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &updatedCircle, nil
+}
+
+func (s *MongoStore) AddCircleAdmin(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircleWhere(ctx, circleId,
+		bson.M{"members": userId, "ownerId": bson.M{"$ne": userId}},
+		bson.M{"$addToSet": bson.M{"admins": userId}},
+	)
+}
+
+func (s *MongoStore) RemoveCircleAdmin(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircleWhere(ctx, circleId, bson.M{}, bson.M{"$pull": bson.M{"admins": userId}})
+}
+
+func (s *MongoStore) OfferCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircleWhere(ctx, circleId,
+		bson.M{"members": userId, "ownerId": bson.M{"$ne": userId}},
+		bson.M{"$set": bson.M{"pendingOwnerId": userId}},
+	)
+}
+
+func (s *MongoStore) AcceptCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	if userId == 0 {
+		return nil, ErrNotFound
+	}
+
+	// A pipeline update sees the circle as it was, so "$ownerId" is the
+	// previous owner, who stays on as an admin.
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"ownerId": userId,
+			"admins": bson.M{"$setUnion": bson.A{
+				bson.M{"$setDifference": bson.A{bson.M{"$ifNull": bson.A{"$admins", bson.A{}}}, bson.A{userId}}},
+				bson.A{"$ownerId"},
+			}},
+		}},
+		bson.M{"$unset": "pendingOwnerId"},
+	}
+	return s.updateCircleWhere(ctx, circleId, bson.M{"pendingOwnerId": userId, "members": userId}, update)
+}
+
+func (s *MongoStore) DeclineCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	if userId == 0 {
+		return nil, ErrNotFound
+	}
+	return s.updateCircleWhere(ctx, circleId,
+		bson.M{"pendingOwnerId": userId},
+		bson.M{"$unset": bson.M{"pendingOwnerId": ""}},
+	)
+}
@@ -11,12 +11,9 @@ var (
 	matchCollectionName = "matches"
 )
 
-func GetMortalMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error) {
+func (s *MongoStore) GetMortalMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error) {
 
-	coll, collErr := GetCollection(matchCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
+	coll := s.collection(matchCollectionName)
 
 	var m models.Match
 	err := coll.FindOne(ctx, bson.M{
@@ -24,16 +21,13 @@ func GetMortalMatch(ctx context.Context, sessionId bson.ObjectID, userId int64)
 		"angel_id":   userId,
 	}).Decode(&m)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	}
 	return &m, nil
 }
 
-func GetAngelMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error) {
-	coll, collErr := GetCollection(matchCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
+func (s *MongoStore) GetAngelMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error) {
+	coll := s.collection(matchCollectionName)
 
 	var m models.Match
 	err := coll.FindOne(ctx, bson.M{
@@ -41,34 +35,23 @@ func GetAngelMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (
 		"mortal_id":  userId,
 	}).Decode(&m)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	}
 	return &m, nil
 }
 
-func CreateMatches(ctx context.Context, matches []*models.Match, sessionId bson.ObjectID) ([]*models.Match, error) {
-
-	coll, collErr := GetCollection(matchCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
-	if len(matches) == 0 {
-		return nil, nil
-	}
-	docs := make([]interface{}, 0, len(matches))
-
-	for _, m := range matches {
-		m.SessionId = sessionId
-		if m.ID.IsZero() {
-			m.ID = bson.NewObjectID()
-		}
-		docs = append(docs, m)
-	}
-	_, err := coll.InsertMany(ctx, docs)
+func (s *MongoStore) GetMatches(ctx context.Context, sessionId bson.ObjectID) ([]*models.Match, error) {
+	coll := s.collection(matchCollectionName)
 
+	cur, err := coll.Find(ctx, bson.M{"session_id": sessionId})
 	if err != nil {
 		return nil, err
 	}
+	defer cur.Close(ctx)
 
+	var matches []*models.Match
+	if err := cur.All(ctx, &matches); err != nil {
+		return nil, err
+	}
 	return matches, nil
 }
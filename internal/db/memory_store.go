@@ -0,0 +1,820 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"grandfather/internal/models"
+	"slices"
+	"sync"
+	"time"
+
+	tlgModels "github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// MemoryStore is a Store that keeps everything in process memory. It mirrors
+// the behaviour of MongoStore closely enough to exercise every handler flow
+// in tests without a running MongoDB.
+type MemoryStore struct {
+	mu       sync.Mutex
+	circles  map[bson.ObjectID]*models.Circle
+	users    map[int64]*models.User
+	sessions map[bson.ObjectID]*models.Session
+	matches  []*models.Match
+	messages []*models.Message
+	watchers []chan struct{}
+}
+
+var (
+	_ Store          = (*MemoryStore)(nil)
+	_ MessageWatcher = (*MemoryStore)(nil)
+)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		circles:  map[bson.ObjectID]*models.Circle{},
+		users:    map[int64]*models.User{},
+		sessions: map[bson.ObjectID]*models.Session{},
+	}
+}
+
+// Values are copied on the way in and out so callers can never mutate the
+// stored state behind the store's back, just like with a real database.
+
+func copyCircle(c *models.Circle) *models.Circle {
+	cp := *c
+	cp.Members = slices.Clone(c.Members)
+	cp.Admins = slices.Clone(c.Admins)
+	cp.Exclusions = slices.Clone(c.Exclusions)
+	if c.CurrentSession != nil {
+		id := *c.CurrentSession
+		cp.CurrentSession = &id
+	}
+	return &cp
+}
+
+func copySession(s *models.Session) *models.Session {
+	cp := *s
+	cp.Members = slices.Clone(s.Members)
+	return &cp
+}
+
+func copyUser(u *models.User) *models.User {
+	cp := *u
+	return &cp
+}
+
+func copyMatch(m *models.Match) *models.Match {
+	cp := *m
+	return &cp
+}
+
+func copyMessage(m *models.Message) *models.Message {
+	cp := *m
+	cp.Buttons = nil
+	for _, row := range m.Buttons {
+		cp.Buttons = append(cp.Buttons, slices.Clone(row))
+	}
+	if m.Payload != nil {
+		payload := *m.Payload
+		cp.Payload = &payload
+	}
+	cp.DeliveredMessageIds = slices.Clone(m.DeliveredMessageIds)
+	if m.ReplyToId != nil {
+		id := *m.ReplyToId
+		cp.ReplyToId = &id
+	}
+	if m.Confirmation != nil {
+		confirmation := *m.Confirmation
+		confirmation.Buttons = nil
+		for _, row := range m.Confirmation.Buttons {
+			confirmation.Buttons = append(confirmation.Buttons, slices.Clone(row))
+		}
+		cp.Confirmation = &confirmation
+	}
+	return &cp
+}
+
+// Circles
+
+func (s *MemoryStore) CreateCircle(ctx context.Context, circleName string, circleOwner int64) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, circle := range s.circles {
+		if circle.Name == circleName {
+			return nil, ErrDuplicate
+		}
+	}
+
+	circle := &models.Circle{
+		ID:         bson.NewObjectID(),
+		Name:       circleName,
+		OwnerId:    circleOwner,
+		Members:    []int64{circleOwner},
+		InviteCode: NewInviteCode(),
+	}
+	s.circles[circle.ID] = circle
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) GetCircle(ctx context.Context, circleName string) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, circle := range s.circles {
+		if circle.Name == circleName {
+			return copyCircle(circle), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) GetCircleByID(ctx context.Context, circleId bson.ObjectID) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) GetCircles(ctx context.Context, userId int64) ([]models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var circles []models.Circle
+	for _, circle := range s.circles {
+		if slices.Contains(circle.Members, userId) {
+			circles = append(circles, *copyCircle(circle))
+		}
+	}
+	// Map iteration is random; ObjectIDs from one process sort by creation.
+	slices.SortFunc(circles, func(a, b models.Circle) int { return bytes.Compare(a.ID[:], b.ID[:]) })
+	return circles, nil
+}
+
+func (s *MemoryStore) AddUserToCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !slices.Contains(circle.Members, userId) {
+		circle.Members = append(circle.Members, userId)
+	}
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) RemoveUserFromCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	circle.Members = slices.DeleteFunc(circle.Members, func(id int64) bool { return id == userId })
+	circle.Admins = slices.DeleteFunc(circle.Admins, func(id int64) bool { return id == userId })
+	circle.Exclusions = slices.DeleteFunc(circle.Exclusions, func(e models.Exclusion) bool {
+		return e.AngelId == userId || e.MortalId == userId
+	})
+	if circle.PendingOwnerId == userId {
+		circle.PendingOwnerId = 0
+	}
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) UnsetCircleCurrentSession(ctx context.Context, circleId, sessionId bson.ObjectID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok || circle.CurrentSession == nil || *circle.CurrentSession != sessionId {
+		return false, nil
+	}
+	circle.CurrentSession = nil
+	return true, nil
+}
+
+func (s *MemoryStore) GetCircleByInviteCode(ctx context.Context, inviteCode string) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, circle := range s.circles {
+		if inviteCode != "" && circle.InviteCode == inviteCode {
+			return copyCircle(circle), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) SetCircleInviteCode(ctx context.Context, circleId bson.ObjectID, inviteCode string) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	circle.InviteCode = inviteCode
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) AddCircleExclusions(ctx context.Context, circleId bson.ObjectID, exclusions []models.Exclusion) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	for _, e := range exclusions {
+		if !slices.Contains(circle.Exclusions, e) {
+			circle.Exclusions = append(circle.Exclusions, e)
+		}
+	}
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) RemoveCircleExclusion(ctx context.Context, circleId bson.ObjectID, exclusion models.Exclusion) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	circle.Exclusions = slices.DeleteFunc(circle.Exclusions, func(e models.Exclusion) bool { return e == exclusion })
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) AddCircleAdmin(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok || circle.OwnerId == userId || !slices.Contains(circle.Members, userId) {
+		return nil, ErrNotFound
+	}
+	if !slices.Contains(circle.Admins, userId) {
+		circle.Admins = append(circle.Admins, userId)
+	}
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) RemoveCircleAdmin(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	circle.Admins = slices.DeleteFunc(circle.Admins, func(id int64) bool { return id == userId })
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) OfferCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok || circle.OwnerId == userId || !slices.Contains(circle.Members, userId) {
+		return nil, ErrNotFound
+	}
+	circle.PendingOwnerId = userId
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) AcceptCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok || userId == 0 || circle.PendingOwnerId != userId || !slices.Contains(circle.Members, userId) {
+		return nil, ErrNotFound
+	}
+	circle.Admins = slices.DeleteFunc(circle.Admins, func(id int64) bool { return id == userId })
+	if !slices.Contains(circle.Admins, circle.OwnerId) {
+		circle.Admins = append(circle.Admins, circle.OwnerId)
+	}
+	circle.OwnerId = userId
+	circle.PendingOwnerId = 0
+	return copyCircle(circle), nil
+}
+
+func (s *MemoryStore) DeclineCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok || userId == 0 || circle.PendingOwnerId != userId {
+		return nil, ErrNotFound
+	}
+	circle.PendingOwnerId = 0
+	return copyCircle(circle), nil
+}
+
+// Users
+
+func (s *MemoryStore) GetUser(ctx context.Context, userId int64) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return nil, nil
+	}
+	return copyUser(user), nil
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, user *tlgModels.User, chatId int64) (*models.User, error, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, alreadyCreatedUser := s.users[user.ID]
+	if !alreadyCreatedUser {
+		existing = &models.User{ID: user.ID}
+		s.users[user.ID] = existing
+	}
+	existing.ChatID = chatId
+	existing.FirstName = user.FirstName
+	existing.LastName = user.LastName
+	existing.UserHandle = user.Username
+
+	return &models.User{
+		ID:     user.ID,
+		ChatID: chatId,
+	}, nil, alreadyCreatedUser
+}
+
+func (s *MemoryStore) GetUsers(ctx context.Context, userIds []int64) ([]*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ordered := make([]*models.User, 0, len(userIds))
+	for _, id := range userIds {
+		if u, ok := s.users[id]; ok {
+			ordered = append(ordered, copyUser(u))
+		}
+	}
+	return ordered, nil
+}
+
+func (s *MemoryStore) UpdateState(ctx context.Context, userId int64, state models.UserState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[userId]; ok {
+		user.State = state
+		user.StateUpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (s *MemoryStore) UpdateStateWithCircle(ctx context.Context, userId int64, state models.UserState, circleId bson.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[userId]; ok {
+		user.State = state
+		user.StateCircleId = circleId
+		user.StateUpdatedAt = time.Now()
+	}
+	return nil
+}
+
+func (s *MemoryStore) ExpireIdleChats(ctx context.Context, idleSince time.Time) ([]*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []*models.User
+	for _, user := range s.users {
+		if slices.Contains(models.ChatStates, user.State) && user.StateUpdatedAt.Before(idleSince) {
+			expired = append(expired, copyUser(user))
+			user.State = models.StateNone
+			user.StateCircleId = bson.ObjectID{}
+			user.StateUpdatedAt = time.Now()
+		}
+	}
+	return expired, nil
+}
+
+// Sessions
+
+func (s *MemoryStore) StartSession(ctx context.Context, circleId bson.ObjectID, members []int64, deadline *time.Time, matches []*models.Match, notifications []*models.Message) (*models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	circle, ok := s.circles[circleId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if circle.CurrentSession != nil {
+		if current, ok := s.sessions[*circle.CurrentSession]; ok && current.State == models.StateActive {
+			return nil, ErrSessionActive
+		}
+	}
+
+	session := &models.Session{
+		ID:        bson.NewObjectID(),
+		CircleId:  circleId,
+		Members:   slices.Clone(members),
+		State:     models.StateActive,
+		CreatedAt: time.Now(),
+		Deadline:  deadline,
+	}
+	s.sessions[session.ID] = session
+
+	for _, m := range matches {
+		m.ID = bson.NewObjectID()
+		m.SessionId = session.ID
+		s.matches = append(s.matches, copyMatch(m))
+	}
+
+	id := session.ID
+	circle.CurrentSession = &id
+	s.queueNotifications(notifications)
+	return copySession(session), nil
+}
+
+func (s *MemoryStore) GetSession(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionId]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copySession(session), nil
+}
+
+func (s *MemoryStore) GetCircleSessions(ctx context.Context, circleId bson.ObjectID) ([]*models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var current bson.ObjectID
+	if circle, ok := s.circles[circleId]; ok && circle.CurrentSession != nil {
+		current = *circle.CurrentSession
+	}
+
+	var sessions []*models.Session
+	for _, session := range s.sessions {
+		if session.CircleId == circleId && (session.State == models.StateFinished || session.ID == current) {
+			sessions = append(sessions, copySession(session))
+		}
+	}
+	slices.SortFunc(sessions, func(a, b *models.Session) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return bytes.Compare(b.ID[:], a.ID[:])
+	})
+	return sessions, nil
+}
+
+func (s *MemoryStore) UpdateSessionToFinished(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[sessionId]
+	if !ok || session.State != models.StateActive {
+		return nil, ErrNotFound
+	}
+	session.State = models.StateFinished
+	return copySession(session), nil
+}
+
+// Matches
+
+func (s *MemoryStore) findMatch(match func(m *models.Match) bool) (*models.Match, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.matches {
+		if match(m) {
+			return copyMatch(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) GetMortalMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error) {
+	return s.findMatch(func(m *models.Match) bool { return m.SessionId == sessionId && m.AngelId == userId })
+}
+
+func (s *MemoryStore) GetAngelMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error) {
+	return s.findMatch(func(m *models.Match) bool { return m.SessionId == sessionId && m.MortalId == userId })
+}
+
+func (s *MemoryStore) GetMatches(ctx context.Context, sessionId bson.ObjectID) ([]*models.Match, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches []*models.Match
+	for _, m := range s.matches {
+		if m.SessionId == sessionId {
+			matches = append(matches, copyMatch(m))
+		}
+	}
+	return matches, nil
+}
+
+// Messages
+
+func (s *MemoryStore) CreateMessage(ctx context.Context, message *models.Message) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message.ID = bson.NewObjectID()
+	message.Kind = models.KindRelay
+	message.MessageState = models.NotDelivered
+	if message.Payload != nil {
+		message.Message = message.Payload.Summary()
+	}
+	s.messages = append(s.messages, copyMessage(message))
+	s.messagesQueued()
+	return message, nil
+}
+
+func (s *MemoryStore) CreateNotifications(ctx context.Context, notifications []*models.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queueNotifications(notifications)
+	return nil
+}
+
+// queueNotifications adds notifications to the outbox. Callers must hold
+// s.mu.
+func (s *MemoryStore) queueNotifications(notifications []*models.Message) {
+	for _, n := range notifications {
+		n.ID = bson.NewObjectID()
+		n.Kind = models.KindNotification
+		n.MessageState = models.NotDelivered
+		s.messages = append(s.messages, copyMessage(n))
+	}
+	s.messagesQueued()
+}
+
+func (s *MemoryStore) WatchMessages(ctx context.Context, notify func()) error {
+	queued := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	s.watchers = append(s.watchers, queued)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.watchers = slices.DeleteFunc(s.watchers, func(w chan struct{}) bool { return w == queued })
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-queued:
+			notify()
+		}
+	}
+}
+
+// messagesQueued wakes up every watcher. Callers must hold s.mu.
+func (s *MemoryStore) messagesQueued() {
+	for _, w := range s.watchers {
+		// A pending wake-up already covers this message.
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *MemoryStore) GetUndeliveredMessages(ctx context.Context) ([]*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	undeliveredMessages := []*models.Message{}
+	for _, m := range s.messages {
+		if m.MessageState == models.NotDelivered || m.MessageState == models.Sending {
+			undeliveredMessages = append(undeliveredMessages, copyMessage(m))
+		}
+	}
+	return undeliveredMessages, nil
+}
+
+func (s *MemoryStore) ClaimMessage(ctx context.Context, leaseOwner string, leaseFor time.Duration) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, m := range s.messages {
+		due := m.MessageState == models.NotDelivered && !m.NextAttemptAt.After(now)
+		expired := m.MessageState == models.Sending && !m.LeaseExpiresAt.After(now)
+		if due || expired {
+			m.MessageState = models.Sending
+			m.LeaseOwner = leaseOwner
+			m.LeaseExpiresAt = now.Add(leaseFor)
+			return copyMessage(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// leased returns the message leaseOwner is sending, or nil when it isn't.
+// Callers must hold s.mu.
+func (s *MemoryStore) leased(messageId bson.ObjectID, leaseOwner string) *models.Message {
+	for _, m := range s.messages {
+		if m.ID == messageId && m.MessageState == models.Sending && m.LeaseOwner == leaseOwner {
+			return m
+		}
+	}
+	return nil
+}
+
+// releaseLease applies update to a message leaseOwner is sending and ends
+// the lease. Callers must hold s.mu.
+func (s *MemoryStore) releaseLease(messageId bson.ObjectID, leaseOwner string, update func(m *models.Message)) error {
+	m := s.leased(messageId, leaseOwner)
+	if m == nil {
+		return ErrNotFound
+	}
+	update(m)
+	m.LeaseOwner = ""
+	m.LeaseExpiresAt = time.Time{}
+	return nil
+}
+
+func (s *MemoryStore) UpdateMessageToDelivered(ctx context.Context, messageId bson.ObjectID, leaseOwner string, deliveredMessageIds []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.releaseLease(messageId, leaseOwner, func(m *models.Message) {
+		m.MessageState = models.Delivered
+		m.DeliveredMessageIds = slices.Clone(deliveredMessageIds)
+	})
+}
+
+func (s *MemoryStore) ScheduleMessageRetry(ctx context.Context, messageId bson.ObjectID, leaseOwner string, attempts int, nextAttemptAt time.Time, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.releaseLease(messageId, leaseOwner, func(m *models.Message) {
+		m.MessageState = models.NotDelivered
+		m.Attempts = attempts
+		m.NextAttemptAt = nextAttemptAt
+		m.LastError = lastError
+	})
+}
+
+func (s *MemoryStore) UpdateMessageToFailed(ctx context.Context, messageId bson.ObjectID, leaseOwner string, attempts int, lastError string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.releaseLease(messageId, leaseOwner, func(m *models.Message) {
+		m.MessageState = models.Failed
+		m.Attempts = attempts
+		m.LastError = lastError
+	})
+}
+
+func (s *MemoryStore) RecordMessageHeader(ctx context.Context, messageId bson.ObjectID, leaseOwner string, headerMessageId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.leased(messageId, leaseOwner)
+	if m == nil {
+		return ErrNotFound
+	}
+	m.DeliveredMessageIds = []int{headerMessageId}
+	return nil
+}
+
+func (s *MemoryStore) ExtendMessageLease(ctx context.Context, messageId bson.ObjectID, leaseOwner string, leaseFor time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.leased(messageId, leaseOwner)
+	if m == nil {
+		return ErrNotFound
+	}
+	m.LeaseExpiresAt = time.Now().Add(leaseFor)
+	return nil
+}
+
+func (s *MemoryStore) GetMessageByDeliveredId(ctx context.Context, recipientId int64, deliveredMessageId int) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.messages {
+		if m.RecepientId == recipientId && slices.Contains(m.DeliveredMessageIds, deliveredMessageId) {
+			return copyMessage(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) GetMessage(ctx context.Context, messageId bson.ObjectID) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.messages {
+		if m.ID == messageId {
+			return copyMessage(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) GetMessageBySource(ctx context.Context, senderId int64, sourceMessageId int) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.messages {
+		if m.SenderId == senderId && m.Payload != nil && m.Payload.SourceMessageID == sourceMessageId {
+			return copyMessage(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) UpdateMessagePayload(ctx context.Context, messageId bson.ObjectID, payload models.Payload) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.messages {
+		if m.ID == messageId {
+			m.Payload = &payload
+			m.Message = payload.Summary()
+			return copyMessage(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) UpdateMessageToUnsent(ctx context.Context, messageId bson.ObjectID) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.messages {
+		if m.ID == messageId {
+			m.MessageState = models.Unsent
+			return copyMessage(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) SetMessageConfirmation(ctx context.Context, messageId bson.ObjectID, confirmation models.Confirmation) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.messages {
+		if m.ID == messageId {
+			m.Confirmation = &confirmation
+			return copyMessage(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) MarkMessageSeen(ctx context.Context, messageId bson.ObjectID) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.messages {
+		if m.ID == messageId && m.MessageState == models.Delivered && m.SeenAt.IsZero() {
+			m.SeenAt = time.Now()
+			return copyMessage(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) GetMessageHistory(ctx context.Context, circleId bson.ObjectID, userId int64, skip, limit int) ([]*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var history []*models.Message
+	for _, m := range slices.Backward(s.messages) {
+		if m.CircleId != circleId || m.Kind == models.KindNotification || m.MessageState == models.Unsent {
+			continue
+		}
+		if m.SenderId != userId && m.RecepientId != userId {
+			continue
+		}
+		history = append(history, copyMessage(m))
+	}
+
+	if skip >= len(history) {
+		return nil, nil
+	}
+	history = history[skip:]
+	return history[:min(limit, len(history))], nil
+}
@@ -3,45 +3,57 @@ package db
 import (
 	"context"
 	"grandfather/internal/models"
+	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 var (
 	messagesCollectionName = "messages"
 )
 
-func CreateMessage(ctx context.Context, senderId int64, receipientId int64, circleName string, message string, senderRole string) (*models.Message, error) {
-	messageCollection, collErr := GetCollection(messagesCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
+func (s *MongoStore) CreateMessage(ctx context.Context, message *models.Message) (*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
 
-	newMessage := &models.Message{
-		ID:           bson.NewObjectID(),
-		SenderId:     senderId,
-		RecepientId:  receipientId,
-		MessageState: models.NotDelivered,
-		CircleName:   circleName,
-		Message:      message,
-		SenderRole:   senderRole,
+	message.ID = bson.NewObjectID()
+	message.Kind = models.KindRelay
+	message.MessageState = models.NotDelivered
+	if message.Payload != nil {
+		message.Message = message.Payload.Summary()
 	}
 
-	_, err := messageCollection.InsertOne(ctx, newMessage)
+	_, err := messageCollection.InsertOne(ctx, message)
 	if err != nil {
 		return nil, err
 	}
-	return newMessage, nil
+	return message, nil
 }
 
-func GetUndeliveredMessages(ctx context.Context) ([]*models.Message, error) {
+func (s *MongoStore) CreateNotifications(ctx context.Context, notifications []*models.Message) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	messageCollection := s.collection(messagesCollectionName)
 
-	messageCollection, collErr := GetCollection(messagesCollectionName)
-	if collErr != nil {
-		return nil, collErr
+	docs := make([]interface{}, 0, len(notifications))
+	for _, n := range notifications {
+		n.ID = bson.NewObjectID()
+		n.Kind = models.KindNotification
+		n.MessageState = models.NotDelivered
+		docs = append(docs, n)
 	}
 
-	filter := bson.M{"messageState": models.NotDelivered}
+	_, err := messageCollection.InsertMany(ctx, docs)
+	return err
+}
+
+func (s *MongoStore) GetUndeliveredMessages(ctx context.Context) ([]*models.Message, error) {
+
+	messageCollection := s.collection(messagesCollectionName)
+
+	filter := bson.M{"messageState": bson.M{"$in": bson.A{models.NotDelivered, models.Sending}}}
 
 	cur, err := messageCollection.Find(ctx, filter)
 	if err != nil {
@@ -65,16 +77,219 @@ func GetUndeliveredMessages(ctx context.Context) ([]*models.Message, error) {
 	return undeliveredMessages, nil
 }
 
-func UpdateMessageToDelivered(ctx context.Context, messageId bson.ObjectID) error {
+func (s *MongoStore) ClaimMessage(ctx context.Context, leaseOwner string, leaseFor time.Duration) (*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
 
-	messageCollection, collErr := GetCollection(messagesCollectionName)
-	if collErr != nil {
-		return nil
+	now := time.Now()
+	filter := bson.M{"$or": bson.A{
+		// Messages that never failed have no nextAttemptAt.
+		bson.M{"messageState": models.NotDelivered, "nextAttemptAt": bson.M{"$not": bson.M{"$gt": now}}},
+		// An expired lease belongs to an instance that died mid-delivery.
+		bson.M{"messageState": models.Sending, "leaseExpiresAt": bson.M{"$lte": now}},
+	}}
+	update := bson.M{"$set": bson.M{
+		"messageState":   models.Sending,
+		"leaseOwner":     leaseOwner,
+		"leaseExpiresAt": now.Add(leaseFor),
+	}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var message models.Message
+	if err := messageCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&message); err != nil {
+		return nil, notFound(err)
 	}
+	return &message, nil
+}
+
+// releaseLease applies set to a message leaseOwner is sending and ends the
+// lease. It returns ErrNotFound when the lease was lost.
+func (s *MongoStore) releaseLease(ctx context.Context, messageId bson.ObjectID, leaseOwner string, set bson.M) error {
+	messageCollection := s.collection(messagesCollectionName)
 
-	_, err := messageCollection.UpdateOne(ctx,
-		bson.M{"_id": messageId},
-		bson.M{"$set": bson.M{"messageState": models.Delivered}},
+	result, err := messageCollection.UpdateOne(ctx,
+		bson.M{"_id": messageId, "messageState": models.Sending, "leaseOwner": leaseOwner},
+		bson.M{
+			"$set":   set,
+			"$unset": bson.M{"leaseOwner": "", "leaseExpiresAt": ""},
+		},
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) UpdateMessageToDelivered(ctx context.Context, messageId bson.ObjectID, leaseOwner string, deliveredMessageIds []int) error {
+	return s.releaseLease(ctx, messageId, leaseOwner, bson.M{
+		"messageState":        models.Delivered,
+		"deliveredMessageIds": deliveredMessageIds,
+	})
+}
+
+func (s *MongoStore) ScheduleMessageRetry(ctx context.Context, messageId bson.ObjectID, leaseOwner string, attempts int, nextAttemptAt time.Time, lastError string) error {
+	return s.releaseLease(ctx, messageId, leaseOwner, bson.M{
+		"messageState":  models.NotDelivered,
+		"attempts":      attempts,
+		"nextAttemptAt": nextAttemptAt,
+		"lastError":     lastError,
+	})
+}
+
+func (s *MongoStore) UpdateMessageToFailed(ctx context.Context, messageId bson.ObjectID, leaseOwner string, attempts int, lastError string) error {
+	return s.releaseLease(ctx, messageId, leaseOwner, bson.M{
+		"messageState": models.Failed,
+		"attempts":     attempts,
+		"lastError":    lastError,
+	})
+}
+
+func (s *MongoStore) RecordMessageHeader(ctx context.Context, messageId bson.ObjectID, leaseOwner string, headerMessageId int) error {
+	messageCollection := s.collection(messagesCollectionName)
+
+	result, err := messageCollection.UpdateOne(ctx,
+		bson.M{"_id": messageId, "messageState": models.Sending, "leaseOwner": leaseOwner},
+		bson.M{"$set": bson.M{"deliveredMessageIds": []int{headerMessageId}}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) ExtendMessageLease(ctx context.Context, messageId bson.ObjectID, leaseOwner string, leaseFor time.Duration) error {
+	messageCollection := s.collection(messagesCollectionName)
+
+	result, err := messageCollection.UpdateOne(ctx,
+		bson.M{"_id": messageId, "messageState": models.Sending, "leaseOwner": leaseOwner},
+		bson.M{"$set": bson.M{"leaseExpiresAt": time.Now().Add(leaseFor)}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *MongoStore) GetMessageByDeliveredId(ctx context.Context, recipientId int64, deliveredMessageId int) (*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
+
+	filter := bson.M{"recepientId": recipientId, "deliveredMessageIds": deliveredMessageId}
+
+	var message models.Message
+	if err := messageCollection.FindOne(ctx, filter).Decode(&message); err != nil {
+		return nil, notFound(err)
+	}
+	return &message, nil
+}
+
+func (s *MongoStore) GetMessage(ctx context.Context, messageId bson.ObjectID) (*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
+
+	var message models.Message
+	if err := messageCollection.FindOne(ctx, bson.M{"_id": messageId}).Decode(&message); err != nil {
+		return nil, notFound(err)
+	}
+	return &message, nil
+}
+
+func (s *MongoStore) GetMessageBySource(ctx context.Context, senderId int64, sourceMessageId int) (*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
+
+	filter := bson.M{"senderId": senderId, "payload.sourceMessageId": sourceMessageId}
+
+	var message models.Message
+	if err := messageCollection.FindOne(ctx, filter).Decode(&message); err != nil {
+		return nil, notFound(err)
+	}
+	return &message, nil
+}
+
+func (s *MongoStore) UpdateMessagePayload(ctx context.Context, messageId bson.ObjectID, payload models.Payload) (*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
+
+	update := bson.M{"$set": bson.M{
+		"payload": payload,
+		"message": payload.Summary(),
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated models.Message
+	if err := messageCollection.FindOneAndUpdate(ctx, bson.M{"_id": messageId}, update, opts).Decode(&updated); err != nil {
+		return nil, notFound(err)
+	}
+	return &updated, nil
+}
+
+func (s *MongoStore) UpdateMessageToUnsent(ctx context.Context, messageId bson.ObjectID) (*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
+
+	update := bson.M{"$set": bson.M{"messageState": models.Unsent}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated models.Message
+	if err := messageCollection.FindOneAndUpdate(ctx, bson.M{"_id": messageId}, update, opts).Decode(&updated); err != nil {
+		return nil, notFound(err)
+	}
+	return &updated, nil
+}
+
+func (s *MongoStore) SetMessageConfirmation(ctx context.Context, messageId bson.ObjectID, confirmation models.Confirmation) (*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
+
+	update := bson.M{"$set": bson.M{"confirmation": confirmation}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated models.Message
+	if err := messageCollection.FindOneAndUpdate(ctx, bson.M{"_id": messageId}, update, opts).Decode(&updated); err != nil {
+		return nil, notFound(err)
+	}
+	return &updated, nil
+}
+
+func (s *MongoStore) MarkMessageSeen(ctx context.Context, messageId bson.ObjectID) (*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
+
+	filter := bson.M{"_id": messageId, "messageState": models.Delivered, "seenAt": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"seenAt": time.Now()}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated models.Message
+	if err := messageCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated); err != nil {
+		return nil, notFound(err)
+	}
+	return &updated, nil
+}
+
+func (s *MongoStore) GetMessageHistory(ctx context.Context, circleId bson.ObjectID, userId int64, skip, limit int) ([]*models.Message, error) {
+	messageCollection := s.collection(messagesCollectionName)
+
+	filter := bson.M{
+		"circleId":     circleId,
+		"kind":         bson.M{"$ne": models.KindNotification},
+		"messageState": bson.M{"$ne": models.Unsent},
+		"$or":          bson.A{bson.M{"senderId": userId}, bson.M{"recepientId": userId}},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetSkip(int64(skip)).SetLimit(int64(limit))
+
+	cursor, err := messageCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []*models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
 }
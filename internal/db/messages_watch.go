@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var (
+	changeStreamsCollectionName = "changeStreams"
+)
+
+// messagesStreamName identifies the messages change stream's resume token.
+const messagesStreamName = "messages"
+
+// Server error codes for change streams that can't be opened.
+const (
+	// codeChangeStreamNotSupported is returned by standalone servers.
+	codeChangeStreamNotSupported = 40573
+	// codeChangeStreamHistoryLost means the resume token fell off the oplog.
+	codeChangeStreamHistoryLost = 286
+)
+
+var _ MessageWatcher = (*MongoStore)(nil)
+
+type resumeToken struct {
+	Stream string   `bson:"_id"`
+	Token  bson.Raw `bson:"token"`
+}
+
+// WatchMessages follows inserts into the messages collection with a change
+// stream. The stream's resume token is saved after every event, so a
+// restarted bot picks up where the last one stopped.
+func (s *MongoStore) WatchMessages(ctx context.Context, notify func()) error {
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	messageCollection := s.collection(messagesCollectionName)
+
+	opts := options.ChangeStream()
+	token, loadErr := s.loadResumeToken(ctx, messagesStreamName)
+	if loadErr != nil && !errors.Is(loadErr, ErrNotFound) {
+		return fmt.Errorf("load resume token: %w", loadErr)
+	}
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+
+	stream, err := messageCollection.Watch(ctx, pipeline, opts)
+	if token != nil && hasErrorCode(err, codeChangeStreamHistoryLost) {
+		// The outbox polls on start, so starting afresh loses nothing.
+		stream, err = messageCollection.Watch(ctx, pipeline)
+	}
+	if hasErrorCode(err, codeChangeStreamNotSupported) {
+		return fmt.Errorf("%w: %v", ErrWatchUnsupported, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		notify()
+		if err := s.saveResumeToken(ctx, messagesStreamName, stream.ResumeToken()); err != nil {
+			return fmt.Errorf("save resume token: %w", err)
+		}
+	}
+	return stream.Err()
+}
+
+func (s *MongoStore) loadResumeToken(ctx context.Context, stream string) (bson.Raw, error) {
+	var token resumeToken
+	if err := s.collection(changeStreamsCollectionName).FindOne(ctx, bson.M{"_id": stream}).Decode(&token); err != nil {
+		return nil, notFound(err)
+	}
+	return token.Token, nil
+}
+
+func (s *MongoStore) saveResumeToken(ctx context.Context, stream string, token bson.Raw) error {
+	_, err := s.collection(changeStreamsCollectionName).ReplaceOne(ctx,
+		bson.M{"_id": stream},
+		resumeToken{Stream: stream, Token: token},
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func hasErrorCode(err error, code int) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(code)
+}
@@ -0,0 +1,365 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"grandfather/internal/models"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	migrationsCollectionName     = "migrations"
+	migrationLocksCollectionName = "migrationLocks"
+)
+
+// migrationLockTimeout is how long a lock left behind by an instance that
+// died while migrating holds up the others. The instance migrating renews
+// its lock well before then, however long the migrations take.
+const migrationLockTimeout = 10 * time.Minute
+
+// errMigrationLockLost ends migrations when another instance took the lock
+// over after it could not be renewed in time.
+var errMigrationLockLost = errors.New("migration lock lost")
+
+// migration changes the database from one version to the next. A migration
+// that fails is run again on the next start, so it has to cope with having
+// partly run before.
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrations are applied in order. Applied versions are recorded in the
+// database, so never change or renumber a migration that was released; add a
+// new one instead.
+var migrations = []migration{
+	{1, "index the outbox queue and message history", indexMessages},
+	{2, "record the circle and session of older relays", backfillMessageCircles},
+	{3, "make circle names and invite codes unique", uniqueCircleNames},
+	{4, "index matches by session", indexMatches},
+	{5, "index sessions by circle and idle chats", indexSessionsAndUsers},
+}
+
+// appliedMigration records a migration that ran.
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// migrate applies the migrations this database hasn't had yet. Instances
+// starting at the same time take turns, so each migration runs once.
+func (s *MongoStore) migrate(ctx context.Context) error {
+	ctx, unlock, err := s.lockMigrations(ctx)
+	if err != nil {
+		return fmt.Errorf("lock migrations: %w", err)
+	}
+	defer unlock()
+
+	coll := s.collection(migrationsCollectionName)
+
+	cursor, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var records []appliedMigration
+	if err := cursor.All(ctx, &records); err != nil {
+		return err
+	}
+	applied := make(map[int]bool, len(records))
+	for _, record := range records {
+		applied[record.Version] = true
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+
+		log.Printf("Applying migration %d: %s\n", m.version, m.description)
+		if err := m.up(ctx, s.db); err != nil {
+			if cause := context.Cause(ctx); errors.Is(cause, errMigrationLockLost) {
+				err = cause
+			}
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+
+		record := appliedMigration{Version: m.version, Description: m.description, AppliedAt: time.Now()}
+		if _, err := coll.InsertOne(ctx, record); err != nil {
+			return fmt.Errorf("record migration %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// lockMigrations waits until no other instance is migrating and returns the
+// function that lets the next one go. The lock is renewed until then; the
+// returned context ends with errMigrationLockLost if it is lost anyway.
+func (s *MongoStore) lockMigrations(ctx context.Context) (context.Context, func(), error) {
+	coll := s.collection(migrationLocksCollectionName)
+	owner := bson.NewObjectID()
+	held := bson.M{"_id": migrationsCollectionName, "owner": owner}
+
+	for {
+		lock := bson.M{"_id": migrationsCollectionName, "owner": owner, "expiresAt": time.Now().Add(migrationLockTimeout)}
+		_, err := coll.InsertOne(ctx, lock)
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, nil, err
+		}
+
+		// Someone else holds the lock, or held it and died.
+		if _, err := coll.DeleteOne(ctx, bson.M{"_id": migrationsCollectionName, "expiresAt": bson.M{"$lt": time.Now()}}); err != nil {
+			return nil, nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	lockCtx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		ticker := time.NewTicker(migrationLockTimeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-lockCtx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			update := bson.M{"$set": bson.M{"expiresAt": time.Now().Add(migrationLockTimeout)}}
+			result, err := coll.UpdateOne(lockCtx, held, update)
+			if err == nil && result.MatchedCount == 0 {
+				cancel(errMigrationLockLost)
+				return
+			}
+			// The next renewal may still make it in time.
+			if err != nil && lockCtx.Err() == nil {
+				log.Printf("Failed to renew the migration lock: %v\n", err)
+			}
+		}
+	}()
+
+	return lockCtx, func() {
+		cancel(nil)
+		_, _ = coll.DeleteOne(context.Background(), held)
+	}, nil
+}
+
+func indexMessages(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(messagesCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		// The outbox claims undelivered messages that are due and messages
+		// whose lease expired.
+		{Keys: bson.D{{Key: "messageState", Value: 1}, {Key: "nextAttemptAt", Value: 1}}},
+		{Keys: bson.D{{Key: "messageState", Value: 1}, {Key: "leaseExpiresAt", Value: 1}}},
+		// Message history pages through a circle's relays, newest first.
+		{Keys: bson.D{{Key: "circleId", Value: 1}, {Key: "_id", Value: -1}}},
+	})
+	return err
+}
+
+// backfillMessageCircles works out the circle and session of relays sent
+// before messages recorded them. A relay belongs to the session of the circle
+// it names that was running when it was sent and that had both its sender
+// and its recipient, which also tells apart circles sharing a name.
+func backfillMessageCircles(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection(circleCollectionName).Find(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	var circles []models.Circle
+	if err := cursor.All(ctx, &circles); err != nil {
+		return err
+	}
+
+	messages := db.Collection(messagesCollectionName)
+	for _, circle := range circles {
+		opts := options.Find().SetSort(bson.D{{Key: "time", Value: 1}, {Key: "_id", Value: 1}})
+		cursor, err := db.Collection(sessionCollectionName).Find(ctx, bson.M{"circleId": circle.ID}, opts)
+		if err != nil {
+			return err
+		}
+		var sessions []models.Session
+		if err := cursor.All(ctx, &sessions); err != nil {
+			return err
+		}
+
+		for i, session := range sessions {
+			sentIn := bson.M{"$gte": bson.NewObjectIDFromTimestamp(session.CreatedAt)}
+			if i+1 < len(sessions) {
+				sentIn["$lt"] = bson.NewObjectIDFromTimestamp(sessions[i+1].CreatedAt)
+			}
+			filter := bson.M{
+				"_id":         sentIn,
+				"circleName":  circle.Name,
+				"circleId":    bson.M{"$exists": false},
+				"kind":        bson.M{"$ne": models.KindNotification},
+				"senderId":    bson.M{"$in": session.Members},
+				"recepientId": bson.M{"$in": session.Members},
+			}
+			update := bson.M{"$set": bson.M{"circleId": circle.ID, "sessionId": session.ID}}
+			if _, err := messages.UpdateMany(ctx, filter, update); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// duplicateCircleName lists the circles sharing a name, oldest first.
+type duplicateCircleName struct {
+	Name string          `bson:"_id"`
+	IDs  []bson.ObjectID `bson:"ids"`
+}
+
+func findDuplicateCircleNames(ctx context.Context, coll *mongo.Collection) ([]duplicateCircleName, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$name"},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "count", Value: bson.D{{Key: "$gt", Value: 1}}}}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var duplicates []duplicateCircleName
+	if err := cursor.All(ctx, &duplicates); err != nil {
+		return nil, err
+	}
+	return duplicates, nil
+}
+
+// uniqueCircleNames renames all but the oldest of the circles sharing a name,
+// so the unique index on names can be built.
+func uniqueCircleNames(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection(circleCollectionName)
+
+	duplicates, err := findDuplicateCircleNames(ctx, coll)
+	if err != nil {
+		return err
+	}
+
+	renames, err := renameDuplicateCircles(duplicates, func(name string) (bool, error) {
+		err := coll.FindOne(ctx, bson.M{"name": name}).Err()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+	// A rename that was made before a failure is simply not picked again,
+	// as its circle no longer shares a name.
+	for _, rename := range renames {
+		if _, err := coll.UpdateOne(ctx, bson.M{"_id": rename.id}, bson.M{"$set": bson.M{"name": rename.to}}); err != nil {
+			return err
+		}
+		log.Printf("Renamed circle %s from %q to %q\n", rename.id.Hex(), rename.from, rename.to)
+	}
+
+	_, err = coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+		// Disabled invites have no code at all.
+		{Keys: bson.D{{Key: "inviteCode", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+		{Keys: bson.D{{Key: "members", Value: 1}}},
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		// A circle was created with a taken name after the renaming, e.g. by
+		// an instance still running the old version. The next start renames
+		// it, as this migration isn't recorded.
+		duplicates, findErr := findDuplicateCircleNames(ctx, coll)
+		if findErr != nil {
+			return errors.Join(err, findErr)
+		}
+		if len(duplicates) == 0 {
+			return err
+		}
+		return fmt.Errorf("circle names are still shared by %s; restart to rename them: %w", describeDuplicateCircleNames(duplicates), err)
+	}
+	return err
+}
+
+// circleRename is a new name for a circle that shared its name.
+type circleRename struct {
+	id       bson.ObjectID
+	from, to string
+}
+
+// renameDuplicateCircles picks new names for all but the oldest circle of
+// each name in duplicates, numbering them from 2 and skipping names that
+// are taken. Names stay letters, numbers and spaces, like the ones users
+// pick.
+func renameDuplicateCircles(duplicates []duplicateCircleName, taken func(name string) (bool, error)) ([]circleRename, error) {
+	var renames []circleRename
+	for _, duplicate := range duplicates {
+		suffix := 2
+		for _, id := range duplicate.IDs[1:] {
+			for {
+				name := fmt.Sprintf("%s %d", duplicate.Name, suffix)
+				suffix++
+				isTaken, err := taken(name)
+				if err != nil {
+					return nil, err
+				}
+				if !isTaken {
+					renames = append(renames, circleRename{id: id, from: duplicate.Name, to: name})
+					break
+				}
+			}
+		}
+	}
+	return renames, nil
+}
+
+// describeDuplicateCircleNames lists the names in duplicates and how many
+// circles share each, for telling operators what is in the way.
+func describeDuplicateCircleNames(duplicates []duplicateCircleName) string {
+	names := make([]string, 0, len(duplicates))
+	for _, duplicate := range duplicates {
+		names = append(names, fmt.Sprintf("%q (%d circles)", duplicate.Name, len(duplicate.IDs)))
+	}
+	return strings.Join(names, ", ")
+}
+
+func indexMatches(ctx context.Context, db *mongo.Database) error {
+	// Everyone has exactly one mortal and one angel per session.
+	_, err := db.Collection(matchCollectionName).Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "session_id", Value: 1}, {Key: "angel_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "session_id", Value: 1}, {Key: "mortal_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+	return err
+}
+
+func indexSessionsAndUsers(ctx context.Context, db *mongo.Database) error {
+	_, err := db.Collection(sessionCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "circleId", Value: 1}, {Key: "time", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The chat sweeper looks for chats that went quiet.
+	_, err = db.Collection(userCollectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "state", Value: 1}, {Key: "stateUpdatedAt", Value: 1}},
+	})
+	return err
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestRenameDuplicateCircles(t *testing.T) {
+	ids := make([]bson.ObjectID, 5)
+	for i := range ids {
+		ids[i] = bson.NewObjectID()
+	}
+	duplicates := []duplicateCircleName{
+		{Name: "Book Club", IDs: ids[:3]},
+		{Name: "Chess", IDs: ids[3:]},
+	}
+	existing := []string{"Book Club", "Book Club 2", "Chess"}
+	taken := func(name string) (bool, error) { return slices.Contains(existing, name), nil }
+
+	renames, err := renameDuplicateCircles(duplicates, taken)
+	if err != nil {
+		t.Fatalf("renameDuplicateCircles: %v", err)
+	}
+	// The oldest circle of each name keeps it.
+	want := []circleRename{
+		{id: ids[1], from: "Book Club", to: "Book Club 3"},
+		{id: ids[2], from: "Book Club", to: "Book Club 4"},
+		{id: ids[4], from: "Chess", to: "Chess 2"},
+	}
+	if !slices.Equal(renames, want) {
+		t.Errorf("renames = %+v, want %+v", renames, want)
+	}
+
+	failure := errors.New("connection reset")
+	if _, err := renameDuplicateCircles(duplicates, func(string) (bool, error) { return false, failure }); !errors.Is(err, failure) {
+		t.Errorf("renameDuplicateCircles with a failing lookup = %v, want %v", err, failure)
+	}
+}
+
+func TestDescribeDuplicateCircleNames(t *testing.T) {
+	duplicates := []duplicateCircleName{
+		{Name: "Book Club", IDs: []bson.ObjectID{bson.NewObjectID(), bson.NewObjectID()}},
+		{Name: "Chess", IDs: []bson.ObjectID{bson.NewObjectID(), bson.NewObjectID(), bson.NewObjectID()}},
+	}
+
+	want := `"Book Club" (2 circles), "Chess" (3 circles)`
+	if got := describeDuplicateCircleNames(duplicates); got != want {
+		t.Errorf("describeDuplicateCircleNames = %s, want %s", got, want)
+	}
+}
@@ -2,56 +2,64 @@ package db
 
 import (
 	"context"
+	"errors"
+	"grandfather/internal/config"
 	"log"
-	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
-var (
-	clientOnce sync.Once
-	client     *mongo.Client
-	clientErr  error
-)
+// MongoStore is the Store backed by a MongoDB database.
+type MongoStore struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
 
-func connect() {
-	uri := "mongodb://127.0.0.1:27017/?directConnection=true"
+var _ Store = (*MongoStore)(nil)
 
+func NewMongoStore(ctx context.Context, cfg config.MongoConfig) (*MongoStore, error) {
 	clientOpts := options.Client().
-		ApplyURI(uri).
+		ApplyURI(cfg.URI).
 		SetServerSelectionTimeout(5 * time.Second). // how long to wait for a suitable server
 		SetConnectTimeout(5 * time.Second)          // dial timeout
 
 	cli, err := mongo.Connect(clientOpts)
 	if err != nil {
-		clientErr = err
-		return
+		return nil, err
 	}
 
 	// Verify with a short-lived context
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	if err := cli.Ping(ctx, nil); err != nil {
-		clientErr = err
+	if err := cli.Ping(pingCtx, nil); err != nil {
 		_ = cli.Disconnect(context.Background())
-		return
+		return nil, err
 	}
 
 	log.Println("Connected to MongoDB")
-	client = cli
+	store := &MongoStore{client: cli, db: cli.Database(cfg.Database)}
+
+	if err := store.migrate(ctx); err != nil {
+		_ = cli.Disconnect(context.Background())
+		return nil, err
+	}
+	return store, nil
 }
 
-func GetMongoClient() (*mongo.Client, error) {
-	clientOnce.Do(connect)
-	return client, clientErr
+func (s *MongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
 }
 
-func GetCollection(collectionName string) (*mongo.Collection, error) {
-	cli, err := GetMongoClient()
-	if err != nil {
-		return nil, err
+func (s *MongoStore) collection(collectionName string) *mongo.Collection {
+	return s.db.Collection(collectionName)
+}
+
+// notFound maps the driver's ErrNoDocuments onto the store-level ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
 	}
-	return cli.Database("grandfather").Collection(collectionName), nil
+	return err
 }
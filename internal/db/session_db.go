@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"grandfather/internal/models"
+	"log"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -15,54 +16,57 @@ var (
 	sessionCollectionName = "sessions"
 )
 
-func CreateSession(ctx context.Context, circleId bson.ObjectID, members []int64) (*models.Session, error) {
-
-	sessionCollection, collErr := GetCollection(sessionCollectionName)
-	if collErr != nil {
-		return nil, collErr
+func (s *MongoStore) GetSession(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error) {
+	sessionCollection := s.collection(sessionCollectionName)
+	filter := bson.M{
+		"_id": sessionId,
 	}
 
-	newSession := &models.Session{
-		ID:        bson.NewObjectID(),
-		CircleId:  circleId,
-		Members:   members,
-		State:     models.StateActive,
-		CreatedAt: time.Now(),
+	var session models.Session
+	if err := sessionCollection.FindOne(ctx, filter).Decode(&session); err != nil {
+		return nil, notFound(err)
 	}
+	return &session, nil
+}
 
-	_, err := sessionCollection.InsertOne(ctx, newSession)
+func (s *MongoStore) GetCircleSessions(ctx context.Context, circleId bson.ObjectID) ([]*models.Session, error) {
+	sessionCollection := s.collection(sessionCollectionName)
+
+	var circle models.Circle
+	err := s.collection(circleCollectionName).FindOne(ctx, bson.M{"_id": circleId}).Decode(&circle)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	return newSession, nil
-}
 
-func GetSession(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error) {
-	sessionCollection, collErr := GetCollection(sessionCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
-	filter := bson.M{
-		"_id": sessionId,
+	// Without transactions a start that failed half way can leave a session
+	// behind that never became current; it must not count as a pairing.
+	counted := bson.A{bson.M{"state": models.StateFinished}}
+	if circle.CurrentSession != nil {
+		counted = append(counted, bson.M{"_id": *circle.CurrentSession})
 	}
+	filter := bson.M{"circleId": circleId, "$or": counted}
 
-	var session models.Session
-	err := sessionCollection.FindOne(ctx, filter).Decode(&session)
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}})
+	cur, err := sessionCollection.Find(ctx, filter, opts)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			return nil, nil
-		}
 		return nil, err
 	}
-	return &session, nil
-}
+	defer cur.Close(ctx)
 
-func UpdateSessionToFinished(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error) {
-	sessionCollection, collErr := GetCollection(sessionCollectionName)
-	if collErr != nil {
-		return nil, collErr
+	var sessions []*models.Session
+	if err := cur.All(ctx, &sessions); err != nil {
+		return nil, err
 	}
-	filter := bson.M{"_id": sessionId}
+	return sessions, nil
+}
+
+func (s *MongoStore) UpdateSessionToFinished(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error) {
+	sessionCollection := s.collection(sessionCollectionName)
+	// Only the call that ends the session finds it active.
+	filter := bson.M{"_id": sessionId, "state": models.StateActive}
 	update := bson.M{
 		"$set": bson.M{
 			"state": models.StateFinished,
@@ -74,26 +78,112 @@ func UpdateSessionToFinished(ctx context.Context, sessionId bson.ObjectID) (*mod
 	var updated models.Session
 	err := sessionCollection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updated)
 	if err != nil {
-		return nil, err
+		return nil, notFound(err)
 	}
 
 	return &updated, nil
 }
 
-func DeleteSessionByID(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error) {
-	coll, collErr := GetCollection(sessionCollectionName)
-	if collErr != nil {
-		return nil, collErr
+// codeIllegalOperation is returned when starting a transaction on a
+// standalone server, which can't run them.
+const codeIllegalOperation = 20
+
+// StartSession runs in a transaction where the server supports them. On a
+// standalone server the writes are made one by one, and the session is only
+// made current if the circle still has the current session it had when
+// checked, so concurrent starts can't both succeed either way. There the
+// notifications are queued last, so a crash can lose them but never
+// announce a session that didn't start.
+func (s *MongoStore) StartSession(ctx context.Context, circleId bson.ObjectID, members []int64, deadline *time.Time, matches []*models.Match, notifications []*models.Message) (*models.Session, error) {
+	newSession := &models.Session{
+		ID:        bson.NewObjectID(),
+		CircleId:  circleId,
+		Members:   members,
+		State:     models.StateActive,
+		CreatedAt: time.Now(),
+		Deadline:  deadline,
+	}
+	for _, m := range matches {
+		m.ID = bson.NewObjectID()
+		m.SessionId = newSession.ID
 	}
 
-	var deleted models.Session
-	err := coll.FindOneAndDelete(ctx, bson.M{"_id": sessionId}).Decode(&deleted)
+	dbSession, err := s.client.StartSession()
 	if err != nil {
-		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, nil // nothing found
+		return nil, err
+	}
+	defer dbSession.EndSession(ctx)
+
+	_, err = dbSession.WithTransaction(ctx, func(ctx context.Context) (any, error) {
+		return nil, s.startSession(ctx, newSession, matches, notifications)
+	})
+	// The transaction fails on its first read, before anything is written.
+	if hasErrorCode(err, codeIllegalOperation) {
+		err = s.startSession(ctx, newSession, matches, nil)
+		if err == nil {
+			// The session has started either way.
+			if notifyErr := s.CreateNotifications(ctx, notifications); notifyErr != nil {
+				log.Printf("Failed to queue the notifications of session %s: %v\n", newSession.ID.Hex(), notifyErr)
+			}
 		}
+	}
+	if err != nil {
 		return nil, err
 	}
+	return newSession, nil
+}
+
+// startSession writes newSession and its matches, makes it the circle's
+// current session and then queues notifications.
+func (s *MongoStore) startSession(ctx context.Context, newSession *models.Session, matches []*models.Match, notifications []*models.Message) error {
+	var circle models.Circle
+	if err := s.collection(circleCollectionName).FindOne(ctx, bson.M{"_id": newSession.CircleId}).Decode(&circle); err != nil {
+		return notFound(err)
+	}
+
+	// A circle may still point at a session that was ended, or whose start
+	// was cut short.
+	currentSession := bson.M{"$exists": false}
+	if circle.CurrentSession != nil {
+		var current models.Session
+		err := s.collection(sessionCollectionName).FindOne(ctx, bson.M{"_id": *circle.CurrentSession}).Decode(&current)
+		if err == nil && current.State == models.StateActive {
+			return ErrSessionActive
+		}
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+		currentSession = bson.M{"$eq": *circle.CurrentSession}
+	}
+
+	if _, err := s.collection(sessionCollectionName).InsertOne(ctx, newSession); err != nil {
+		return err
+	}
+	if len(matches) > 0 {
+		if _, err := s.collection(matchCollectionName).InsertMany(ctx, matches); err != nil {
+			s.discardSession(ctx, newSession.ID)
+			return err
+		}
+	}
+
+	filter := bson.M{"_id": newSession.CircleId, "currentSession": currentSession}
+	update := bson.M{"$set": bson.M{"currentSession": newSession.ID}}
+	result, err := s.collection(circleCollectionName).UpdateOne(ctx, filter, update)
+	if err != nil {
+		s.discardSession(ctx, newSession.ID)
+		return err
+	}
+	if result.MatchedCount == 0 {
+		// Another session was started since the check above.
+		s.discardSession(ctx, newSession.ID)
+		return ErrSessionActive
+	}
+	return s.CreateNotifications(ctx, notifications)
+}
 
-	return &deleted, nil
+// discardSession removes a session that never became current, and its
+// matches. Inside a transaction aborting does the same.
+func (s *MongoStore) discardSession(ctx context.Context, sessionId bson.ObjectID) {
+	_, _ = s.collection(matchCollectionName).DeleteMany(ctx, bson.M{"session_id": sessionId})
+	_, _ = s.collection(sessionCollectionName).DeleteOne(ctx, bson.M{"_id": sessionId})
 }
@@ -0,0 +1,258 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"grandfather/internal/config"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteStore is the Store backed by a single SQLite file, for deployments
+// too small to be worth running MongoDB for.
+type SQLiteStore struct {
+	db *sql.DB
+
+	mu       sync.Mutex
+	watchers []chan struct{}
+}
+
+var (
+	_ Store          = (*SQLiteStore)(nil)
+	_ MessageWatcher = (*SQLiteStore)(nil)
+)
+
+func NewSQLiteStore(ctx context.Context, cfg config.SQLiteConfig) (*SQLiteStore, error) {
+	// Transactions take the write lock as they begin, so two of them can't
+	// both read and then fail to write. Other processes using the file are
+	// waited for rather than failed.
+	query := url.Values{}
+	query.Set("_txlock", "immediate")
+	query.Add("_pragma", "busy_timeout(5000)")
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "foreign_keys(1)")
+
+	db, err := sql.Open("sqlite", "file:"+cfg.Path+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	// SQLite writes one at a time anyway; a single connection keeps the
+	// store's transactions from waiting on each other's locks.
+	db.SetMaxOpenConns(1)
+
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	log.Printf("Opened SQLite database %s\n", cfg.Path)
+	store := &SQLiteStore{db: db}
+
+	if err := store.migrate(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *SQLiteStore) Close(ctx context.Context) error {
+	return s.db.Close()
+}
+
+// inTx runs fn in a transaction, which is committed if fn succeeds.
+func (s *SQLiteStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqlNotFound maps sql.ErrNoRows onto the store-level ErrNotFound.
+func sqlNotFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// isConstraintError reports whether err is a violated unique constraint.
+func isConstraintError(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// placeholders returns n comma separated query parameters, for IN lists.
+func placeholders(n int) string {
+	return strings.Repeat(", ?", n)[2:]
+}
+
+// anys converts values to query arguments.
+func anys[T any](values []T) []any {
+	args := make([]any, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
+
+// scanner is a *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// The types below convert model fields to and from SQLite columns.
+
+// objectID is stored as its hex string, which sorts like the ID itself, so
+// ordering by it orders by creation. The zero ID is stored as NULL.
+type objectID struct {
+	id *bson.ObjectID
+}
+
+func (o objectID) Value() (driver.Value, error) {
+	if o.id == nil || o.id.IsZero() {
+		return nil, nil
+	}
+	return o.id.Hex(), nil
+}
+
+func (o objectID) Scan(src any) error {
+	var hex string
+	switch v := src.(type) {
+	case nil:
+		*o.id = bson.ObjectID{}
+		return nil
+	case string:
+		hex = v
+	case []byte:
+		hex = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into an ObjectID", src)
+	}
+	id, err := bson.ObjectIDFromHex(hex)
+	if err != nil {
+		return err
+	}
+	*o.id = id
+	return nil
+}
+
+// unixTime stores a time as Unix nanoseconds. The zero time is stored as 0,
+// so it sorts before every other time.
+type unixTime struct {
+	t *time.Time
+}
+
+func (u unixTime) Value() (driver.Value, error) {
+	if u.t == nil || u.t.IsZero() {
+		return int64(0), nil
+	}
+	return u.t.UnixNano(), nil
+}
+
+func (u unixTime) Scan(src any) error {
+	n, ok := src.(int64)
+	if !ok && src != nil {
+		return fmt.Errorf("cannot scan %T into a time", src)
+	}
+	if n == 0 {
+		*u.t = time.Time{}
+		return nil
+	}
+	*u.t = time.Unix(0, n)
+	return nil
+}
+
+// jsonValue stores slices and documents as JSON text.
+type jsonValue struct {
+	v any
+}
+
+func (j jsonValue) Value() (driver.Value, error) {
+	b, err := json.Marshal(j.v)
+	return string(b), err
+}
+
+func (j jsonValue) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), j.v)
+	case []byte:
+		return json.Unmarshal(v, j.v)
+	}
+	return fmt.Errorf("cannot scan %T as JSON", src)
+}
+
+var (
+	_ driver.Valuer = objectID{}
+	_ driver.Valuer = unixTime{}
+	_ driver.Valuer = jsonValue{}
+	_ sql.Scanner   = objectID{}
+	_ sql.Scanner   = unixTime{}
+	_ sql.Scanner   = jsonValue{}
+)
+
+func idValue(id bson.ObjectID) objectID {
+	return objectID{&id}
+}
+
+func timeValue(t time.Time) unixTime {
+	return unixTime{&t}
+}
+
+// WatchMessages tells the outbox about messages this process queues. Other
+// processes sharing the file are picked up by polling.
+func (s *SQLiteStore) WatchMessages(ctx context.Context, notify func()) error {
+	queued := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	s.watchers = append(s.watchers, queued)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.watchers = slices.DeleteFunc(s.watchers, func(w chan struct{}) bool { return w == queued })
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-queued:
+			notify()
+		}
+	}
+}
+
+// messagesQueued wakes up every watcher.
+func (s *SQLiteStore) messagesQueued() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range s.watchers {
+		// A pending wake-up already covers this message.
+		select {
+		case w <- struct{}{}:
+		default:
+		}
+	}
+}
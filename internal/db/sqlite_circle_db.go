@@ -0,0 +1,265 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"grandfather/internal/models"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const circleColumns = `id, name, owner_id, members, current_session, invite_code, exclusions, admins, pending_owner_id`
+
+func scanCircle(row scanner) (*models.Circle, error) {
+	var circle models.Circle
+	var currentSession bson.ObjectID
+	var inviteCode sql.NullString
+	err := row.Scan(
+		objectID{&circle.ID},
+		&circle.Name,
+		&circle.OwnerId,
+		jsonValue{&circle.Members},
+		objectID{&currentSession},
+		&inviteCode,
+		jsonValue{&circle.Exclusions},
+		jsonValue{&circle.Admins},
+		&circle.PendingOwnerId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if !currentSession.IsZero() {
+		circle.CurrentSession = &currentSession
+	}
+	circle.InviteCode = inviteCode.String
+	return &circle, nil
+}
+
+// inviteCodeValue stores a disabled invite as NULL, so it doesn't clash
+// with other disabled invites.
+func inviteCodeValue(inviteCode string) sql.NullString {
+	return sql.NullString{String: inviteCode, Valid: inviteCode != ""}
+}
+
+func (s *SQLiteStore) CreateCircle(ctx context.Context, circleName string, circleOwner int64) (*models.Circle, error) {
+	circle := &models.Circle{
+		ID:         bson.NewObjectID(),
+		Name:       circleName,
+		OwnerId:    circleOwner,
+		Members:    []int64{circleOwner},
+		InviteCode: NewInviteCode(),
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO circles (id, name, owner_id, members, invite_code, exclusions) VALUES (?, ?, ?, ?, ?, '[]')`,
+		idValue(circle.ID), circle.Name, circle.OwnerId, jsonValue{circle.Members}, inviteCodeValue(circle.InviteCode),
+	)
+	if isConstraintError(err) {
+		return nil, ErrDuplicate
+	}
+	if err != nil {
+		return nil, err
+	}
+	return circle, nil
+}
+
+func (s *SQLiteStore) GetCircle(ctx context.Context, circleName string) (*models.Circle, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+circleColumns+` FROM circles WHERE name = ?`, circleName)
+	circle, err := scanCircle(row)
+	if err != nil {
+		return nil, sqlNotFound(err)
+	}
+	return circle, nil
+}
+
+func (s *SQLiteStore) GetCircleByID(ctx context.Context, circleId bson.ObjectID) (*models.Circle, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+circleColumns+` FROM circles WHERE id = ?`, idValue(circleId))
+	circle, err := scanCircle(row)
+	if err != nil {
+		return nil, sqlNotFound(err)
+	}
+	return circle, nil
+}
+
+func (s *SQLiteStore) GetCircles(ctx context.Context, userId int64) ([]models.Circle, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+circleColumns+` FROM circles
+		WHERE EXISTS (SELECT 1 FROM json_each(circles.members) WHERE value = ?)
+		ORDER BY id`,
+		userId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var circles []models.Circle
+	for rows.Next() {
+		circle, err := scanCircle(rows)
+		if err != nil {
+			return nil, err
+		}
+		circles = append(circles, *circle)
+	}
+	return circles, rows.Err()
+}
+
+// updateCircle applies update to a circle and saves its members, admins,
+// owner and exclusions, all in one transaction. The update can refuse the
+// change by returning an error.
+func (s *SQLiteStore) updateCircle(ctx context.Context, circleId bson.ObjectID, update func(circle *models.Circle) error) (*models.Circle, error) {
+	var circle *models.Circle
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		circle, err = scanCircle(tx.QueryRowContext(ctx, `SELECT `+circleColumns+` FROM circles WHERE id = ?`, idValue(circleId)))
+		if err != nil {
+			return sqlNotFound(err)
+		}
+
+		if err := update(circle); err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`UPDATE circles SET members = ?, admins = ?, owner_id = ?, pending_owner_id = ?, exclusions = ? WHERE id = ?`,
+			jsonValue{circle.Members}, jsonValue{circle.Admins}, circle.OwnerId, circle.PendingOwnerId, jsonValue{circle.Exclusions}, idValue(circleId))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return circle, nil
+}
+
+func (s *SQLiteStore) AddUserToCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircle(ctx, circleId, func(circle *models.Circle) error {
+		if !slices.Contains(circle.Members, userId) {
+			circle.Members = append(circle.Members, userId)
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) RemoveUserFromCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircle(ctx, circleId, func(circle *models.Circle) error {
+		circle.Members = slices.DeleteFunc(circle.Members, func(id int64) bool { return id == userId })
+		circle.Admins = slices.DeleteFunc(circle.Admins, func(id int64) bool { return id == userId })
+		circle.Exclusions = slices.DeleteFunc(circle.Exclusions, func(e models.Exclusion) bool {
+			return e.AngelId == userId || e.MortalId == userId
+		})
+		if circle.PendingOwnerId == userId {
+			circle.PendingOwnerId = 0
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) UnsetCircleCurrentSession(ctx context.Context, circleId, sessionId bson.ObjectID) (bool, error) {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE circles SET current_session = NULL WHERE id = ? AND current_session = ?`,
+		idValue(circleId), idValue(sessionId),
+	)
+	if err != nil {
+		return false, err
+	}
+	unset, err := result.RowsAffected()
+	return unset == 1, err
+}
+
+func (s *SQLiteStore) GetCircleByInviteCode(ctx context.Context, inviteCode string) (*models.Circle, error) {
+	if inviteCode == "" {
+		return nil, ErrNotFound
+	}
+
+	row := s.db.QueryRowContext(ctx, `SELECT `+circleColumns+` FROM circles WHERE invite_code = ?`, inviteCode)
+	circle, err := scanCircle(row)
+	if err != nil {
+		return nil, sqlNotFound(err)
+	}
+	return circle, nil
+}
+
+func (s *SQLiteStore) SetCircleInviteCode(ctx context.Context, circleId bson.ObjectID, inviteCode string) (*models.Circle, error) {
+	row := s.db.QueryRowContext(ctx,
+		`UPDATE circles SET invite_code = ? WHERE id = ? RETURNING `+circleColumns,
+		inviteCodeValue(inviteCode), idValue(circleId),
+	)
+	circle, err := scanCircle(row)
+	if err != nil {
+		return nil, sqlNotFound(err)
+	}
+	return circle, nil
+}
+
+func (s *SQLiteStore) AddCircleExclusions(ctx context.Context, circleId bson.ObjectID, exclusions []models.Exclusion) (*models.Circle, error) {
+	return s.updateCircle(ctx, circleId, func(circle *models.Circle) error {
+		for _, e := range exclusions {
+			if !slices.Contains(circle.Exclusions, e) {
+				circle.Exclusions = append(circle.Exclusions, e)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) RemoveCircleExclusion(ctx context.Context, circleId bson.ObjectID, exclusion models.Exclusion) (*models.Circle, error) {
+	return s.updateCircle(ctx, circleId, func(circle *models.Circle) error {
+		circle.Exclusions = slices.DeleteFunc(circle.Exclusions, func(e models.Exclusion) bool { return e == exclusion })
+		return nil
+	})
+}
+
+func (s *SQLiteStore) AddCircleAdmin(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircle(ctx, circleId, func(circle *models.Circle) error {
+		if circle.OwnerId == userId || !slices.Contains(circle.Members, userId) {
+			return ErrNotFound
+		}
+		if !slices.Contains(circle.Admins, userId) {
+			circle.Admins = append(circle.Admins, userId)
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteStore) RemoveCircleAdmin(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircle(ctx, circleId, func(circle *models.Circle) error {
+		circle.Admins = slices.DeleteFunc(circle.Admins, func(id int64) bool { return id == userId })
+		return nil
+	})
+}
+
+func (s *SQLiteStore) OfferCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircle(ctx, circleId, func(circle *models.Circle) error {
+		if circle.OwnerId == userId || !slices.Contains(circle.Members, userId) {
+			return ErrNotFound
+		}
+		circle.PendingOwnerId = userId
+		return nil
+	})
+}
+
+func (s *SQLiteStore) AcceptCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircle(ctx, circleId, func(circle *models.Circle) error {
+		if userId == 0 || circle.PendingOwnerId != userId || !slices.Contains(circle.Members, userId) {
+			return ErrNotFound
+		}
+		circle.Admins = slices.DeleteFunc(circle.Admins, func(id int64) bool { return id == userId })
+		if !slices.Contains(circle.Admins, circle.OwnerId) {
+			circle.Admins = append(circle.Admins, circle.OwnerId)
+		}
+		circle.OwnerId = userId
+		circle.PendingOwnerId = 0
+		return nil
+	})
+}
+
+func (s *SQLiteStore) DeclineCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error) {
+	return s.updateCircle(ctx, circleId, func(circle *models.Circle) error {
+		if userId == 0 || circle.PendingOwnerId != userId {
+			return ErrNotFound
+		}
+		circle.PendingOwnerId = 0
+		return nil
+	})
+}
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"grandfather/internal/models"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// execer is a *sql.DB or *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// messageValues are the columns of a message, in the order of the messages
+// table. The message is stored whole as JSON, so every field round-trips
+// without the store listing them; the other columns copy the fields messages
+// are looked up by.
+func messageValues(m *models.Message) []any {
+	var sourceMessageId sql.NullInt64
+	if m.Payload != nil && m.Payload.SourceMessageID != 0 {
+		sourceMessageId = sql.NullInt64{Int64: int64(m.Payload.SourceMessageID), Valid: true}
+	}
+	return []any{
+		idValue(m.ID),
+		m.Kind,
+		m.MessageState,
+		m.SenderId,
+		m.RecepientId,
+		idValue(m.CircleId),
+		sourceMessageId,
+		timeValue(m.NextAttemptAt),
+		m.LeaseOwner,
+		timeValue(m.LeaseExpiresAt),
+		jsonValue{m},
+	}
+}
+
+func insertMessage(ctx context.Context, db execer, m *models.Message) error {
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO messages (id, kind, state, sender_id, recipient_id, circle_id, source_message_id, next_attempt_at, lease_owner, lease_expires_at, document)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		messageValues(m)...,
+	)
+	return err
+}
+
+func saveMessage(ctx context.Context, db execer, m *models.Message) error {
+	_, err := db.ExecContext(ctx,
+		`UPDATE messages SET (id, kind, state, sender_id, recipient_id, circle_id, source_message_id, next_attempt_at, lease_owner, lease_expires_at, document)
+		= (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) WHERE id = ?`,
+		append(messageValues(m), idValue(m.ID))...,
+	)
+	return err
+}
+
+// findMessages returns the messages matching the where clause and whatever
+// follows it, such as an ORDER BY.
+func (s *SQLiteStore) findMessages(ctx context.Context, where string, args ...any) ([]*models.Message, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT document FROM messages WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []*models.Message
+	for rows.Next() {
+		var message models.Message
+		if err := rows.Scan(jsonValue{&message}); err != nil {
+			return nil, err
+		}
+		messages = append(messages, &message)
+	}
+	return messages, rows.Err()
+}
+
+// findMessage returns the first message matching the where clause, or
+// ErrNotFound.
+func (s *SQLiteStore) findMessage(ctx context.Context, where string, args ...any) (*models.Message, error) {
+	var message models.Message
+	if err := s.db.QueryRowContext(ctx, `SELECT document FROM messages WHERE `+where+` LIMIT 1`, args...).Scan(jsonValue{&message}); err != nil {
+		return nil, sqlNotFound(err)
+	}
+	return &message, nil
+}
+
+// updateMessage applies update to the first message matching the where
+// clause and saves it, in one transaction. It returns ErrNotFound if no
+// message matches, and the update can refuse the change by returning an
+// error.
+func (s *SQLiteStore) updateMessage(ctx context.Context, update func(m *models.Message) error, where string, args ...any) (*models.Message, error) {
+	var message models.Message
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, `SELECT document FROM messages WHERE `+where+` LIMIT 1`, args...).Scan(jsonValue{&message}); err != nil {
+			return sqlNotFound(err)
+		}
+		if err := update(&message); err != nil {
+			return err
+		}
+		return saveMessage(ctx, tx, &message)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (s *SQLiteStore) CreateMessage(ctx context.Context, message *models.Message) (*models.Message, error) {
+	message.ID = bson.NewObjectID()
+	message.Kind = models.KindRelay
+	message.MessageState = models.NotDelivered
+	if message.Payload != nil {
+		message.Message = message.Payload.Summary()
+	}
+
+	if err := insertMessage(ctx, s.db, message); err != nil {
+		return nil, err
+	}
+	s.messagesQueued()
+	return message, nil
+}
+
+func (s *SQLiteStore) CreateNotifications(ctx context.Context, notifications []*models.Message) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		return insertNotifications(ctx, tx, notifications)
+	})
+	if err != nil {
+		return err
+	}
+	s.messagesQueued()
+	return nil
+}
+
+func insertNotifications(ctx context.Context, tx *sql.Tx, notifications []*models.Message) error {
+	for _, n := range notifications {
+		n.ID = bson.NewObjectID()
+		n.Kind = models.KindNotification
+		n.MessageState = models.NotDelivered
+		if err := insertMessage(ctx, tx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStore) GetUndeliveredMessages(ctx context.Context) ([]*models.Message, error) {
+	messages, err := s.findMessages(ctx, `state IN (?, ?) ORDER BY id`, models.NotDelivered, models.Sending)
+	if err != nil {
+		return nil, err
+	}
+	if messages == nil {
+		messages = []*models.Message{}
+	}
+	return messages, nil
+}
+
+func (s *SQLiteStore) ClaimMessage(ctx context.Context, leaseOwner string, leaseFor time.Duration) (*models.Message, error) {
+	now := time.Now()
+	return s.updateMessage(ctx,
+		func(m *models.Message) error {
+			m.MessageState = models.Sending
+			m.LeaseOwner = leaseOwner
+			m.LeaseExpiresAt = now.Add(leaseFor)
+			return nil
+		},
+		// An expired lease belongs to an instance that died mid-delivery.
+		`(state = ? AND next_attempt_at <= ?) OR (state = ? AND lease_expires_at <= ?) ORDER BY id`,
+		models.NotDelivered, timeValue(now), models.Sending, timeValue(now),
+	)
+}
+
+// releaseLease applies update to a message leaseOwner is sending and ends
+// the lease. It returns ErrNotFound when the lease was lost.
+func (s *SQLiteStore) releaseLease(ctx context.Context, messageId bson.ObjectID, leaseOwner string, update func(m *models.Message)) error {
+	_, err := s.updateMessage(ctx,
+		func(m *models.Message) error {
+			update(m)
+			m.LeaseOwner = ""
+			m.LeaseExpiresAt = time.Time{}
+			return nil
+		},
+		`id = ? AND state = ? AND lease_owner = ?`,
+		idValue(messageId), models.Sending, leaseOwner,
+	)
+	return err
+}
+
+func (s *SQLiteStore) UpdateMessageToDelivered(ctx context.Context, messageId bson.ObjectID, leaseOwner string, deliveredMessageIds []int) error {
+	return s.releaseLease(ctx, messageId, leaseOwner, func(m *models.Message) {
+		m.MessageState = models.Delivered
+		m.DeliveredMessageIds = slices.Clone(deliveredMessageIds)
+	})
+}
+
+func (s *SQLiteStore) ScheduleMessageRetry(ctx context.Context, messageId bson.ObjectID, leaseOwner string, attempts int, nextAttemptAt time.Time, lastError string) error {
+	return s.releaseLease(ctx, messageId, leaseOwner, func(m *models.Message) {
+		m.MessageState = models.NotDelivered
+		m.Attempts = attempts
+		m.NextAttemptAt = nextAttemptAt
+		m.LastError = lastError
+	})
+}
+
+func (s *SQLiteStore) UpdateMessageToFailed(ctx context.Context, messageId bson.ObjectID, leaseOwner string, attempts int, lastError string) error {
+	return s.releaseLease(ctx, messageId, leaseOwner, func(m *models.Message) {
+		m.MessageState = models.Failed
+		m.Attempts = attempts
+		m.LastError = lastError
+	})
+}
+
+func (s *SQLiteStore) RecordMessageHeader(ctx context.Context, messageId bson.ObjectID, leaseOwner string, headerMessageId int) error {
+	_, err := s.updateMessage(ctx,
+		func(m *models.Message) error {
+			m.DeliveredMessageIds = []int{headerMessageId}
+			return nil
+		},
+		`id = ? AND state = ? AND lease_owner = ?`,
+		idValue(messageId), models.Sending, leaseOwner,
+	)
+	return err
+}
+
+func (s *SQLiteStore) ExtendMessageLease(ctx context.Context, messageId bson.ObjectID, leaseOwner string, leaseFor time.Duration) error {
+	_, err := s.updateMessage(ctx,
+		func(m *models.Message) error {
+			m.LeaseExpiresAt = time.Now().Add(leaseFor)
+			return nil
+		},
+		`id = ? AND state = ? AND lease_owner = ?`,
+		idValue(messageId), models.Sending, leaseOwner,
+	)
+	return err
+}
+
+func (s *SQLiteStore) GetMessageByDeliveredId(ctx context.Context, recipientId int64, deliveredMessageId int) (*models.Message, error) {
+	return s.findMessage(ctx,
+		`recipient_id = ? AND EXISTS (SELECT 1 FROM json_each(messages.document, '$.deliveredMessageIds') WHERE value = ?)`,
+		recipientId, deliveredMessageId,
+	)
+}
+
+func (s *SQLiteStore) GetMessage(ctx context.Context, messageId bson.ObjectID) (*models.Message, error) {
+	return s.findMessage(ctx, `id = ?`, idValue(messageId))
+}
+
+func (s *SQLiteStore) GetMessageBySource(ctx context.Context, senderId int64, sourceMessageId int) (*models.Message, error) {
+	return s.findMessage(ctx, `sender_id = ? AND source_message_id = ?`, senderId, sourceMessageId)
+}
+
+func (s *SQLiteStore) UpdateMessagePayload(ctx context.Context, messageId bson.ObjectID, payload models.Payload) (*models.Message, error) {
+	return s.updateMessage(ctx,
+		func(m *models.Message) error {
+			m.Payload = &payload
+			m.Message = payload.Summary()
+			return nil
+		},
+		`id = ?`, idValue(messageId),
+	)
+}
+
+func (s *SQLiteStore) UpdateMessageToUnsent(ctx context.Context, messageId bson.ObjectID) (*models.Message, error) {
+	return s.updateMessage(ctx,
+		func(m *models.Message) error {
+			m.MessageState = models.Unsent
+			return nil
+		},
+		`id = ?`, idValue(messageId),
+	)
+}
+
+func (s *SQLiteStore) SetMessageConfirmation(ctx context.Context, messageId bson.ObjectID, confirmation models.Confirmation) (*models.Message, error) {
+	return s.updateMessage(ctx,
+		func(m *models.Message) error {
+			m.Confirmation = &confirmation
+			return nil
+		},
+		`id = ?`, idValue(messageId),
+	)
+}
+
+func (s *SQLiteStore) MarkMessageSeen(ctx context.Context, messageId bson.ObjectID) (*models.Message, error) {
+	return s.updateMessage(ctx,
+		func(m *models.Message) error {
+			if !m.SeenAt.IsZero() {
+				return ErrNotFound
+			}
+			m.SeenAt = time.Now()
+			return nil
+		},
+		`id = ? AND state = ?`, idValue(messageId), models.Delivered,
+	)
+}
+
+func (s *SQLiteStore) GetMessageHistory(ctx context.Context, circleId bson.ObjectID, userId int64, skip, limit int) ([]*models.Message, error) {
+	return s.findMessages(ctx,
+		`circle_id = ? AND kind != ? AND state != ? AND (sender_id = ? OR recipient_id = ?)
+		ORDER BY id DESC LIMIT ? OFFSET ?`,
+		idValue(circleId), models.KindNotification, models.Unsent, userId, userId, limit, skip,
+	)
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// sqliteMigration changes the SQLite schema from one version to the next.
+// Each runs in a transaction together with its record, so it either applies
+// completely or not at all.
+type sqliteMigration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, tx *sql.Tx) error
+}
+
+// sqliteMigrations are applied in order. Applied versions are recorded in
+// the database, so never change or renumber a migration that was released;
+// add a new one instead.
+var sqliteMigrations = []sqliteMigration{
+	{1, "create the schema", createSQLiteSchema},
+	{2, "add circle admins and ownership offers", addSQLiteCircleAdmins},
+}
+
+// migrate applies the migrations this database hasn't had yet. Every
+// transaction holds the write lock, so processes starting at the same time
+// take turns and each migration runs once.
+func (s *SQLiteStore) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS migrations (
+		version     INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at  INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("create migrations table: %w", err)
+	}
+
+	for _, m := range sqliteMigrations {
+		err := s.inTx(ctx, func(tx *sql.Tx) error {
+			var applied bool
+			if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM migrations WHERE version = ?)`, m.version).Scan(&applied); err != nil {
+				return err
+			}
+			if applied {
+				return nil
+			}
+
+			log.Printf("Applying migration %d: %s\n", m.version, m.description)
+			if err := m.up(ctx, tx); err != nil {
+				return err
+			}
+
+			_, err := tx.ExecContext(ctx, `INSERT INTO migrations (version, description, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.description, timeValue(time.Now()))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+func createSQLiteSchema(ctx context.Context, tx *sql.Tx) error {
+	// Members, exclusions and the parts of messages that are never queried
+	// are stored as JSON. IDs are hex ObjectIDs and times Unix nanoseconds.
+	_, err := tx.ExecContext(ctx, `
+		CREATE TABLE users (
+			id               INTEGER PRIMARY KEY,
+			chat_id          INTEGER NOT NULL,
+			first_name       TEXT NOT NULL DEFAULT '',
+			last_name        TEXT NOT NULL DEFAULT '',
+			user_handle      TEXT NOT NULL DEFAULT '',
+			state            TEXT NOT NULL DEFAULT '',
+			state_circle_id  TEXT,
+			state_updated_at INTEGER NOT NULL DEFAULT 0
+		);
+		-- The chat sweeper looks for chats that went quiet.
+		CREATE INDEX users_state ON users (state, state_updated_at);
+
+		CREATE TABLE circles (
+			id              TEXT PRIMARY KEY,
+			name            TEXT NOT NULL UNIQUE,
+			owner_id        INTEGER NOT NULL,
+			members         TEXT NOT NULL DEFAULT '[]',
+			current_session TEXT,
+			-- Disabled invites have no code at all.
+			invite_code     TEXT UNIQUE,
+			exclusions      TEXT NOT NULL DEFAULT '[]'
+		);
+
+		CREATE TABLE sessions (
+			id         TEXT PRIMARY KEY,
+			circle_id  TEXT NOT NULL REFERENCES circles (id),
+			members    TEXT NOT NULL DEFAULT '[]',
+			state      TEXT NOT NULL,
+			created_at INTEGER NOT NULL,
+			deadline   INTEGER
+		);
+		CREATE INDEX sessions_circle ON sessions (circle_id, created_at);
+
+		-- Everyone has exactly one mortal and one angel per session.
+		CREATE TABLE matches (
+			id         TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL REFERENCES sessions (id),
+			angel_id   INTEGER NOT NULL,
+			mortal_id  INTEGER NOT NULL,
+			UNIQUE (session_id, angel_id),
+			UNIQUE (session_id, mortal_id)
+		);
+
+		-- document holds the whole message; the other columns copy the fields
+		-- messages are looked up by.
+		CREATE TABLE messages (
+			id                TEXT PRIMARY KEY,
+			kind              TEXT NOT NULL,
+			state             TEXT NOT NULL,
+			sender_id         INTEGER NOT NULL,
+			recipient_id      INTEGER NOT NULL,
+			circle_id         TEXT,
+			source_message_id INTEGER,
+			next_attempt_at   INTEGER NOT NULL DEFAULT 0,
+			lease_owner       TEXT NOT NULL DEFAULT '',
+			lease_expires_at  INTEGER NOT NULL DEFAULT 0,
+			document          TEXT NOT NULL
+		);
+		-- The outbox claims undelivered messages that are due and messages
+		-- whose lease expired.
+		CREATE INDEX messages_due ON messages (state, next_attempt_at);
+		CREATE INDEX messages_lease ON messages (state, lease_expires_at);
+		-- Message history pages through a circle's relays, newest first.
+		CREATE INDEX messages_circle ON messages (circle_id, id);
+		CREATE INDEX messages_source ON messages (sender_id, source_message_id);
+		CREATE INDEX messages_recipient ON messages (recipient_id);
+	`)
+	return err
+}
+
+func addSQLiteCircleAdmins(ctx context.Context, tx *sql.Tx) error {
+	// No one is offered a circle while pending_owner_id is 0.
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE circles ADD COLUMN admins TEXT NOT NULL DEFAULT '[]';
+		ALTER TABLE circles ADD COLUMN pending_owner_id INTEGER NOT NULL DEFAULT 0;
+	`)
+	return err
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"grandfather/internal/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const sessionColumns = `id, circle_id, members, state, created_at, deadline`
+
+func scanSession(row scanner) (*models.Session, error) {
+	var session models.Session
+	var deadline sql.NullInt64
+	err := row.Scan(
+		objectID{&session.ID},
+		objectID{&session.CircleId},
+		jsonValue{&session.Members},
+		&session.State,
+		unixTime{&session.CreatedAt},
+		&deadline,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if deadline.Valid {
+		t := time.Unix(0, deadline.Int64)
+		session.Deadline = &t
+	}
+	return &session, nil
+}
+
+// StartSession checks and updates the circle in one transaction, which
+// holds the database's write lock, so concurrent starts can't both succeed.
+// The notifications are queued in the same transaction.
+func (s *SQLiteStore) StartSession(ctx context.Context, circleId bson.ObjectID, members []int64, deadline *time.Time, matches []*models.Match, notifications []*models.Message) (*models.Session, error) {
+	session := &models.Session{
+		ID:        bson.NewObjectID(),
+		CircleId:  circleId,
+		Members:   members,
+		State:     models.StateActive,
+		CreatedAt: time.Now(),
+		Deadline:  deadline,
+	}
+
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var currentState sql.NullString
+		err := tx.QueryRowContext(ctx,
+			`SELECT sessions.state FROM circles LEFT JOIN sessions ON sessions.id = circles.current_session WHERE circles.id = ?`,
+			idValue(circleId),
+		).Scan(&currentState)
+		if err != nil {
+			return sqlNotFound(err)
+		}
+		if currentState.String == string(models.StateActive) {
+			return ErrSessionActive
+		}
+
+		var deadlineValue sql.NullInt64
+		if deadline != nil {
+			deadlineValue = sql.NullInt64{Int64: deadline.UnixNano(), Valid: true}
+		}
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO sessions (id, circle_id, members, state, created_at, deadline) VALUES (?, ?, ?, ?, ?, ?)`,
+			idValue(session.ID), idValue(circleId), jsonValue{members}, session.State, timeValue(session.CreatedAt), deadlineValue,
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range matches {
+			m.ID = bson.NewObjectID()
+			m.SessionId = session.ID
+			_, err := tx.ExecContext(ctx,
+				`INSERT INTO matches (id, session_id, angel_id, mortal_id) VALUES (?, ?, ?, ?)`,
+				idValue(m.ID), idValue(m.SessionId), m.AngelId, m.MortalId,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `UPDATE circles SET current_session = ? WHERE id = ?`, idValue(session.ID), idValue(circleId))
+		if err != nil {
+			return err
+		}
+		return insertNotifications(ctx, tx, notifications)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(notifications) > 0 {
+		s.messagesQueued()
+	}
+	return session, nil
+}
+
+func (s *SQLiteStore) GetSession(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, idValue(sessionId))
+	session, err := scanSession(row)
+	if err != nil {
+		return nil, sqlNotFound(err)
+	}
+	return session, nil
+}
+
+func (s *SQLiteStore) GetCircleSessions(ctx context.Context, circleId bson.ObjectID) ([]*models.Session, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+sessionColumns+` FROM sessions
+		WHERE circle_id = ? AND (state = ? OR id = (SELECT current_session FROM circles WHERE id = ?))
+		ORDER BY created_at DESC, id DESC`,
+		idValue(circleId), models.StateFinished, idValue(circleId),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*models.Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *SQLiteStore) UpdateSessionToFinished(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error) {
+	row := s.db.QueryRowContext(ctx,
+		`UPDATE sessions SET state = ? WHERE id = ? AND state = ? RETURNING `+sessionColumns,
+		models.StateFinished, idValue(sessionId), models.StateActive,
+	)
+	session, err := scanSession(row)
+	if err != nil {
+		return nil, sqlNotFound(err)
+	}
+	return session, nil
+}
+
+// Matches
+
+const matchColumns = `id, session_id, angel_id, mortal_id`
+
+func scanMatch(row scanner) (*models.Match, error) {
+	var match models.Match
+	err := row.Scan(objectID{&match.ID}, objectID{&match.SessionId}, &match.AngelId, &match.MortalId)
+	if err != nil {
+		return nil, err
+	}
+	return &match, nil
+}
+
+func (s *SQLiteStore) GetMortalMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+matchColumns+` FROM matches WHERE session_id = ? AND angel_id = ?`, idValue(sessionId), userId)
+	match, err := scanMatch(row)
+	if err != nil {
+		return nil, sqlNotFound(err)
+	}
+	return match, nil
+}
+
+func (s *SQLiteStore) GetAngelMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+matchColumns+` FROM matches WHERE session_id = ? AND mortal_id = ?`, idValue(sessionId), userId)
+	match, err := scanMatch(row)
+	if err != nil {
+		return nil, sqlNotFound(err)
+	}
+	return match, nil
+}
+
+func (s *SQLiteStore) GetMatches(ctx context.Context, sessionId bson.ObjectID) ([]*models.Match, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+matchColumns+` FROM matches WHERE session_id = ? ORDER BY id`, idValue(sessionId))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []*models.Match
+	for rows.Next() {
+		match, err := scanMatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
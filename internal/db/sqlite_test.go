@@ -0,0 +1,509 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"grandfather/internal/config"
+	"grandfather/internal/db"
+	"grandfather/internal/models"
+
+	tlgModels "github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func newSQLiteStore(t *testing.T, path string) *db.SQLiteStore {
+	t.Helper()
+
+	store, err := db.NewSQLiteStore(context.Background(), config.SQLiteConfig{Path: path})
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close(context.Background()) })
+	return store
+}
+
+// forEachStore runs test against the SQLite store and, for comparison, the
+// memory store it has to behave like.
+func forEachStore(t *testing.T, test func(t *testing.T, store db.Store)) {
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, newSQLiteStore(t, filepath.Join(t.TempDir(), "grandfather.db")))
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, db.NewMemoryStore())
+	})
+}
+
+func TestSQLiteMigrationsRunOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grandfather.db")
+	ctx := context.Background()
+
+	first := newSQLiteStore(t, path)
+	if _, err := first.CreateCircle(ctx, "Book Club", 1); err != nil {
+		t.Fatalf("CreateCircle: %v", err)
+	}
+	if err := first.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Reopening must neither fail on the existing schema nor lose data.
+	second := newSQLiteStore(t, path)
+	if _, err := second.GetCircle(ctx, "Book Club"); err != nil {
+		t.Fatalf("GetCircle after reopening: %v", err)
+	}
+}
+
+func TestStoreCircles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store db.Store) {
+		ctx := context.Background()
+
+		circle, err := store.CreateCircle(ctx, "Book Club", 1)
+		if err != nil {
+			t.Fatalf("CreateCircle: %v", err)
+		}
+		if _, err := store.CreateCircle(ctx, "Book Club", 2); !errors.Is(err, db.ErrDuplicate) {
+			t.Fatalf("CreateCircle with a taken name = %v, want ErrDuplicate", err)
+		}
+		other, err := store.CreateCircle(ctx, "Choir", 2)
+		if err != nil {
+			t.Fatalf("CreateCircle: %v", err)
+		}
+
+		if _, err := store.AddUserToCircle(ctx, circle.ID, 2); err != nil {
+			t.Fatalf("AddUserToCircle: %v", err)
+		}
+		exclusions := []models.Exclusion{{AngelId: 1, MortalId: 2}, {AngelId: 2, MortalId: 1}}
+		if _, err := store.AddCircleExclusions(ctx, circle.ID, exclusions); err != nil {
+			t.Fatalf("AddCircleExclusions: %v", err)
+		}
+
+		circles, err := store.GetCircles(ctx, 2)
+		if err != nil {
+			t.Fatalf("GetCircles: %v", err)
+		}
+		if len(circles) != 2 || circles[0].ID != circle.ID || circles[1].ID != other.ID {
+			t.Fatalf("GetCircles(2) = %v, want Book Club then Choir", circles)
+		}
+
+		updated, err := store.RemoveUserFromCircle(ctx, circle.ID, 2)
+		if err != nil {
+			t.Fatalf("RemoveUserFromCircle: %v", err)
+		}
+		if len(updated.Members) != 1 || len(updated.Exclusions) != 0 {
+			t.Errorf("after removing user 2: members %v, exclusions %v; want [1] and none", updated.Members, updated.Exclusions)
+		}
+
+		found, err := store.GetCircleByInviteCode(ctx, circle.InviteCode)
+		if err != nil || found.ID != circle.ID {
+			t.Fatalf("GetCircleByInviteCode = %v, %v", found, err)
+		}
+		// Disabled invites don't clash with each other.
+		if _, err := store.SetCircleInviteCode(ctx, circle.ID, ""); err != nil {
+			t.Fatalf("SetCircleInviteCode: %v", err)
+		}
+		if _, err := store.SetCircleInviteCode(ctx, other.ID, ""); err != nil {
+			t.Fatalf("SetCircleInviteCode: %v", err)
+		}
+		if _, err := store.GetCircleByInviteCode(ctx, ""); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("GetCircleByInviteCode(\"\") = %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreAdminsAndOwnership(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store db.Store) {
+		ctx := context.Background()
+
+		circle, err := store.CreateCircle(ctx, "Book Club", 1)
+		if err != nil {
+			t.Fatalf("CreateCircle: %v", err)
+		}
+		for _, id := range []int64{2, 3} {
+			if _, err := store.AddUserToCircle(ctx, circle.ID, id); err != nil {
+				t.Fatalf("AddUserToCircle: %v", err)
+			}
+		}
+
+		if _, err := store.AddCircleAdmin(ctx, circle.ID, 4); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("AddCircleAdmin of a non-member = %v, want ErrNotFound", err)
+		}
+		if _, err := store.AddCircleAdmin(ctx, circle.ID, 1); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("AddCircleAdmin of the owner = %v, want ErrNotFound", err)
+		}
+		updated, err := store.AddCircleAdmin(ctx, circle.ID, 2)
+		if err != nil || updated.RoleOf(2) != models.RoleAdmin {
+			t.Fatalf("AddCircleAdmin = %v, %v; want user 2 to be an admin", updated, err)
+		}
+
+		if _, err := store.AcceptCircleOwnership(ctx, circle.ID, 3); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("AcceptCircleOwnership without an offer = %v, want ErrNotFound", err)
+		}
+		if _, err := store.OfferCircleOwnership(ctx, circle.ID, 3); err != nil {
+			t.Fatalf("OfferCircleOwnership: %v", err)
+		}
+		if _, err := store.DeclineCircleOwnership(ctx, circle.ID, 2); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("DeclineCircleOwnership by someone else = %v, want ErrNotFound", err)
+		}
+
+		// The offer lapses when the member leaves.
+		if _, err := store.RemoveUserFromCircle(ctx, circle.ID, 3); err != nil {
+			t.Fatalf("RemoveUserFromCircle: %v", err)
+		}
+		if _, err := store.AddUserToCircle(ctx, circle.ID, 3); err != nil {
+			t.Fatalf("AddUserToCircle: %v", err)
+		}
+		if _, err := store.AcceptCircleOwnership(ctx, circle.ID, 3); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("AcceptCircleOwnership after leaving = %v, want ErrNotFound", err)
+		}
+
+		if _, err := store.OfferCircleOwnership(ctx, circle.ID, 2); err != nil {
+			t.Fatalf("OfferCircleOwnership: %v", err)
+		}
+		updated, err = store.AcceptCircleOwnership(ctx, circle.ID, 2)
+		if err != nil {
+			t.Fatalf("AcceptCircleOwnership: %v", err)
+		}
+		if updated.OwnerId != 2 || updated.PendingOwnerId != 0 {
+			t.Errorf("after accepting: owner %d, pending %d; want 2 and none", updated.OwnerId, updated.PendingOwnerId)
+		}
+		if updated.RoleOf(1) != models.RoleAdmin || updated.RoleOf(2) != models.RoleOwner {
+			t.Errorf("after accepting: user 1 is %s and user 2 is %s; want admin and owner", updated.RoleOf(1), updated.RoleOf(2))
+		}
+
+		found, err := store.GetCircleByID(ctx, circle.ID)
+		if err != nil || found.OwnerId != 2 || len(found.Admins) != 1 {
+			t.Fatalf("GetCircleByID = %+v, %v; want owner 2 and admin 1", found, err)
+		}
+		updated, err = store.RemoveCircleAdmin(ctx, circle.ID, 1)
+		if err != nil || updated.RoleOf(1) != models.RoleMember {
+			t.Errorf("RemoveCircleAdmin = %v, %v; want user 1 to be a member", updated, err)
+		}
+	})
+}
+
+func TestStoreUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store db.Store) {
+		ctx := context.Background()
+		alice := &tlgModels.User{ID: 1, FirstName: "Alice", Username: "alice"}
+
+		if _, err, existed := store.CreateUser(ctx, alice, 10); err != nil || existed {
+			t.Fatalf("CreateUser = %v, %v; want a new user", err, existed)
+		}
+		alice.LastName = "Liddell"
+		if _, err, existed := store.CreateUser(ctx, alice, 11); err != nil || !existed {
+			t.Fatalf("CreateUser again = %v, %v; want the existing user", err, existed)
+		}
+
+		user, err := store.GetUser(ctx, 1)
+		if err != nil || user == nil {
+			t.Fatalf("GetUser = %v, %v", user, err)
+		}
+		if user.ChatID != 11 || user.DisplayName() != "Alice Liddell (@alice)" {
+			t.Errorf("GetUser = %+v, want chat 11 and the new name", user)
+		}
+		if missing, err := store.GetUser(ctx, 2); missing != nil || err != nil {
+			t.Errorf("GetUser of an unknown user = %v, %v; want nil, nil", missing, err)
+		}
+
+		circle, err := store.CreateCircle(ctx, "Book Club", 1)
+		if err != nil {
+			t.Fatalf("CreateCircle: %v", err)
+		}
+		if err := store.UpdateStateWithCircle(ctx, 1, models.StateChattingWithAngel, circle.ID); err != nil {
+			t.Fatalf("UpdateStateWithCircle: %v", err)
+		}
+
+		if expired, err := store.ExpireIdleChats(ctx, time.Now().Add(-time.Minute)); err != nil || len(expired) != 0 {
+			t.Fatalf("ExpireIdleChats of a fresh chat = %v, %v; want none", expired, err)
+		}
+		expired, err := store.ExpireIdleChats(ctx, time.Now().Add(time.Minute))
+		if err != nil || len(expired) != 1 {
+			t.Fatalf("ExpireIdleChats = %v, %v; want Alice", expired, err)
+		}
+		if expired[0].State != models.StateChattingWithAngel || expired[0].StateCircleId != circle.ID {
+			t.Errorf("expired user = %+v, want them as they were", expired[0])
+		}
+
+		user, _ = store.GetUser(ctx, 1)
+		if user.State != models.StateNone || !user.StateCircleId.IsZero() {
+			t.Errorf("after expiry user = %+v, want no state", user)
+		}
+	})
+}
+
+func TestStoreStartSession(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store db.Store) {
+		ctx := context.Background()
+
+		circle, err := store.CreateCircle(ctx, "Book Club", 1)
+		if err != nil {
+			t.Fatalf("CreateCircle: %v", err)
+		}
+		matches := func() []*models.Match {
+			return []*models.Match{{AngelId: 1, MortalId: 2}, {AngelId: 2, MortalId: 1}}
+		}
+		deadline := time.Now().Add(time.Hour).Truncate(time.Second)
+
+		// Only one of several concurrent starts wins, and only its
+		// announcement is queued.
+		var wg sync.WaitGroup
+		results := make(chan error, 5)
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				announcement := []*models.Message{{RecepientId: 1, Message: "Session started"}}
+				_, err := store.StartSession(ctx, circle.ID, []int64{1, 2}, &deadline, matches(), announcement)
+				results <- err
+			}()
+		}
+		wg.Wait()
+		close(results)
+
+		started := 0
+		for err := range results {
+			switch {
+			case err == nil:
+				started++
+			case !errors.Is(err, db.ErrSessionActive):
+				t.Fatalf("StartSession: %v", err)
+			}
+		}
+		if started != 1 {
+			t.Fatalf("%d concurrent starts succeeded, want 1", started)
+		}
+		if queued, _ := store.GetUndeliveredMessages(ctx); len(queued) != 1 || queued[0].Kind != models.KindNotification {
+			t.Errorf("GetUndeliveredMessages = %v, want the winning start's announcement", queued)
+		}
+
+		circle, _ = store.GetCircleByID(ctx, circle.ID)
+		if circle.CurrentSession == nil {
+			t.Fatal("the circle has no current session")
+		}
+		session, err := store.GetSession(ctx, *circle.CurrentSession)
+		if err != nil {
+			t.Fatalf("GetSession: %v", err)
+		}
+		if session.Deadline == nil || !session.Deadline.Equal(deadline) {
+			t.Errorf("session deadline = %v, want %v", session.Deadline, deadline)
+		}
+		if _, err := store.GetSession(ctx, bson.NewObjectID()); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("GetSession of a missing session = %v, want ErrNotFound", err)
+		}
+
+		mortal, err := store.GetMortalMatch(ctx, session.ID, 1)
+		if err != nil || mortal.MortalId != 2 {
+			t.Errorf("GetMortalMatch = %v, %v; want user 2", mortal, err)
+		}
+		if all, _ := store.GetMatches(ctx, session.ID); len(all) != 2 {
+			t.Errorf("GetMatches returned %d matches, want 2", len(all))
+		}
+
+		// Only one of several concurrent ends finishes it.
+		ended := make(chan error, 5)
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := store.UpdateSessionToFinished(ctx, session.ID)
+				ended <- err
+			}()
+		}
+		wg.Wait()
+		close(ended)
+
+		finished := 0
+		for err := range ended {
+			switch {
+			case err == nil:
+				finished++
+			case !errors.Is(err, db.ErrNotFound):
+				t.Fatalf("UpdateSessionToFinished: %v", err)
+			}
+		}
+		if finished != 1 {
+			t.Fatalf("%d concurrent ends succeeded, want 1", finished)
+		}
+
+		next, err := store.StartSession(ctx, circle.ID, []int64{1, 2}, nil, matches(), nil)
+		if err != nil {
+			t.Fatalf("StartSession after finishing: %v", err)
+		}
+		sessions, _ := store.GetCircleSessions(ctx, circle.ID)
+		if len(sessions) != 2 || sessions[0].ID != next.ID {
+			t.Errorf("GetCircleSessions = %v, want the new session first", sessions)
+		}
+	})
+}
+
+func TestCircleSessionsSkipSessionsThatNeverStarted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grandfather.db")
+	ctx := context.Background()
+	store := newSQLiteStore(t, path)
+
+	circle, err := store.CreateCircle(ctx, "Book Club", 1)
+	if err != nil {
+		t.Fatalf("CreateCircle: %v", err)
+	}
+
+	// A start that failed half way leaves an active session behind that the
+	// circle never pointed to.
+	raw, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer raw.Close()
+	orphan := bson.NewObjectID().Hex()
+	if _, err := raw.ExecContext(ctx,
+		`INSERT INTO sessions (id, circle_id, members, state, created_at) VALUES (?, ?, '[1,2]', ?, ?)`,
+		orphan, circle.ID.Hex(), models.StateActive, time.Now().UnixNano(),
+	); err != nil {
+		t.Fatalf("inserting the orphan session: %v", err)
+	}
+
+	if sessions, _ := store.GetCircleSessions(ctx, circle.ID); len(sessions) != 0 {
+		t.Fatalf("GetCircleSessions = %v, want no sessions", sessions)
+	}
+
+	current, err := store.StartSession(ctx, circle.ID, []int64{1, 2}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("StartSession: %v", err)
+	}
+	sessions, _ := store.GetCircleSessions(ctx, circle.ID)
+	if len(sessions) != 1 || sessions[0].ID != current.ID {
+		t.Errorf("GetCircleSessions = %v, want only the current session", sessions)
+	}
+}
+
+func TestStoreMessages(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store db.Store) {
+		ctx := context.Background()
+
+		circle, err := store.CreateCircle(ctx, "Book Club", 1)
+		if err != nil {
+			t.Fatalf("CreateCircle: %v", err)
+		}
+		send := func(from, to int64, text string) *models.Message {
+			t.Helper()
+			message, err := store.CreateMessage(ctx, &models.Message{
+				SenderId:    from,
+				RecepientId: to,
+				CircleId:    circle.ID,
+				SenderRole:  "angel",
+				Payload:     &models.Payload{Type: models.PayloadText, Text: text, SourceMessageID: len(text)},
+			})
+			if err != nil {
+				t.Fatalf("CreateMessage: %v", err)
+			}
+			return message
+		}
+		first := send(1, 2, "hi")
+		second := send(2, 1, "hello")
+
+		claimed, err := store.ClaimMessage(ctx, "outbox", time.Minute)
+		if err != nil || claimed.ID != first.ID || claimed.MessageState != models.Sending {
+			t.Fatalf("ClaimMessage = %v, %v; want the first message, sending", claimed, err)
+		}
+		if err := store.UpdateMessageToDelivered(ctx, first.ID, "someone else", []int{7}); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("delivering with another lease = %v, want ErrNotFound", err)
+		}
+		if err := store.UpdateMessageToDelivered(ctx, first.ID, "outbox", []int{7, 8}); err != nil {
+			t.Fatalf("UpdateMessageToDelivered: %v", err)
+		}
+
+		delivered, err := store.GetMessageByDeliveredId(ctx, 2, 8)
+		if err != nil || delivered.ID != first.ID || delivered.LeaseOwner != "" {
+			t.Fatalf("GetMessageByDeliveredId = %+v, %v; want the first message without a lease", delivered, err)
+		}
+		if _, err := store.GetMessageByDeliveredId(ctx, 1, 8); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("GetMessageByDeliveredId of another recipient = %v, want ErrNotFound", err)
+		}
+
+		if _, err := store.MarkMessageSeen(ctx, first.ID); err != nil {
+			t.Fatalf("MarkMessageSeen: %v", err)
+		}
+		if _, err := store.MarkMessageSeen(ctx, first.ID); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("MarkMessageSeen twice = %v, want ErrNotFound", err)
+		}
+		if _, err := store.MarkMessageSeen(ctx, second.ID); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("MarkMessageSeen of an undelivered message = %v, want ErrNotFound", err)
+		}
+
+		// A failed attempt holds the message back until it is due again.
+		claimed, err = store.ClaimMessage(ctx, "outbox", time.Minute)
+		if err != nil || claimed.ID != second.ID {
+			t.Fatalf("ClaimMessage = %v, %v; want the second message", claimed, err)
+		}
+		if err := store.RecordMessageHeader(ctx, second.ID, "someone else", 5); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("recording a header with another lease = %v, want ErrNotFound", err)
+		}
+		if err := store.RecordMessageHeader(ctx, second.ID, "outbox", 5); err != nil {
+			t.Fatalf("RecordMessageHeader: %v", err)
+		}
+		if err := store.ExtendMessageLease(ctx, second.ID, "someone else", time.Hour); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("extending another lease = %v, want ErrNotFound", err)
+		}
+		if err := store.ExtendMessageLease(ctx, second.ID, "outbox", time.Hour); err != nil {
+			t.Fatalf("ExtendMessageLease: %v", err)
+		}
+		if held, _ := store.GetMessage(ctx, second.ID); time.Until(held.LeaseExpiresAt) < 59*time.Minute {
+			t.Errorf("lease expires at %v, want an hour from now", held.LeaseExpiresAt)
+		}
+		if err := store.ScheduleMessageRetry(ctx, second.ID, "outbox", 1, time.Now().Add(time.Hour), "flood"); err != nil {
+			t.Fatalf("ScheduleMessageRetry: %v", err)
+		}
+		if _, err := store.ClaimMessage(ctx, "outbox", time.Minute); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("ClaimMessage before the retry is due = %v, want ErrNotFound", err)
+		}
+		if undelivered, _ := store.GetUndeliveredMessages(ctx); len(undelivered) != 1 || undelivered[0].LastError != "flood" {
+			t.Errorf("GetUndeliveredMessages = %v, want the retried message", undelivered)
+		} else if !slices.Equal(undelivered[0].DeliveredMessageIds, []int{5}) {
+			t.Errorf("retried message delivered ids = %v, want the recorded header", undelivered[0].DeliveredMessageIds)
+		}
+
+		edited, err := store.UpdateMessagePayload(ctx, second.ID, models.Payload{Type: models.PayloadText, Text: "hello!", SourceMessageID: len("hello")})
+		if err != nil || edited.Message != "hello!" {
+			t.Fatalf("UpdateMessagePayload = %v, %v", edited, err)
+		}
+		if bySource, err := store.GetMessageBySource(ctx, 2, len("hello")); err != nil || bySource.ID != second.ID {
+			t.Errorf("GetMessageBySource = %v, %v; want the second message", bySource, err)
+		}
+
+		// Unsending returns the copies delivered since the sender last looked.
+		third := send(1, 2, "unsent")
+		claimed, err = store.ClaimMessage(ctx, "outbox", time.Minute)
+		if err != nil || claimed.ID != third.ID {
+			t.Fatalf("ClaimMessage = %v, %v; want the third message", claimed, err)
+		}
+		if err := store.UpdateMessageToDelivered(ctx, third.ID, "outbox", []int{42}); err != nil {
+			t.Fatalf("UpdateMessageToDelivered: %v", err)
+		}
+		unsent, err := store.UpdateMessageToUnsent(ctx, third.ID)
+		if err != nil || unsent.MessageState != models.Unsent || len(unsent.DeliveredMessageIds) != 1 {
+			t.Fatalf("UpdateMessageToUnsent = %+v, %v; want it unsent with its delivered copy", unsent, err)
+		}
+		if _, err := store.UpdateMessageToUnsent(ctx, bson.NewObjectID()); !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("UpdateMessageToUnsent of a missing message = %v, want ErrNotFound", err)
+		}
+		if err := store.CreateNotifications(ctx, []*models.Message{{RecepientId: 1, Message: "Session started"}}); err != nil {
+			t.Fatalf("CreateNotifications: %v", err)
+		}
+
+		history, err := store.GetMessageHistory(ctx, circle.ID, 1, 0, 10)
+		if err != nil {
+			t.Fatalf("GetMessageHistory: %v", err)
+		}
+		if len(history) != 2 || history[0].ID != second.ID || history[1].ID != first.ID {
+			t.Fatalf("GetMessageHistory = %v, want the second then the first message", history)
+		}
+		if page, _ := store.GetMessageHistory(ctx, circle.ID, 1, 1, 10); len(page) != 1 || page[0].ID != first.ID {
+			t.Errorf("second page of history = %v, want the first message", page)
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"grandfather/internal/models"
+	"log"
+	"time"
+
+	tlgModels "github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const userColumns = `id, chat_id, first_name, last_name, user_handle, state, state_circle_id, state_updated_at`
+
+func scanUser(row scanner) (*models.User, error) {
+	var user models.User
+	err := row.Scan(
+		&user.ID,
+		&user.ChatID,
+		&user.FirstName,
+		&user.LastName,
+		&user.UserHandle,
+		&user.State,
+		objectID{&user.StateCircleId},
+		unixTime{&user.StateUpdatedAt},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *SQLiteStore) GetUser(ctx context.Context, userId int64) (*models.User, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = ?`, userId)
+	user, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *SQLiteStore) CreateUser(ctx context.Context, user *tlgModels.User, chatId int64) (*models.User, error, bool) {
+	var alreadyCreatedUser bool
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)`, user.ID).Scan(&alreadyCreatedUser); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx,
+			`INSERT INTO users (id, chat_id, first_name, last_name, user_handle) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET
+				chat_id = excluded.chat_id,
+				first_name = excluded.first_name,
+				last_name = excluded.last_name,
+				user_handle = excluded.user_handle`,
+			user.ID, chatId, user.FirstName, user.LastName, user.Username,
+		)
+		return err
+	})
+	if err != nil {
+		return nil, err, false
+	}
+
+	if alreadyCreatedUser {
+		fmt.Println("User already exists, updated chatId")
+	} else {
+		fmt.Println("Inserted new user with ID:", user.ID)
+	}
+
+	return &models.User{
+		ID:     user.ID,
+		ChatID: chatId,
+	}, nil, alreadyCreatedUser
+}
+
+func (s *SQLiteStore) GetUsers(ctx context.Context, userIds []int64) ([]*models.User, error) {
+	if len(userIds) == 0 {
+		return []*models.User{}, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT `+userColumns+` FROM users WHERE id IN (`+placeholders(len(userIds))+`)`, anys(userIds)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	foundByID := make(map[int64]*models.User, len(userIds))
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		foundByID[u.ID] = u
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ordered := make([]*models.User, 0, len(userIds))
+	for _, id := range userIds {
+		if u, ok := foundByID[id]; ok {
+			ordered = append(ordered, u)
+		}
+	}
+	return ordered, nil
+}
+
+func (s *SQLiteStore) UpdateState(ctx context.Context, userId int64, state models.UserState) error {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET state = ?, state_updated_at = ? WHERE id = ?`,
+		state, timeValue(time.Now()), userId,
+	)
+	if err != nil {
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		log.Printf("No user found with id %d", userId)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) UpdateStateWithCircle(ctx context.Context, userId int64, state models.UserState, circleId bson.ObjectID) error {
+	result, err := s.db.ExecContext(ctx,
+		`UPDATE users SET state = ?, state_circle_id = ?, state_updated_at = ? WHERE id = ?`,
+		state, idValue(circleId), timeValue(time.Now()), userId,
+	)
+	if err != nil {
+		return err
+	}
+
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		log.Printf("No user found with id %d", userId)
+	}
+	return nil
+}
+
+func (s *SQLiteStore) ExpireIdleChats(ctx context.Context, idleSince time.Time) ([]*models.User, error) {
+	var expired []*models.User
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		args := append(anys(models.ChatStates), timeValue(idleSince))
+		rows, err := tx.QueryContext(ctx,
+			`SELECT `+userColumns+` FROM users WHERE state IN (`+placeholders(len(models.ChatStates))+`) AND state_updated_at < ?`,
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			user, err := scanUser(rows)
+			if err != nil {
+				return err
+			}
+			expired = append(expired, user)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, user := range expired {
+			_, err := tx.ExecContext(ctx,
+				`UPDATE users SET state = ?, state_circle_id = NULL, state_updated_at = ? WHERE id = ?`,
+				models.StateNone, timeValue(time.Now()), user.ID,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"grandfather/internal/models"
+	"time"
+
+	tlgModels "github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// ErrNotFound is returned by lookups that are expected to find exactly one
+// document, such as GetCircle or GetMortalMatch.
+var ErrNotFound = errors.New("db: not found")
+
+// ErrDuplicate is returned when creating something whose unique key is
+// taken, such as a circle whose name is already used.
+var ErrDuplicate = errors.New("db: already exists")
+
+// ErrSessionActive is returned by StartSession when the circle already has
+// an active session.
+var ErrSessionActive = errors.New("db: the circle already has an active session")
+
+// ErrWatchUnsupported is returned by WatchMessages when the database can't
+// be watched at all, e.g. a MongoDB server that isn't a replica set.
+var ErrWatchUnsupported = errors.New("db: watching messages is not supported")
+
+// NewInviteCode returns a random code for a circle invite link. It only uses
+// characters Telegram allows in /start payloads.
+func NewInviteCode() string {
+	buf := make([]byte, 9)
+	_, _ = rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// Store is everything the bot persists. MongoStore is the production
+// implementation and SQLiteStore the one for small deployments; MemoryStore
+// keeps everything in process for tests.
+type Store interface {
+	CircleStore
+	UserStore
+	SessionStore
+	MatchStore
+	MessageStore
+}
+
+// MessageWatcher is implemented by stores that can tell the outbox about
+// queued messages right away, so it doesn't have to wait for its next poll.
+type MessageWatcher interface {
+	// WatchMessages calls notify whenever messages are queued, until ctx is
+	// done or watching fails.
+	WatchMessages(ctx context.Context, notify func()) error
+}
+
+type CircleStore interface {
+	CreateCircle(ctx context.Context, circleName string, circleOwner int64) (*models.Circle, error)
+	GetCircle(ctx context.Context, circleName string) (*models.Circle, error)
+	GetCircleByID(ctx context.Context, circleId bson.ObjectID) (*models.Circle, error)
+	GetCircles(ctx context.Context, userId int64) ([]models.Circle, error)
+	AddUserToCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error)
+	RemoveUserFromCircle(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error)
+	UnsetCircleCurrentSession(ctx context.Context, circleId, sessionId bson.ObjectID) (bool, error)
+	GetCircleByInviteCode(ctx context.Context, inviteCode string) (*models.Circle, error)
+	// SetCircleInviteCode replaces the circle's invite code; an empty code
+	// disables joining by link.
+	SetCircleInviteCode(ctx context.Context, circleId bson.ObjectID, inviteCode string) (*models.Circle, error)
+	// AddCircleExclusions adds the exclusions the circle doesn't have yet.
+	AddCircleExclusions(ctx context.Context, circleId bson.ObjectID, exclusions []models.Exclusion) (*models.Circle, error)
+	RemoveCircleExclusion(ctx context.Context, circleId bson.ObjectID, exclusion models.Exclusion) (*models.Circle, error)
+	// AddCircleAdmin makes a member an admin. It returns ErrNotFound if
+	// userId isn't a member of the circle or is its owner.
+	AddCircleAdmin(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error)
+	RemoveCircleAdmin(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error)
+	// OfferCircleOwnership records that the owner offered the circle to
+	// userId, replacing any earlier offer. It returns ErrNotFound if userId
+	// isn't a member of the circle or is its owner.
+	OfferCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error)
+	// AcceptCircleOwnership makes userId the owner and the previous owner an
+	// admin, all at once. It returns ErrNotFound unless the circle is still
+	// on offer to userId and they are still a member.
+	AcceptCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error)
+	// DeclineCircleOwnership withdraws the offer to userId. It returns
+	// ErrNotFound if the circle isn't on offer to them.
+	DeclineCircleOwnership(ctx context.Context, circleId bson.ObjectID, userId int64) (*models.Circle, error)
+}
+
+type UserStore interface {
+	// GetUser returns nil without an error when the user is not registered.
+	GetUser(ctx context.Context, userId int64) (*models.User, error)
+	CreateUser(ctx context.Context, user *tlgModels.User, chatId int64) (*models.User, error, bool)
+	GetUsers(ctx context.Context, userIds []int64) ([]*models.User, error)
+	UpdateState(ctx context.Context, userId int64, state models.UserState) error
+	UpdateStateWithCircle(ctx context.Context, userId int64, state models.UserState, circleId bson.ObjectID) error
+	// ExpireIdleChats resets every user who has been chatting without
+	// activity since idleSince and returns them as they were before.
+	ExpireIdleChats(ctx context.Context, idleSince time.Time) ([]*models.User, error)
+}
+
+type SessionStore interface {
+	// StartSession makes a session with the given matches the circle's
+	// current one and queues the notifications announcing it, all at once.
+	// It returns ErrSessionActive if the circle already has an active
+	// session, including one started concurrently.
+	StartSession(ctx context.Context, circleId bson.ObjectID, members []int64, deadline *time.Time, matches []*models.Match, notifications []*models.Message) (*models.Session, error)
+	// GetSession returns ErrNotFound when the session does not exist.
+	GetSession(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error)
+	// GetCircleSessions returns every session the circle has had, newest
+	// first. Only finished sessions and the current one count: an active
+	// session the circle never made current was left behind by a start that
+	// was cut short.
+	GetCircleSessions(ctx context.Context, circleId bson.ObjectID) ([]*models.Session, error)
+	// UpdateSessionToFinished ends an active session. It returns ErrNotFound
+	// if the session isn't active, e.g. because it was just ended by someone
+	// else, so only one caller ever ends it.
+	UpdateSessionToFinished(ctx context.Context, sessionId bson.ObjectID) (*models.Session, error)
+}
+
+type MatchStore interface {
+	GetMortalMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error)
+	GetAngelMatch(ctx context.Context, sessionId bson.ObjectID, userId int64) (*models.Match, error)
+	GetMatches(ctx context.Context, sessionId bson.ObjectID) ([]*models.Match, error)
+}
+
+type MessageStore interface {
+	// CreateMessage queues a relay for the outbox. Its ID, state and text
+	// summary are filled in from the payload.
+	CreateMessage(ctx context.Context, message *models.Message) (*models.Message, error)
+	// CreateNotifications queues bot-authored messages for the outbox.
+	CreateNotifications(ctx context.Context, notifications []*models.Message) error
+	// GetUndeliveredMessages returns the messages that are queued or being
+	// sent.
+	GetUndeliveredMessages(ctx context.Context) ([]*models.Message, error)
+	// ClaimMessage atomically takes the oldest message that is due for
+	// delivery, or whose lease expired, and leases it to leaseOwner for
+	// leaseFor. It returns ErrNotFound when there is nothing to send.
+	ClaimMessage(ctx context.Context, leaseOwner string, leaseFor time.Duration) (*models.Message, error)
+	// UpdateMessageToDelivered, ScheduleMessageRetry and UpdateMessageToFailed
+	// end leaseOwner's lease on a message. They return ErrNotFound when the
+	// lease was lost, e.g. because it expired and another instance took over
+	// or the sender unsent the message.
+	UpdateMessageToDelivered(ctx context.Context, messageId bson.ObjectID, leaseOwner string, deliveredMessageIds []int) error
+	// ScheduleMessageRetry records a failed delivery and when to try again.
+	ScheduleMessageRetry(ctx context.Context, messageId bson.ObjectID, leaseOwner string, attempts int, nextAttemptAt time.Time, lastError string) error
+	// UpdateMessageToFailed gives up on delivering a message.
+	UpdateMessageToFailed(ctx context.Context, messageId bson.ObjectID, leaseOwner string, attempts int, lastError string) error
+	// RecordMessageHeader stores the header sent ahead of a relay's content
+	// as its first delivered message while leaseOwner is still sending it,
+	// so that a retry doesn't send the header again. It returns ErrNotFound
+	// when the lease was lost.
+	RecordMessageHeader(ctx context.Context, messageId bson.ObjectID, leaseOwner string, headerMessageId int) error
+	// ExtendMessageLease renews leaseOwner's lease on a message it is still
+	// sending for another leaseFor. It returns ErrNotFound when the lease
+	// was lost.
+	ExtendMessageLease(ctx context.Context, messageId bson.ObjectID, leaseOwner string, leaseFor time.Duration) error
+	// GetMessageByDeliveredId finds the message whose delivered copy in
+	// recipientId's chat has the Telegram message ID deliveredMessageId.
+	GetMessageByDeliveredId(ctx context.Context, recipientId int64, deliveredMessageId int) (*models.Message, error)
+	GetMessage(ctx context.Context, messageId bson.ObjectID) (*models.Message, error)
+	// GetMessageBySource finds the relay created from senderId's Telegram
+	// message sourceMessageId.
+	GetMessageBySource(ctx context.Context, senderId int64, sourceMessageId int) (*models.Message, error)
+	// UpdateMessagePayload replaces the content of a relay after its sender
+	// edited it.
+	UpdateMessagePayload(ctx context.Context, messageId bson.ObjectID, payload models.Payload) (*models.Message, error)
+	// UpdateMessageToUnsent marks a message unsent and returns it as it is
+	// now, including any copies the outbox delivered in the meantime.
+	UpdateMessageToUnsent(ctx context.Context, messageId bson.ObjectID) (*models.Message, error)
+	// GetMessageHistory returns the relays userId sent or received in the
+	// circle, newest first, skipping the first skip and returning at most
+	// limit. Unsent relays are left out.
+	GetMessageHistory(ctx context.Context, circleId bson.ObjectID, userId int64, skip, limit int) ([]*models.Message, error)
+	// SetMessageConfirmation records where the sender's confirmation of a
+	// relay is and returns the relay as it is now.
+	SetMessageConfirmation(ctx context.Context, messageId bson.ObjectID, confirmation models.Confirmation) (*models.Message, error)
+	// MarkMessageSeen records that the recipient saw a delivered relay. It
+	// returns ErrNotFound if the relay isn't delivered or was already seen.
+	MarkMessageSeen(ctx context.Context, messageId bson.ObjectID) (*models.Message, error)
+}
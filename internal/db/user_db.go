@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"grandfather/internal/models"
 	"log"
+	"time"
 
 	tlgModels "github.com/go-telegram/bot/models"
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -16,13 +17,10 @@ var (
 	userCollectionName = "users"
 )
 
-func GetUser(ctx context.Context, userId int64) (*models.User, error) {
+func (s *MongoStore) GetUser(ctx context.Context, userId int64) (*models.User, error) {
 	filter := bson.M{"_id": userId}
 
-	coll, collErr := GetCollection(userCollectionName)
-	if collErr != nil {
-		return nil, collErr
-	}
+	coll := s.collection(userCollectionName)
 
 	var user models.User
 	err := coll.FindOne(ctx, filter).Decode(&user)
@@ -37,13 +35,10 @@ func GetUser(ctx context.Context, userId int64) (*models.User, error) {
 	return &user, nil
 }
 
-func CreateUser(ctx context.Context, user *tlgModels.User, chatId int64) (*models.User, error, bool) {
+func (s *MongoStore) CreateUser(ctx context.Context, user *tlgModels.User, chatId int64) (*models.User, error, bool) {
 	userId := user.ID
 
-	coll, collErr := GetCollection(userCollectionName)
-	if collErr != nil {
-		return nil, collErr, false
-	}
+	coll := s.collection(userCollectionName)
 
 	filter := bson.M{"_id": userId}
 	update := bson.M{
@@ -74,16 +69,13 @@ func CreateUser(ctx context.Context, user *tlgModels.User, chatId int64) (*model
 	}, nil, alreadyCreatedUser
 }
 
-func GetUsers(ctx context.Context, userIds []int64) ([]*models.User, error) {
+func (s *MongoStore) GetUsers(ctx context.Context, userIds []int64) ([]*models.User, error) {
 
 	if len(userIds) == 0 {
 		return []*models.User{}, nil
 	}
 
-	coll, err := GetCollection(userCollectionName)
-	if err != nil {
-		return nil, err
-	}
+	coll := s.collection(userCollectionName)
 
 	filter := bson.M{"_id": bson.M{"$in": userIds}}
 
@@ -116,17 +108,15 @@ func GetUsers(ctx context.Context, userIds []int64) ([]*models.User, error) {
 	return ordered, nil
 }
 
-func UpdateState(ctx context.Context, userId int64, state models.UserState) error {
+func (s *MongoStore) UpdateState(ctx context.Context, userId int64, state models.UserState) error {
 
-	coll, err := GetCollection(userCollectionName)
-	if err != nil {
-		return err
-	}
+	coll := s.collection(userCollectionName)
 
 	filter := bson.M{"_id": userId}
 	update := bson.M{
 		"$set": bson.M{
-			"state": state,
+			"state":          state,
+			"stateUpdatedAt": time.Now(),
 		},
 	}
 
@@ -143,18 +133,16 @@ func UpdateState(ctx context.Context, userId int64, state models.UserState) erro
 	return nil
 }
 
-func UpdateStateWithCircle(ctx context.Context, userId int64, state models.UserState, circleName string) error {
+func (s *MongoStore) UpdateStateWithCircle(ctx context.Context, userId int64, state models.UserState, circleId bson.ObjectID) error {
 
-	coll, err := GetCollection(userCollectionName)
-	if err != nil {
-		return err
-	}
+	coll := s.collection(userCollectionName)
 
 	filter := bson.M{"_id": userId}
 	update := bson.M{
 		"$set": bson.M{
-			"state":       state,
-			"stateCircle": circleName,
+			"state":          state,
+			"stateCircleId":  circleId,
+			"stateUpdatedAt": time.Now(),
 		},
 	}
 
@@ -170,3 +158,40 @@ func UpdateStateWithCircle(ctx context.Context, userId int64, state models.UserS
 
 	return nil
 }
+
+func (s *MongoStore) ExpireIdleChats(ctx context.Context, idleSince time.Time) ([]*models.User, error) {
+	coll := s.collection(userCollectionName)
+
+	filter := bson.M{
+		"state":          bson.M{"$in": models.ChatStates},
+		"stateUpdatedAt": bson.M{"$lt": idleSince},
+	}
+
+	cur, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var idle []*models.User
+	if err := cur.All(ctx, &idle); err != nil {
+		return nil, err
+	}
+
+	expired := make([]*models.User, 0, len(idle))
+	for _, user := range idle {
+		// Only reset the user if they haven't sent anything since the query.
+		result, err := coll.UpdateOne(ctx,
+			bson.M{"_id": user.ID, "state": user.State, "stateUpdatedAt": user.StateUpdatedAt},
+			bson.M{"$set": bson.M{"state": models.StateNone, "stateCircleId": bson.ObjectID{}, "stateUpdatedAt": time.Now()}},
+		)
+		if err != nil {
+			return expired, err
+		}
+		if result.ModifiedCount == 1 {
+			expired = append(expired, user)
+		}
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,253 @@
+// Package matching assigns every member of a session a mortal.
+//
+// An assignment is a permutation of the members with no fixed points: each
+// member is the angel of exactly one mortal and the mortal of exactly one
+// angel. Owners can forbid specific angel → mortal pairs, e.g. to keep
+// couples or roommates apart, and pairs can be made costly, e.g. to avoid
+// repeating pairings from earlier sessions.
+package matching
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"slices"
+)
+
+var (
+	// ErrTooFewMembers is returned when there are fewer than two members.
+	ErrTooFewMembers = errors.New("matching: at least two members are needed")
+	// ErrNoValidAssignment is returned when the constraints rule out every
+	// assignment.
+	ErrNoValidAssignment = errors.New("matching: no valid assignment satisfies the constraints")
+)
+
+// cycleSearchBudget caps how many steps the single-cycle search may take
+// before falling back to an assignment made of several smaller cycles.
+const cycleSearchBudget = 20000
+
+// unavailable is the cost of a pair that may not be used at all.
+const unavailable = 1 << 40
+
+// Pair is a directed angel → mortal pairing.
+type Pair struct {
+	Angel  int64
+	Mortal int64
+}
+
+// Constraints restrict which pairs an assignment may contain.
+type Constraints struct {
+	// Forbidden pairs never appear in an assignment. They are directed:
+	// forbidding A → B still allows B → A.
+	Forbidden []Pair
+	// Penalties make pairs undesirable rather than impossible. Match returns
+	// an assignment with the lowest total penalty.
+	Penalties map[Pair]int
+}
+
+func (c Constraints) forbidden() map[Pair]bool {
+	forbidden := make(map[Pair]bool, len(c.Forbidden))
+	for _, p := range c.Forbidden {
+		forbidden[p] = true
+	}
+	return forbidden
+}
+
+// Match returns one pair per member, in the order of members, or
+// ErrNoValidAssignment if the constraints cannot be met. A single cycle
+// through every member without penalised pairs is preferred so that the
+// final reveal reads as one chain; if none is found, the cheapest valid
+// assignment is returned instead, which may consist of several cycles.
+//
+// r supplies randomness; nil uses the global source.
+func Match(members []int64, c Constraints, r *rand.Rand) ([]Pair, error) {
+	if len(members) < 2 {
+		return nil, ErrTooFewMembers
+	}
+
+	g := newGraph(members, c, r)
+
+	mortals, ok := g.cycle()
+	if !ok {
+		mortals, ok = g.cheapestAssignment()
+	}
+	if !ok {
+		return nil, ErrNoValidAssignment
+	}
+
+	pairs := make([]Pair, len(members))
+	for i, angel := range members {
+		pairs[i] = Pair{Angel: angel, Mortal: members[mortals[i]]}
+	}
+	return pairs, nil
+}
+
+// graph holds the cost of every angel → mortal pair by member index, and
+// for each member the shuffled indexes of the members they may be the angel
+// of without any penalty.
+type graph struct {
+	cost [][]int64
+	free [][]int
+	r    *rand.Rand
+}
+
+func newGraph(members []int64, c Constraints, r *rand.Rand) *graph {
+	forbidden := c.forbidden()
+
+	n := len(members)
+	g := &graph{cost: make([][]int64, n), free: make([][]int, n), r: r}
+	for i, angel := range members {
+		g.cost[i] = make([]int64, n)
+		for j, mortal := range members {
+			pair := Pair{Angel: angel, Mortal: mortal}
+			switch {
+			case i == j || forbidden[pair]:
+				g.cost[i][j] = unavailable
+			case c.Penalties[pair] > 0:
+				g.cost[i][j] = int64(c.Penalties[pair])
+			default:
+				g.free[i] = append(g.free[i], j)
+			}
+		}
+		g.shuffle(g.free[i])
+	}
+	return g
+}
+
+func (g *graph) shuffle(a []int) {
+	swap := func(i, j int) { a[i], a[j] = a[j], a[i] }
+	if g.r != nil {
+		g.r.Shuffle(len(a), swap)
+	} else {
+		rand.Shuffle(len(a), swap)
+	}
+}
+
+func (g *graph) canPair(angel, mortal int) bool {
+	return slices.Contains(g.free[angel], mortal)
+}
+
+// cycle searches for a Hamiltonian cycle of penalty-free pairs by randomised
+// backtracking and returns mortals[angel] for it. It gives up after
+// cycleSearchBudget steps.
+func (g *graph) cycle() ([]int, bool) {
+	n := len(g.free)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	g.shuffle(order)
+	start := order[0]
+
+	path := []int{start}
+	visited := make([]bool, n)
+	visited[start] = true
+	steps := 0
+
+	var extend func() bool
+	extend = func() bool {
+		last := path[len(path)-1]
+		if len(path) == n {
+			return g.canPair(last, start)
+		}
+		for _, next := range g.free[last] {
+			if visited[next] {
+				continue
+			}
+			if steps++; steps > cycleSearchBudget {
+				return false
+			}
+			visited[next] = true
+			path = append(path, next)
+			if extend() {
+				return true
+			}
+			path = path[:len(path)-1]
+			visited[next] = false
+		}
+		return false
+	}
+
+	if !extend() {
+		return nil, false
+	}
+
+	mortals := make([]int, n)
+	for i, angel := range path {
+		mortals[angel] = path[(i+1)%n]
+	}
+	return mortals, true
+}
+
+// cheapestAssignment finds the valid assignment with the lowest total cost
+// using the Hungarian algorithm. Members are visited in random order so that
+// ties don't always break the same way.
+func (g *graph) cheapestAssignment() ([]int, bool) {
+	n := len(g.cost)
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	g.shuffle(perm)
+	cost := func(i, j int) int64 { return g.cost[perm[i-1]][perm[j-1]] }
+
+	// Potentials u and v, and p[j] = the row matched to column j, all
+	// 1-indexed with row 0 as a sentinel.
+	u := make([]int64, n+1)
+	v := make([]int64, n+1)
+	p := make([]int, n+1)
+	way := make([]int, n+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]int64, n+1)
+		used := make([]bool, n+1)
+		for j := range minv {
+			minv[j] = math.MaxInt64
+		}
+
+		for p[j0] != 0 {
+			used[j0] = true
+			i0, delta, j1 := p[j0], int64(math.MaxInt64), 0
+			for j := 1; j <= n; j++ {
+				if used[j] {
+					continue
+				}
+				if cur := cost(i0, j) - u[i0] - v[j]; cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= n; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+		}
+
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	mortals := make([]int, n)
+	for j := 1; j <= n; j++ {
+		angel, mortal := perm[p[j]-1], perm[j-1]
+		if g.cost[angel][mortal] >= unavailable {
+			return nil, false
+		}
+		mortals[angel] = mortal
+	}
+	return mortals, true
+}
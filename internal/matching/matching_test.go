@@ -0,0 +1,157 @@
+package matching
+
+import (
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+// checkAssignment fails the test unless pairs give every member exactly one
+// mortal and one angel, avoiding self-pairs and forbidden pairs.
+func checkAssignment(t *testing.T, members []int64, c Constraints, pairs []Pair) {
+	t.Helper()
+
+	if len(pairs) != len(members) {
+		t.Fatalf("got %d pairs for %d members", len(pairs), len(members))
+	}
+	forbidden := c.forbidden()
+	hasAngel := map[int64]bool{}
+	for i, p := range pairs {
+		if p.Angel != members[i] {
+			t.Errorf("pair %d has angel %d, want %d", i, p.Angel, members[i])
+		}
+		if p.Angel == p.Mortal {
+			t.Errorf("%d is their own mortal", p.Angel)
+		}
+		if forbidden[p] {
+			t.Errorf("forbidden pair %d → %d was used", p.Angel, p.Mortal)
+		}
+		if hasAngel[p.Mortal] {
+			t.Errorf("%d has more than one angel", p.Mortal)
+		}
+		hasAngel[p.Mortal] = true
+	}
+}
+
+func cycleLength(pairs []Pair) int {
+	mortalOf := map[int64]int64{}
+	for _, p := range pairs {
+		mortalOf[p.Angel] = p.Mortal
+	}
+	n := 1
+	for id := mortalOf[pairs[0].Angel]; id != pairs[0].Angel; id = mortalOf[id] {
+		n++
+	}
+	return n
+}
+
+func TestMatchPrefersSingleCycle(t *testing.T) {
+	members := []int64{1, 2, 3, 4, 5, 6}
+	c := Constraints{Forbidden: []Pair{{1, 2}, {2, 1}, {3, 4}, {4, 3}}}
+	r := rand.New(rand.NewPCG(1, 2))
+
+	for range 100 {
+		pairs, err := Match(members, c, r)
+		if err != nil {
+			t.Fatalf("Match: %v", err)
+		}
+		checkAssignment(t, members, c, pairs)
+		if n := cycleLength(pairs); n != len(members) {
+			t.Fatalf("got a cycle of %d, want a single cycle of %d", n, len(members))
+		}
+	}
+}
+
+func TestMatchFallsBackToSeveralCycles(t *testing.T) {
+	// Only 1 ↔ 2 and 3 ↔ 4 are allowed, so no single cycle exists.
+	members := []int64{1, 2, 3, 4}
+	c := Constraints{Forbidden: []Pair{{1, 3}, {1, 4}, {2, 3}, {2, 4}, {3, 1}, {3, 2}, {4, 1}, {4, 2}}}
+
+	pairs, err := Match(members, c, nil)
+	if err != nil {
+		t.Fatalf("Match: %v", err)
+	}
+	checkAssignment(t, members, c, pairs)
+}
+
+func TestMatchReportsImpossibleConstraints(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []int64
+		c       Constraints
+		want    error
+	}{
+		{"empty", nil, Constraints{}, ErrTooFewMembers},
+		{"single member", []int64{1}, Constraints{}, ErrTooFewMembers},
+		{"pair forbidden", []int64{1, 2}, Constraints{Forbidden: []Pair{{1, 2}}}, ErrNoValidAssignment},
+		{"nobody may be 3's angel", []int64{1, 2, 3}, Constraints{Forbidden: []Pair{{1, 3}, {2, 3}}}, ErrNoValidAssignment},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Match(tt.members, tt.c, nil); !errors.Is(err, tt.want) {
+				t.Fatalf("Match error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchAvoidsPenalisedPairs(t *testing.T) {
+	members := []int64{1, 2, 3}
+	// Last time the chain was 1 → 2 → 3 → 1, so only the reverse is free.
+	c := Constraints{Penalties: map[Pair]int{{1, 2}: 5, {2, 3}: 5, {3, 1}: 5}}
+
+	for range 20 {
+		pairs, err := Match(members, c, nil)
+		if err != nil {
+			t.Fatalf("Match: %v", err)
+		}
+		checkAssignment(t, members, c, pairs)
+		for _, p := range pairs {
+			if c.Penalties[p] > 0 {
+				t.Fatalf("penalised pair %d → %d was used", p.Angel, p.Mortal)
+			}
+		}
+	}
+}
+
+func TestMatchMinimisesUnavoidablePenalties(t *testing.T) {
+	members := []int64{1, 2, 3, 4}
+	c := Constraints{Penalties: map[Pair]int{}}
+	for _, angel := range members {
+		for _, mortal := range members {
+			c.Penalties[Pair{angel, mortal}] = 1
+		}
+	}
+	delete(c.Penalties, Pair{1, 2})
+	delete(c.Penalties, Pair{2, 1})
+	c.Penalties[Pair{4, 1}] = 10
+
+	pairs, err := Match(members, c, rand.New(rand.NewPCG(3, 4)))
+	if err != nil {
+		t.Fatalf("Match: %v", err)
+	}
+	checkAssignment(t, members, c, pairs)
+
+	total := 0
+	for _, p := range pairs {
+		total += c.Penalties[p]
+	}
+	// 1 ↔ 2 is free and 3 ↔ 4 costs one each; nothing cheaper exists.
+	if total != 2 {
+		t.Fatalf("assignment %v has total penalty %d, want 2", pairs, total)
+	}
+}
+
+func TestMatchPenaltiesNeverOverrideExclusions(t *testing.T) {
+	members := []int64{1, 2, 3}
+	c := Constraints{
+		Forbidden: []Pair{{1, 3}},
+		Penalties: map[Pair]int{{1, 2}: 100, {2, 3}: 100, {3, 1}: 100},
+	}
+
+	pairs, err := Match(members, c, nil)
+	if err != nil {
+		t.Fatalf("Match: %v", err)
+	}
+	checkAssignment(t, members, c, pairs)
+}
@@ -14,6 +14,35 @@ type Circle struct {
 	OwnerId        int64          `bson:"ownerId" json:"ownerId"`
 	Members        []int64        `bson:"members" json:"members"`
 	CurrentSession *bson.ObjectID `bson:"currentSession,omitempty" json:"currentSession,omitempty"`
+	// InviteCode is the secret part of the circle's invite link. An empty
+	// code means the owner has disabled joining by link.
+	InviteCode string `bson:"inviteCode,omitempty" json:"inviteCode,omitempty"`
+	// Exclusions are angel → mortal pairs the owner never wants matched.
+	Exclusions []Exclusion `bson:"exclusions,omitempty" json:"exclusions,omitempty"`
+	// Admins are members the owner trusts to run sessions and remove
+	// members. The owner is never one of them.
+	Admins []int64 `bson:"admins,omitempty" json:"admins,omitempty"`
+	// PendingOwnerId is the member the owner offered the circle to, until
+	// they accept or decline.
+	PendingOwnerId int64 `bson:"pendingOwnerId,omitempty" json:"pendingOwnerId,omitempty"`
+}
+
+// Exclusion forbids AngelId from being assigned MortalId as their mortal.
+type Exclusion struct {
+	AngelId  int64 `bson:"angelId" json:"angelId"`
+	MortalId int64 `bson:"mortalId" json:"mortalId"`
+}
+
+// InvitePayloadPrefix marks /start deep-link payloads that join a circle.
+const InvitePayloadPrefix = "join_"
+
+// InviteLink returns the t.me deep link that joins the circle, or an empty
+// string when invites are disabled.
+func (circle Circle) InviteLink(botUsername string) string {
+	if circle.InviteCode == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://t.me/%s?start=%s%s", botUsername, InvitePayloadPrefix, circle.InviteCode)
 }
 
 func (circle Circle) ToMenu(userID int64) ui.Menu {
@@ -28,18 +57,25 @@ func (circle Circle) ToMenu(userID int64) ui.Menu {
 		Buttons: [][]ui.MenuButton{},
 	}
 
-	isOwner := circle.OwnerId == userID
-	if isOwner {
-		circleMenu.PrependButtonRow("End session", string(commands.EndSessionCommand)+"@"+circleName)
-		circleMenu.PrependButtonRow("Start session", string(commands.StartNewSessionCommand)+"@"+circleName)
-		circleMenu.PrependButtonRow("Remove member", string(commands.RemoveUserCommand)+"@"+circleName)
+	role := circle.RoleOf(userID)
+	if role == RoleOwner {
+		circleMenu.PrependButtonRow("Transfer ownership", commands.Encode(commands.TransferOwnershipCommand, circle.ID))
+		circleMenu.PrependButtonRow("Manage admins", commands.Encode(commands.ManageAdminsCommand, circle.ID))
+		circleMenu.PrependButtonRow("Share invite link", commands.Encode(commands.ShareInviteLinkCommand, circle.ID))
+		circleMenu.PrependButtonRow("Manage exclusions", commands.Encode(commands.ManageExclusionsCommand, circle.ID))
+	}
+	if role >= RoleAdmin {
+		circleMenu.PrependButtonRow("End session", commands.Encode(commands.ChooseRevealModeCommand, circle.ID))
+		circleMenu.PrependButtonRow("Start session", commands.Encode(commands.ChooseSessionLengthCommand, circle.ID))
+		circleMenu.PrependButtonRow("Remove member", commands.Encode(commands.RemoveUserCommand, circle.ID))
 	}
 
-	circleMenu.PrependButtonRow("Member list", string(commands.GetMemberListCommand)+"@"+circleName)
-	circleMenu.AddButtonRow("Reveal mortal", string(commands.RevealMortalCommand)+"@"+circleName)
-	circleMenu.AddButtonRow("Reveal angel", string(commands.RevealAngelCommand)+"@"+circleName)
-	circleMenu.AddButtonRow("Send message to mortal", string(commands.SendMessageCommandToMortal)+"@"+circleName)
-	circleMenu.AddButtonRow("Send message to angel", string(commands.SendMessageCommandToAngel)+"@"+circleName)
+	circleMenu.PrependButtonRow("Member list", commands.Encode(commands.GetMemberListCommand, circle.ID))
+	circleMenu.AddButtonRow("Reveal mortal", commands.Encode(commands.RevealMortalCommand, circle.ID))
+	circleMenu.AddButtonRow("Reveal angel", commands.Encode(commands.RevealAngelCommand, circle.ID))
+	circleMenu.AddButtonRow("💬 Chat with mortal", commands.Encode(commands.SendMessageCommandToMortal, circle.ID))
+	circleMenu.AddButtonRow("💬 Chat with angel", commands.Encode(commands.SendMessageCommandToAngel, circle.ID))
+	circleMenu.AddButtonRow("📜 Message history", commands.Encode(commands.MessageHistoryCommand, circle.ID))
 	circleMenu.AddButtonRow("Back", string(commands.ListCirclesCommand))
 
 	return circleMenu
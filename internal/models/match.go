@@ -8,3 +8,37 @@ type Match struct {
 	AngelId   int64         `bson:"angel_id" json:"angel_id"`
 	MortalId  int64         `bson:"mortal_id" json:"mortal_id"`
 }
+
+// BuildChains follows each angel to their mortal and returns the resulting
+// cycles, e.g. [A B C] for A → B → C → A. Chains start from the earliest
+// unvisited user in order, so the output is stable for a given session.
+func BuildChains(order []int64, matches []*Match) [][]int64 {
+	mortalOf := make(map[int64]int64, len(matches))
+	for _, m := range matches {
+		mortalOf[m.AngelId] = m.MortalId
+	}
+
+	visited := map[int64]bool{}
+	var chains [][]int64
+	for _, start := range order {
+		if visited[start] {
+			continue
+		}
+		if _, ok := mortalOf[start]; !ok {
+			continue
+		}
+
+		var chain []int64
+		for id := start; !visited[id]; {
+			visited[id] = true
+			chain = append(chain, id)
+			next, ok := mortalOf[id]
+			if !ok {
+				break
+			}
+			id = next
+		}
+		chains = append(chains, chain)
+	}
+	return chains
+}
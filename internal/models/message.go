@@ -1,14 +1,125 @@
 package models
 
-import "go.mongodb.org/mongo-driver/v2/bson"
+import (
+	"fmt"
+	"grandfather/internal/commands.go"
+	"grandfather/internal/ui"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
 
 type MessageState string
 
 const (
 	NotDelivered MessageState = "not_delivered"
 	Delivered    MessageState = "delivered"
+	// Unsent messages were taken back by their sender and are never
+	// delivered again.
+	Unsent MessageState = "unsent"
+	// Failed messages could not be delivered and are not retried.
+	Failed MessageState = "failed"
+	// Sending messages are leased to one outbox instance, which is sending
+	// them right now.
+	Sending MessageState = "sending"
+)
+
+type MessageKind string
+
+const (
+	// KindRelay is an anonymous message between an angel and a mortal.
+	// Documents written before kinds existed have no kind and are relays.
+	KindRelay MessageKind = ""
+	// KindNotification is a message from the bot itself, such as a session
+	// announcement. Message holds the fully rendered text.
+	KindNotification MessageKind = "notification"
+)
+
+type PayloadType string
+
+const (
+	PayloadText     PayloadType = "text"
+	PayloadPhoto    PayloadType = "photo"
+	PayloadSticker  PayloadType = "sticker"
+	PayloadVoice    PayloadType = "voice"
+	PayloadVideo    PayloadType = "video"
+	PayloadDocument PayloadType = "document"
+	PayloadLocation PayloadType = "location"
+	// PayloadCopy covers every other kind of message, e.g. audio or polls.
+	// It is redelivered with copyMessage from the sender's chat.
+	PayloadCopy PayloadType = "copy"
+)
+
+// MaxTextLength and MaxCaptionLength are how long Telegram lets a message's
+// text and a media caption be. They count UTF-16 code units of the text as
+// shown, without markup.
+const (
+	MaxTextLength    = 4096
+	MaxCaptionLength = 1024
 )
 
+// textLength measures text the way Telegram's limits do.
+func textLength(text string) int {
+	n := 0
+	for _, r := range text {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
+
+// Payload is the content of a relayed message. Files are referenced by their
+// Telegram file ID, so they are never downloaded.
+type Payload struct {
+	Type    PayloadType `bson:"type" json:"type"`
+	Text    string      `bson:"text,omitempty" json:"text,omitempty"`
+	Caption string      `bson:"caption,omitempty" json:"caption,omitempty"`
+	FileID  string      `bson:"fileId,omitempty" json:"fileId,omitempty"`
+	// Latitude and Longitude are set for locations.
+	Latitude  float64 `bson:"latitude,omitempty" json:"latitude,omitempty"`
+	Longitude float64 `bson:"longitude,omitempty" json:"longitude,omitempty"`
+	// SourceChatID and SourceMessageID point at the sender's original
+	// message. PayloadCopy is redelivered from it, and replies are threaded
+	// onto it.
+	SourceChatID    int64 `bson:"sourceChatId,omitempty" json:"sourceChatId,omitempty"`
+	SourceMessageID int   `bson:"sourceMessageId,omitempty" json:"sourceMessageId,omitempty"`
+}
+
+// TooLong reports whether the text or caption is longer than Telegram lets
+// a message carry.
+func (p Payload) TooLong() bool {
+	return textLength(p.Text) > MaxTextLength || textLength(p.Caption) > MaxCaptionLength
+}
+
+// Summary is a plain text stand-in for the payload, used where only text can
+// be shown.
+func (p Payload) Summary() string {
+	switch p.Type {
+	case PayloadText:
+		return p.Text
+	case PayloadLocation:
+		return "📍 Location"
+	}
+	if p.Caption != "" {
+		return p.Caption
+	}
+	switch p.Type {
+	case PayloadPhoto:
+		return "🖼 Photo"
+	case PayloadSticker:
+		return "Sticker"
+	case PayloadVoice:
+		return "🎤 Voice message"
+	case PayloadVideo:
+		return "🎬 Video"
+	case PayloadDocument:
+		return "📎 File"
+	}
+	return "Message"
+}
+
 type Message struct {
 	ID           bson.ObjectID `bson:"_id" json:"id"`
 	SenderId     int64         `bson:"senderId" json:"senderId"`
@@ -17,4 +128,158 @@ type Message struct {
 	Message      string        `bson:"message" json:"message"`
 	CircleName   string        `bson:"circleName" json:"circleName"`
 	SenderRole   string        `bson:"senderRole" json:"senderRole"`
+	Kind         MessageKind   `bson:"kind,omitempty" json:"kind,omitempty"`
+	// CircleId and SessionId say where a relay was sent. They were filled in
+	// for older relays by a migration, where they could be worked out.
+	CircleId  bson.ObjectID `bson:"circleId,omitempty" json:"circleId,omitempty"`
+	SessionId bson.ObjectID `bson:"sessionId,omitempty" json:"sessionId,omitempty"`
+	// Payload holds the content of relays. Relays stored before payloads
+	// existed only have Message, which is then plain text.
+	Payload *Payload `bson:"payload,omitempty" json:"payload,omitempty"`
+	// DeliveredMessageIds are the messages the outbox sent to the recipient,
+	// in order. A separate header comes before the content and is recorded
+	// as soon as it is sent, so retries only send the content.
+	DeliveredMessageIds []int `bson:"deliveredMessageIds,omitempty" json:"deliveredMessageIds,omitempty"`
+	// ReplyToId is the relay this message answers, and ReplyToMessageId the
+	// message in the recipient's chat the delivered copy should reply to.
+	ReplyToId        *bson.ObjectID `bson:"replyToId,omitempty" json:"replyToId,omitempty"`
+	ReplyToMessageId int            `bson:"replyToMessageId,omitempty" json:"replyToMessageId,omitempty"`
+	// Attempts counts failed deliveries. The outbox leaves the message alone
+	// until NextAttemptAt, and LastError says why the last attempt failed.
+	Attempts      int       `bson:"attempts,omitempty" json:"attempts,omitempty"`
+	NextAttemptAt time.Time `bson:"nextAttemptAt,omitempty" json:"nextAttemptAt,omitempty"`
+	LastError     string    `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	// LeaseOwner is the outbox instance sending the message, which other
+	// instances leave alone until LeaseExpiresAt.
+	LeaseOwner     string    `bson:"leaseOwner,omitempty" json:"leaseOwner,omitempty"`
+	LeaseExpiresAt time.Time `bson:"leaseExpiresAt,omitempty" json:"leaseExpiresAt,omitempty"`
+	// Confirmation is the message that told the sender their relay was
+	// queued. It is edited as the relay is delivered and seen.
+	Confirmation *Confirmation `bson:"confirmation,omitempty" json:"confirmation,omitempty"`
+	// SeenAt is when the recipient marked the relay as read or reacted to it.
+	SeenAt time.Time `bson:"seenAt,omitempty" json:"seenAt,omitempty"`
+	// ParseMode and Buttons are only used by notifications.
+	ParseMode string            `bson:"parseMode,omitempty" json:"parseMode,omitempty"`
+	Buttons   [][]ui.MenuButton `bson:"buttons,omitempty" json:"buttons,omitempty"`
+}
+
+// Confirmation locates a relay's confirmation in its sender's chat.
+type Confirmation struct {
+	ChatId    int64 `bson:"chatId" json:"chatId"`
+	MessageId int   `bson:"messageId" json:"messageId"`
+	// Text is shown below the delivery status.
+	Text    string            `bson:"text,omitempty" json:"text,omitempty"`
+	Buttons [][]ui.MenuButton `bson:"buttons,omitempty" json:"buttons,omitempty"`
+}
+
+// Status describes how far a relay got, for its sender.
+func (m Message) Status() string {
+	recipient := m.RecipientRole()
+	switch {
+	case m.MessageState == Unsent:
+		return "↩️ Message unsent."
+	case m.MessageState == Failed:
+		return fmt.Sprintf("⚠️ Could not be delivered to your %s", recipient)
+	case !m.SeenAt.IsZero():
+		return fmt.Sprintf("👀 Seen by your %s", recipient)
+	case m.MessageState == Delivered:
+		return fmt.Sprintf("✅ Delivered to your %s", recipient)
+	default:
+		return fmt.Sprintf("🕓 Queued for your %s", recipient)
+	}
+}
+
+// ConfirmationText is the text of the sender's confirmation: the status,
+// followed by the confirmation's own text.
+func (m Message) ConfirmationText() string {
+	if m.Confirmation == nil || m.Confirmation.Text == "" {
+		return m.Status()
+	}
+	return m.Status() + "\n" + m.Confirmation.Text
+}
+
+// ConfirmationButtons are the buttons under the sender's confirmation. They
+// go away once there is nothing left to do with the message.
+func (m Message) ConfirmationButtons() [][]ui.MenuButton {
+	if m.Confirmation == nil || m.MessageState == Unsent || m.MessageState == Failed {
+		return nil
+	}
+	return m.Confirmation.Buttons
+}
+
+// RecipientButtons are the buttons under the delivered copy of a relay.
+func (m Message) RecipientButtons() [][]ui.MenuButton {
+	if !m.SeenAt.IsZero() {
+		return nil
+	}
+	return [][]ui.MenuButton{{{Text: "👀 Mark read", Command: commands.Encode(commands.MarkReadCommand, m.ID)}}}
+}
+
+const relayHeaderFormat = "✉️ You received a new message in circle %s from your %s:"
+
+// RelayHeader is the HTML line shown above a relay. It names only the
+// sender's role, never the sender.
+func (m Message) RelayHeader() string {
+	return fmt.Sprintf(relayHeaderFormat, "<b>"+html.EscapeString(m.CircleName)+"</b>", m.SenderRole)
+}
+
+// relayEscaper escapes the characters Telegram's HTML parse mode requires,
+// leaving the rest of what the sender wrote as it was.
+var relayEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// EscapeRelay is what the sender wrote as HTML that shows it exactly as
+// typed.
+func EscapeRelay(content string) string {
+	return relayEscaper.Replace(content)
+}
+
+// RelayText is the HTML text or caption of a relay: its header followed by
+// what the sender wrote, escaped so that it is shown exactly as typed.
+func (m Message) RelayText(content string) string {
+	if content == "" {
+		return m.RelayHeader()
+	}
+	return m.RelayHeader() + "\n\n" + EscapeRelay(content)
+}
+
+// RelayFits reports whether RelayText(content) stays within limit, so the
+// header and content can go out as one message.
+func (m Message) RelayFits(content string, limit int) bool {
+	return textLength(m.plainHeader())+textLength(content) <= limit
+}
+
+// plainHeader is the header and the blank line after it as Telegram counts
+// them, without markup.
+func (m Message) plainHeader() string {
+	return fmt.Sprintf(relayHeaderFormat, m.CircleName, m.SenderRole) + "\n\n"
+}
+
+// DeliveredRelayText is what the delivered text or caption of the relay
+// shows once its content is edited. A header sent on its own is left out;
+// one in front of the content that no longer fits with it is kept, and the
+// content is cut short instead.
+func (m Message) DeliveredRelayText(content string, limit int) string {
+	if len(m.DeliveredMessageIds) > 1 {
+		return EscapeRelay(content)
+	}
+	if m.RelayFits(content, limit) {
+		return m.RelayText(content)
+	}
+
+	room := limit - textLength(m.plainHeader()) - textLength("…")
+	for i, r := range content {
+		if room -= utf16.RuneLen(r); room < 0 {
+			content = content[:i]
+			break
+		}
+	}
+	return m.RelayText(content + "…")
+}
+
+// RecipientRole is what the recipient of a relay is to its sender.
+func (m Message) RecipientRole() string {
+	if m.SenderRole == "angel" {
+		return "mortal"
+	}
+	return "angel"
 }
@@ -0,0 +1,40 @@
+package models
+
+import "slices"
+
+// Role is what a user is to a circle. Roles are ordered: each can do
+// everything the roles below it can.
+type Role int
+
+const (
+	// RoleNone is anyone who isn't a member of the circle.
+	RoleNone Role = iota
+	RoleMember
+	RoleAdmin
+	RoleOwner
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleMember:
+		return "member"
+	case RoleAdmin:
+		return "admin"
+	case RoleOwner:
+		return "owner"
+	}
+	return "non-member"
+}
+
+// RoleOf returns the role userID has in the circle.
+func (circle Circle) RoleOf(userID int64) Role {
+	switch {
+	case circle.OwnerId == userID:
+		return RoleOwner
+	case !slices.Contains(circle.Members, userID):
+		return RoleNone
+	case slices.Contains(circle.Admins, userID):
+		return RoleAdmin
+	}
+	return RoleMember
+}
@@ -19,4 +19,6 @@ type Session struct {
 	Members   []int64       `bson:"members" json:"members"`
 	State     SessionState  `bson:"state" json:"state"`
 	CreatedAt time.Time     `bson:"time" json:"time"`
+	// Deadline is when the owner plans to end the session, if they set one.
+	Deadline *time.Time `bson:"deadline,omitempty" json:"deadline,omitempty"`
 }
@@ -1,21 +1,56 @@
 package models
 
+import (
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
 type UserState string
 
 const (
 	StateNone                       UserState = ""
 	StateWaitingCircleName          UserState = "waiting_circle_name"
-	StateWaitingJoinCircleName      UserState = "waiting_join_circle_name"
+	StateWaitingJoinInviteCode      UserState = "waiting_join_invite_code"
 	StateWaitingSendMessageToAngel  UserState = "waiting_send_message_to_angel"
 	StateWaitingSendMessageToMortal UserState = "waiting_send_message_to_mortal"
+	// In the chatting states every message the user sends is relayed until
+	// they exit or stay idle for too long.
+	StateChattingWithAngel  UserState = "chatting_with_angel"
+	StateChattingWithMortal UserState = "chatting_with_mortal"
+	// StateWaitingJoinCircleName is left over from joining circles by name.
+	// Users can still be in it, so it is handled like waiting for an invite.
+	StateWaitingJoinCircleName UserState = "waiting_join_circle_name"
 )
 
+// ChatStates are the states in which a user is chatting with their angel or
+// mortal.
+var ChatStates = []UserState{StateChattingWithAngel, StateChattingWithMortal}
+
 type User struct {
-	ID          int64     `bson:"_id" json:"id"`         // Telegram user ID as the primary key
-	ChatID      int64     `bson:"chat_id" json:"chatId"` // Chat ID (can differ from user ID, esp. groups)
-	FirstName   string    `bson:"first_name" json:"firstName"`
-	LastName    string    `bson:"last_name" json:"lastName"`
-	UserHandle  string    `bson:"user_handle" json:"userHandle"`
-	State       UserState `bson:"state" json:"state"`
-	StateCircle string    `bson:"stateCircle,omitempty" json:"stateCircle,omitempty"`
+	ID         int64     `bson:"_id" json:"id"`         // Telegram user ID as the primary key
+	ChatID     int64     `bson:"chat_id" json:"chatId"` // Chat ID (can differ from user ID, esp. groups)
+	FirstName  string    `bson:"first_name" json:"firstName"`
+	LastName   string    `bson:"last_name" json:"lastName"`
+	UserHandle string    `bson:"user_handle" json:"userHandle"`
+	State      UserState `bson:"state" json:"state"`
+	// StateCircleId is the circle the current state applies to, e.g. the
+	// circle whose angel a pending message is for.
+	StateCircleId bson.ObjectID `bson:"stateCircleId,omitempty" json:"stateCircleId,omitempty"`
+	// StateUpdatedAt is when the state was last set. Relaying a chat message
+	// sets the state again, so it also tracks chat activity.
+	StateUpdatedAt time.Time `bson:"stateUpdatedAt,omitempty" json:"stateUpdatedAt,omitempty"`
+}
+
+// DisplayName returns the user's full name followed by their @handle, if any.
+func (u User) DisplayName() string {
+	name := u.FirstName
+	if u.LastName != "" {
+		name += " " + u.LastName
+	}
+	if u.UserHandle != "" {
+		name += fmt.Sprintf(" (@%s)", u.UserHandle)
+	}
+	return name
 }
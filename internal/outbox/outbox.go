@@ -2,31 +2,62 @@ package outbox
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"grandfather/internal/config"
 	"grandfather/internal/db"
 	"grandfather/internal/models"
+	"grandfather/internal/sender"
+	"grandfather/internal/ui"
+	"grandfather/utils"
+	"os"
 	"time"
 
 	"github.com/go-telegram/bot"
 	tgModels "github.com/go-telegram/bot/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type Outbox struct {
-	stop chan struct{}
-	ctx  context.Context
-	bot  *bot.Bot
+	stop  chan struct{}
+	wake  chan struct{}
+	ctx   context.Context
+	bot   *bot.Bot
+	store db.Store
+	cfg   config.OutboxConfig
+	// owner identifies this instance in the leases it takes on messages.
+	owner string
 }
 
-func NewOutbox(ctx context.Context, b *bot.Bot) *Outbox {
-	o := &Outbox{stop: make(chan struct{})}
-	o.ctx = ctx
+func NewOutbox(ctx context.Context, b *bot.Bot, store db.Store, cfg config.OutboxConfig) *Outbox {
+	o := &Outbox{stop: make(chan struct{}), wake: make(chan struct{}, 1)}
+	// Deliveries yield to replies to what users are doing right now.
+	o.ctx = sender.WithPriority(ctx, sender.Bulk)
 	o.bot = b
+	o.store = store
+	o.cfg = cfg
+	o.owner = instanceName()
 	go o.run(ctx)
 	return o
 }
 
+// run polls for messages every PollInterval, and right away whenever the
+// store reports new ones. Polling still picks up retries that fell due and
+// covers stores that can't be watched.
 func (o *Outbox) run(ctx context.Context) {
+	watchCtx, cancelWatch := context.WithCancel(ctx)
+	defer cancelWatch()
+
+	if watcher, ok := o.store.(db.MessageWatcher); ok {
+		go o.watch(watchCtx, watcher)
+	}
+
+	ticker := time.NewTicker(o.cfg.PollInterval)
+	defer ticker.Stop()
+
 	for {
+		o.poll()
+
 		select {
 		case <-ctx.Done():
 			fmt.Println("Context done, stopping poll")
@@ -34,82 +65,366 @@ func (o *Outbox) run(ctx context.Context) {
 		case <-o.stop:
 			fmt.Println("Stop channel closed, stopping poll")
 			return
-		default:
-			o.poll()
-			time.Sleep(5 * time.Second)
+		case <-ticker.C:
+		case <-o.wake:
 		}
 	}
 }
 
+// watch wakes the outbox up whenever messages are queued. When the store
+// turns out not to support it, the outbox is left polling.
+func (o *Outbox) watch(ctx context.Context, watcher db.MessageWatcher) {
+	for {
+		err := watcher.WatchMessages(ctx, o.signal)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, db.ErrWatchUnsupported) {
+			fmt.Printf("Cannot watch for new messages, polling every %s instead: %s\n", o.cfg.PollInterval, err)
+			return
+		}
+
+		fmt.Printf("Watching for new messages failed, retrying in %s: %s\n", o.cfg.PollInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(o.cfg.PollInterval):
+		}
+	}
+}
+
+func (o *Outbox) signal() {
+	// A pending wake-up already covers this message.
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
 func (o *Outbox) Stop() {
 	close(o.stop)
 }
 
-func (o *Outbox) poll() []*models.Message {
+// poll delivers messages until none are due. Messages are claimed one at a
+// time, so several instances can share the queue without sending anything
+// twice.
+func (o *Outbox) poll() {
 	fmt.Println("Polling for messages")
 
-	messages, getMessagesErr := db.GetUndeliveredMessages(o.ctx)
+	for {
+		select {
+		case <-o.ctx.Done():
+			return
+		case <-o.stop:
+			return
+		default:
+		}
+
+		message, claimErr := o.store.ClaimMessage(o.ctx, o.owner, o.cfg.LeaseDuration)
+		if errors.Is(claimErr, db.ErrNotFound) {
+			return
+		}
+		if claimErr != nil {
+			fmt.Printf("There was an error claiming a message: %s\n", claimErr)
+			return
+		}
+
+		// The message is retried once the lease runs out.
+		user, getUserErr := o.store.GetUser(o.ctx, message.RecepientId)
+		if getUserErr != nil {
+			fmt.Printf("There was an error getting the recipient of message %s: %s\n", message.ID.Hex(), getUserErr)
+			return
+		}
+
+		if deliverMessageErr := o.deliverMessage(message, user); deliverMessageErr != nil {
+			fmt.Printf("Delivering message error: %s\n", deliverMessageErr)
+		}
+	}
+}
 
-	if getMessagesErr != nil {
-		fmt.Printf("There was an error getting undelivered messages: %s\n", getMessagesErr)
+func (o Outbox) deliverMessage(message *models.Message, user *models.User) error {
+	// 1. Send it to the recipient, on a copy of the outbox whose context
+	// ends if the lease is lost
+	sending := o
+	var stopRenewing context.CancelFunc
+	sending.ctx, stopRenewing = o.renewLease(message)
+
+	var deliveredIds []int
+	var err error
+	switch {
+	case user == nil:
+		err = errUnknownRecipient
+	case message.Kind == models.KindNotification:
+		deliveredIds, err = sending.sendNotification(message, user.ChatID)
+	default:
+		deliveredIds, err = sending.sendRelay(message, user.ChatID)
+	}
+	leaseLost := errors.Is(context.Cause(sending.ctx), errLeaseLost)
+	stopRenewing()
+	if err != nil && leaseLost {
+		// Whoever took the message over sends it.
+		return fmt.Errorf("lost the lease on message %s while sending it: %w", message.ID.Hex(), err)
+	}
+	if err != nil {
+		var chatID int64
+		if user != nil {
+			chatID = user.ChatID
+		}
+		o.recordFailure(message, chatID, err)
+		return fmt.Errorf("failed to send telegram message: %w", err)
+	}
+
+	// 2. Update state in DB to "delivered"
+	updateMessageErr := o.store.UpdateMessageToDelivered(o.ctx, message.ID, o.owner, deliveredIds)
+	if errors.Is(updateMessageErr, db.ErrNotFound) {
+		o.leaseLost(message, user.ChatID, deliveredIds)
 		return nil
 	}
+	if updateMessageErr != nil {
+		return fmt.Errorf("update message state: %w", updateMessageErr)
+	}
+
+	// 3. Catch up with edits made while it was being sent, and tell the
+	// sender it arrived
+	o.catchUp(message, user.ChatID)
+
+	return nil
+}
+
+// catchUp brings a relay that was just delivered up to date: the copy sent
+// shows what the sender wrote when it was claimed, so an edit made since is
+// applied to it now. The sender's confirmation then says it arrived.
+func (o Outbox) catchUp(message *models.Message, chatID int64) {
+	if message.Kind == models.KindNotification {
+		return
+	}
+	current, err := o.store.GetMessage(o.ctx, message.ID)
+	if err != nil {
+		fmt.Printf("There was an error reloading message %s: %s\n", message.ID.Hex(), err)
+		return
+	}
+
+	sent, now := message.Payload, current.Payload
+	if sent != nil && now != nil && (sent.Text != now.Text || sent.Caption != now.Caption) {
+		if err := utils.EditRelay(o.ctx, o.bot, chatID, current); err != nil {
+			fmt.Printf("There was an error applying an edit to message %s: %s\n", message.ID.Hex(), err)
+		}
+	}
+	utils.EditConfirmation(o.ctx, o.bot, current)
+}
+
+var errLeaseLost = errors.New("lease lost")
+
+// renewLease keeps the lease on message for as long as it is being sent,
+// which rate limits can make take longer than LeaseDuration, so that no
+// other instance takes it over and sends it again. The returned context
+// ends with errLeaseLost if the lease is lost anyway; calling the returned
+// function stops renewing.
+func (o Outbox) renewLease(message *models.Message) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(o.ctx)
+
+	go func() {
+		ticker := time.NewTicker(max(o.cfg.LeaseDuration/3, time.Millisecond))
+		defer ticker.Stop()
 
-	userIds := []int64{}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			err := o.store.ExtendMessageLease(ctx, message.ID, o.owner, o.cfg.LeaseDuration)
+			if errors.Is(err, db.ErrNotFound) {
+				cancel(errLeaseLost)
+				return
+			}
+			// The next renewal may still make it in time.
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("There was an error renewing the lease on message %s: %s\n", message.ID.Hex(), err)
+			}
+		}
+	}()
+
+	return ctx, func() { cancel(nil) }
+}
+
+// updateConfirmation edits the sender's confirmation of a relay to show
+// where it is now.
+func (o Outbox) updateConfirmation(message *models.Message) {
+	if message.Kind == models.KindNotification {
+		return
+	}
+	// The confirmation may have been stored since the message was claimed.
+	current, err := o.store.GetMessage(o.ctx, message.ID)
+	if err != nil {
+		fmt.Printf("There was an error reloading message %s: %s\n", message.ID.Hex(), err)
+		return
+	}
+	utils.EditConfirmation(o.ctx, o.bot, current)
+}
+
+// leaseLost handles a message that stopped being ours while it was sent.
+// If its sender unsent it meanwhile, the copy that just went out is deleted
+// again.
+func (o Outbox) leaseLost(message *models.Message, chatID int64, deliveredIds []int) {
+	current, err := o.store.GetMessage(o.ctx, message.ID)
+	if err != nil {
+		fmt.Printf("There was an error reloading message %s: %s\n", message.ID.Hex(), err)
+		return
+	}
+	if current.MessageState != models.Unsent {
+		fmt.Printf("Lost the lease on message %s while sending it, it is now %s\n", message.ID.Hex(), current.MessageState)
+		return
+	}
 
-	for _, message := range messages {
-		userIds = append(userIds, message.RecepientId)
+	if _, err := o.bot.DeleteMessages(o.ctx, &bot.DeleteMessagesParams{ChatID: chatID, MessageIDs: deliveredIds}); err != nil {
+		fmt.Printf("There was an error deleting unsent message %s: %s\n", message.ID.Hex(), err)
 	}
-	usersArr, getUsersErr := db.GetUsers(o.ctx, userIds)
+}
 
-	if getUsersErr != nil {
-		fmt.Printf("There was an error getting the users for the receipient messages: %s\n", getUsersErr)
+func (o Outbox) sendNotification(message *models.Message, chatID int64) ([]int, error) {
+	params := &bot.SendMessageParams{
+		ChatID:    chatID,
+		Text:      message.Message,
+		ParseMode: tgModels.ParseMode(message.ParseMode),
+	}
+	if len(message.Buttons) > 0 {
+		params.ReplyMarkup = ui.Menu{Buttons: message.Buttons}.ToInlineKeyboard()
 	}
 
-	users := map[int64]*models.User{}
+	sent, err := o.bot.SendMessage(o.ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return []int{sent.ID}, nil
+}
 
-	for _, user := range usersArr {
-		users[user.ID] = user
+// sendRelay sends an angel's or mortal's message under a header naming only
+// their role, so the recipient never sees who wrote it. It returns the IDs
+// of the messages it sent.
+func (o Outbox) sendRelay(message *models.Message, chatID int64) ([]int, error) {
+	payload := message.Payload
+	if payload == nil {
+		payload = &models.Payload{Type: models.PayloadText, Text: message.Message}
 	}
 
-	deliveredCount := 0
+	// Answers thread onto the message they answer, which is still in the
+	// recipient's chat unless they deleted it.
+	var replyTo *tgModels.ReplyParameters
+	if message.ReplyToMessageId != 0 {
+		replyTo = &tgModels.ReplyParameters{MessageID: message.ReplyToMessageId, AllowSendingWithoutReply: true}
+	}
+	// Lets the recipient tell the sender they saw it.
+	markup := ui.Menu{Buttons: message.RecipientButtons()}.ToInlineKeyboard()
 
-	for _, message := range messages {
-		deliverMessageErr := o.deliverMessage(message, users[message.RecepientId])
-		if deliverMessageErr != nil {
-			fmt.Printf("Delivering message error: %s", deliverMessageErr)
-		} else {
-			deliveredCount++
+	content, limit := payload.Caption, models.MaxCaptionLength
+	if payload.Type == models.PayloadText {
+		content, limit = payload.Text, models.MaxTextLength
+	}
+	// Relays are HTML with the sender's words escaped, so whatever they type
+	// is shown as is and can't make Telegram reject the message. The header
+	// goes in front of them unless that would make the message too long or
+	// the message can't carry a caption of ours, in which case it is sent
+	// first on its own.
+	uncaptioned := payload.Type == models.PayloadSticker || payload.Type == models.PayloadLocation || payload.Type == models.PayloadCopy
+	var headerId int
+	caption := message.RelayText(content)
+	if uncaptioned || len(message.DeliveredMessageIds) > 0 || !message.RelayFits(content, limit) {
+		var err error
+		if headerId, err = o.sendHeader(message, chatID, replyTo); err != nil {
+			return nil, err
 		}
+		caption, replyTo = models.EscapeRelay(content), nil
 	}
+	file := &tgModels.InputFileString{Data: payload.FileID}
 
-	return []*models.Message{}
+	var sent *tgModels.Message
+	var err error
+	switch payload.Type {
+	case models.PayloadText:
+		sent, err = o.bot.SendMessage(o.ctx, &bot.SendMessageParams{
+			ChatID:          chatID,
+			Text:            caption,
+			ParseMode:       tgModels.ParseModeHTML,
+			ReplyParameters: replyTo,
+			ReplyMarkup:     markup,
+		})
+	case models.PayloadPhoto:
+		sent, err = o.bot.SendPhoto(o.ctx, &bot.SendPhotoParams{ChatID: chatID, Photo: file, Caption: caption, ParseMode: tgModels.ParseModeHTML, ReplyParameters: replyTo, ReplyMarkup: markup})
+	case models.PayloadVoice:
+		sent, err = o.bot.SendVoice(o.ctx, &bot.SendVoiceParams{ChatID: chatID, Voice: file, Caption: caption, ParseMode: tgModels.ParseModeHTML, ReplyParameters: replyTo, ReplyMarkup: markup})
+	case models.PayloadVideo:
+		sent, err = o.bot.SendVideo(o.ctx, &bot.SendVideoParams{ChatID: chatID, Video: file, Caption: caption, ParseMode: tgModels.ParseModeHTML, ReplyParameters: replyTo, ReplyMarkup: markup})
+	case models.PayloadDocument:
+		sent, err = o.bot.SendDocument(o.ctx, &bot.SendDocumentParams{ChatID: chatID, Document: file, Caption: caption, ParseMode: tgModels.ParseModeHTML, ReplyParameters: replyTo, ReplyMarkup: markup})
+	case models.PayloadSticker, models.PayloadLocation, models.PayloadCopy:
+		id, err := o.sendUncaptioned(payload, chatID, markup)
+		if err != nil {
+			return nil, err
+		}
+		return []int{headerId, id}, nil
+	default:
+		err = fmt.Errorf("unknown payload type %q", payload.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if headerId != 0 {
+		return []int{headerId, sent.ID}, nil
+	}
+	return []int{sent.ID}, nil
 }
 
-func (o Outbox) deliverMessage(message *models.Message, user *models.User) error {
-	// 1. Construct the Telegram message payload
-	text := fmt.Sprintf(
-		"✉️ You received a new message in circle *%s* from your %s:\n\n%s",
-		message.CircleName,
-		message.SenderRole,
-		message.Message,
-	)
-
-	// 2. Send it to the recipient
-	_, err := o.bot.SendMessage(o.ctx, &bot.SendMessageParams{
-		ChatID:    user.ChatID,
-		Text:      text,
-		ParseMode: tgModels.ParseModeMarkdown, // or MarkdownV2/HTML
-	})
+// sendHeader sends the relay's header as a message of its own and returns
+// its ID. A header an earlier attempt sent is not sent again.
+func (o Outbox) sendHeader(message *models.Message, chatID int64, replyTo *tgModels.ReplyParameters) (int, error) {
+	if len(message.DeliveredMessageIds) > 0 {
+		return message.DeliveredMessageIds[0], nil
+	}
+
+	sent, err := o.bot.SendMessage(o.ctx, &bot.SendMessageParams{ChatID: chatID, Text: message.RelayHeader(), ParseMode: tgModels.ParseModeHTML, ReplyParameters: replyTo})
 	if err != nil {
-		return fmt.Errorf("failed to send telegram message: %w", err)
+		return 0, err
 	}
+	// Should this fail, the worst case is that a retry sends it again.
+	if err := o.store.RecordMessageHeader(o.ctx, message.ID, o.owner, sent.ID); err != nil {
+		fmt.Printf("There was an error recording the header of message %s: %s\n", message.ID.Hex(), err)
+	}
+	message.DeliveredMessageIds = []int{sent.ID}
+	return sent.ID, nil
+}
 
-	// 3. Update state in DB to "delivered"
-	updateMessageErr := db.UpdateMessageToDelivered(o.ctx, message.ID)
-	if updateMessageErr != nil {
-		return fmt.Errorf("update message state: %w", updateMessageErr)
+func (o Outbox) sendUncaptioned(payload *models.Payload, chatID int64, markup tgModels.ReplyMarkup) (int, error) {
+	switch payload.Type {
+	case models.PayloadSticker:
+		sent, err := o.bot.SendSticker(o.ctx, &bot.SendStickerParams{ChatID: chatID, Sticker: &tgModels.InputFileString{Data: payload.FileID}, ReplyMarkup: markup})
+		if err != nil {
+			return 0, err
+		}
+		return sent.ID, nil
+	case models.PayloadLocation:
+		sent, err := o.bot.SendLocation(o.ctx, &bot.SendLocationParams{ChatID: chatID, Latitude: payload.Latitude, Longitude: payload.Longitude, ReplyMarkup: markup})
+		if err != nil {
+			return 0, err
+		}
+		return sent.ID, nil
+	default:
+		// copyMessage, unlike forwarding, doesn't link back to the sender.
+		copied, err := o.bot.CopyMessage(o.ctx, &bot.CopyMessageParams{ChatID: chatID, FromChatID: payload.SourceChatID, MessageID: payload.SourceMessageID, ReplyMarkup: markup})
+		if err != nil {
+			return 0, err
+		}
+		return copied.ID, nil
 	}
+}
 
-	return nil
+// instanceName is a lease owner that is unique to this process, prefixed
+// with the host name to tell replicas apart in the database.
+func instanceName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "outbox"
+	}
+	return host + "-" + bson.NewObjectID().Hex()
 }
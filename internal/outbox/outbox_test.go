@@ -0,0 +1,376 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"grandfather/internal/config"
+	"grandfather/internal/db"
+	"grandfather/internal/models"
+	"grandfather/internal/outbox"
+	"grandfather/internal/telegramtest"
+
+	tgModels "github.com/go-telegram/bot/models"
+)
+
+// newRecipient registers a user whose private chat has the same ID.
+func newRecipient(t *testing.T, store *db.MemoryStore, id int64) {
+	t.Helper()
+
+	if _, err, _ := store.CreateUser(context.Background(), &tgModels.User{ID: id, FirstName: "Alice"}, id); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+}
+
+func queue(t *testing.T, store *db.MemoryStore, recipient int64, text string) *models.Message {
+	t.Helper()
+
+	message, err := store.CreateMessage(context.Background(), &models.Message{
+		SenderId:    7,
+		RecepientId: recipient,
+		CircleName:  "Book Club",
+		SenderRole:  "angel",
+		Payload:     &models.Payload{Type: models.PayloadText, Text: text},
+	})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	return message
+}
+
+func startOutbox(t *testing.T, th *telegramtest.Harness, store db.Store, cfg config.OutboxConfig) {
+	t.Helper()
+
+	ob := outbox.NewOutbox(context.Background(), th.Bot, store, cfg)
+	t.Cleanup(ob.Stop)
+}
+
+func waitUntilDelivered(t *testing.T, store *db.MemoryStore) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		pending, _ := store.GetUndeliveredMessages(context.Background())
+		if len(pending) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages were never delivered", len(pending))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWatchedStoreDeliversWithoutWaitingForPoll(t *testing.T) {
+	th := telegramtest.New(t)
+	store := db.NewMemoryStore()
+
+	newRecipient(t, store, 42)
+
+	// The first poll runs straight away, so only a watcher can deliver
+	// anything queued after it.
+	cfg := config.Default().Outbox
+	cfg.PollInterval = time.Hour
+	startOutbox(t, th, store, cfg)
+	time.Sleep(50 * time.Millisecond)
+
+	queue(t, store, 42, "good morning")
+
+	if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == 42 && strings.HasSuffix(c.Text(), "good morning")
+	}); !ok {
+		t.Fatal("the message was not delivered before the next poll")
+	}
+}
+
+func TestReplicasDeliverEachMessageOnce(t *testing.T) {
+	th := telegramtest.New(t)
+	store := db.NewMemoryStore()
+	newRecipient(t, store, 42)
+
+	const count = 50
+	for i := range count {
+		queue(t, store, 42, fmt.Sprintf("message %d", i))
+	}
+
+	cfg := config.Default().Outbox
+	cfg.PollInterval = 10 * time.Millisecond
+	for range 3 {
+		startOutbox(t, th, store, cfg)
+	}
+	waitUntilDelivered(t, store)
+
+	seen := map[string]int{}
+	for _, c := range th.Server.CallsTo("sendMessage", 42) {
+		seen[c.Text()]++
+	}
+	if len(seen) != count {
+		t.Errorf("delivered %d distinct messages, want %d", len(seen), count)
+	}
+	for text, n := range seen {
+		if n != 1 {
+			t.Errorf("%q was delivered %d times", text, n)
+		}
+	}
+}
+
+func TestExpiredLeasesAreTakenOver(t *testing.T) {
+	th := telegramtest.New(t)
+	store := db.NewMemoryStore()
+	ctx := context.Background()
+	newRecipient(t, store, 42)
+
+	// Another replica claimed the message and died before sending it.
+	queue(t, store, 42, "still coming")
+	claimed, err := store.ClaimMessage(ctx, "crashed", time.Millisecond)
+	if err != nil {
+		t.Fatalf("ClaimMessage: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	cfg := config.Default().Outbox
+	cfg.PollInterval = 10 * time.Millisecond
+	startOutbox(t, th, store, cfg)
+
+	if _, ok := th.Server.WaitFor(2*time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == 42 && strings.HasSuffix(c.Text(), "still coming")
+	}); !ok {
+		t.Fatal("the abandoned message was never delivered")
+	}
+	waitUntilDelivered(t, store)
+
+	// The crashed replica can no longer touch it.
+	if err := store.UpdateMessageToDelivered(ctx, claimed.ID, "crashed", []int{1}); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("UpdateMessageToDelivered with a lost lease = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSlowSendsKeepTheirLease(t *testing.T) {
+	th := telegramtest.New(t)
+	store := db.NewMemoryStore()
+	newRecipient(t, store, 42)
+
+	// Sending takes several leases' worth of time, as waiting out a rate
+	// limit can.
+	th.Server.SlowSends(42, 300*time.Millisecond)
+	queue(t, store, 42, "worth the wait")
+
+	cfg := config.Default().Outbox
+	cfg.PollInterval = 10 * time.Millisecond
+	cfg.LeaseDuration = 50 * time.Millisecond
+	for range 2 {
+		startOutbox(t, th, store, cfg)
+	}
+	waitUntilDelivered(t, store)
+
+	if sent := th.Server.CallsTo("sendMessage", 42); len(sent) != 1 {
+		t.Errorf("the message was sent %d times, want once", len(sent))
+	}
+}
+
+func TestFormattingCharactersAreRelayedAsTyped(t *testing.T) {
+	th := telegramtest.New(t)
+	store := db.NewMemoryStore()
+	ctx := context.Background()
+	newRecipient(t, store, 42)
+
+	queue(t, store, 42, "snake_case *text <3")
+	if _, err := store.CreateMessage(ctx, &models.Message{
+		SenderId:    7,
+		RecepientId: 42,
+		CircleName:  "Book_Club",
+		SenderRole:  "angel",
+		Payload:     &models.Payload{Type: models.PayloadPhoto, FileID: "photo", Caption: "[draft"},
+	}); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	cfg := config.Default().Outbox
+	cfg.PollInterval = 10 * time.Millisecond
+	startOutbox(t, th, store, cfg)
+	waitUntilDelivered(t, store)
+
+	for _, c := range th.Server.Calls() {
+		if c.Failed {
+			t.Errorf("%s to chat %d failed: %q", c.Method, c.ChatID(), c.Text()+c.Params["caption"])
+		}
+	}
+	if _, ok := th.Server.WaitFor(time.Second, func(c telegramtest.Call) bool {
+		return c.ChatID() == 42 && strings.HasSuffix(c.Text(), "snake_case *text &lt;3")
+	}); !ok {
+		t.Error("the text was not delivered as typed")
+	}
+	if _, ok := th.Server.WaitFor(time.Second, func(c telegramtest.Call) bool {
+		return c.Method == "sendPhoto" && strings.HasSuffix(c.Params["caption"], "[draft")
+	}); !ok {
+		t.Error("the caption was not delivered as typed")
+	}
+}
+
+func TestOnlyRecipientFailuresArePermanent(t *testing.T) {
+	for _, tt := range []struct {
+		description  string
+		code         int
+		wantAttempts int
+	}{
+		{"Forbidden: bot was blocked by the user", 403, 1},
+		{"Bad Request: chat not found", 400, 1},
+		{"Bad Request: message is too long", 400, 3},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			th := telegramtest.New(t)
+			store := db.NewMemoryStore()
+			newRecipient(t, store, 42)
+			th.Server.FailSends(42, tt.code, tt.description)
+			queued := queue(t, store, 42, "hello?")
+
+			cfg := config.Default().Outbox
+			cfg.PollInterval = 10 * time.Millisecond
+			cfg.RetryBaseDelay = time.Millisecond
+			cfg.MaxAttempts = 3
+			startOutbox(t, th, store, cfg)
+			waitUntilDelivered(t, store)
+
+			message, err := store.GetMessage(context.Background(), queued.ID)
+			if err != nil {
+				t.Fatalf("GetMessage: %v", err)
+			}
+			if message.MessageState != models.Failed || message.Attempts != tt.wantAttempts {
+				t.Errorf("state = %q after %d attempts, want %q after %d", message.MessageState, message.Attempts, models.Failed, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetriesDontRepeatTheHeader(t *testing.T) {
+	th := telegramtest.New(t)
+	store := db.NewMemoryStore()
+	newRecipient(t, store, 42)
+	th.Server.FailCalls(42, "sendSticker", 500, "Internal Server Error")
+
+	queued, err := store.CreateMessage(context.Background(), &models.Message{
+		SenderId:    7,
+		RecepientId: 42,
+		CircleName:  "Book Club",
+		SenderRole:  "angel",
+		Payload:     &models.Payload{Type: models.PayloadSticker, FileID: "sticker"},
+	})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	cfg := config.Default().Outbox
+	cfg.PollInterval = 10 * time.Millisecond
+	cfg.RetryBaseDelay = time.Millisecond
+	cfg.MaxAttempts = 3
+	startOutbox(t, th, store, cfg)
+	waitUntilDelivered(t, store)
+
+	if message, _ := store.GetMessage(context.Background(), queued.ID); message.Attempts != 3 {
+		t.Fatalf("the sticker was attempted %d times, want 3", message.Attempts)
+	}
+	var headers []telegramtest.Call
+	for _, c := range th.Server.CallsTo("sendMessage", 42) {
+		if !c.Failed {
+			headers = append(headers, c)
+		}
+	}
+	if len(headers) != 1 {
+		t.Fatalf("the header was sent %d times, want once", len(headers))
+	}
+
+	// Once the sticker is given up on, its header goes too.
+	if _, ok := th.Server.WaitFor(time.Second, func(c telegramtest.Call) bool {
+		return c.Method == "deleteMessages" && c.ChatID() == 42 && strings.Contains(c.Params["message_ids"], fmt.Sprint(headers[0].MessageID))
+	}); !ok {
+		t.Errorf("the header %d was not deleted", headers[0].MessageID)
+	}
+}
+
+func TestRelaysNearTheLimitSendTheHeaderApart(t *testing.T) {
+	th := telegramtest.New(t)
+	store := db.NewMemoryStore()
+	newRecipient(t, store, 42)
+
+	// The escaped "<" is still one character once Telegram parses it.
+	text := strings.Repeat("<", models.MaxTextLength)
+	caption := strings.Repeat("é", models.MaxCaptionLength)
+	queue(t, store, 42, text)
+	if _, err := store.CreateMessage(context.Background(), &models.Message{
+		SenderId:    7,
+		RecepientId: 42,
+		CircleName:  "Book Club",
+		SenderRole:  "angel",
+		Payload:     &models.Payload{Type: models.PayloadPhoto, FileID: "photo", Caption: caption},
+	}); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	cfg := config.Default().Outbox
+	cfg.PollInterval = 10 * time.Millisecond
+	startOutbox(t, th, store, cfg)
+	waitUntilDelivered(t, store)
+
+	for _, c := range th.Server.Calls() {
+		if c.Failed {
+			t.Fatalf("%s to chat %d failed", c.Method, c.ChatID())
+		}
+	}
+	if _, ok := th.Server.WaitFor(time.Second, func(c telegramtest.Call) bool {
+		return c.Method == "sendMessage" && c.Text() == models.EscapeRelay(text)
+	}); !ok {
+		t.Error("the text was not sent on its own")
+	}
+	if _, ok := th.Server.WaitFor(time.Second, func(c telegramtest.Call) bool {
+		return c.Method == "sendPhoto" && c.Params["caption"] == caption
+	}); !ok {
+		t.Error("the caption was not sent on its own")
+	}
+	var headers int
+	for _, c := range th.Server.CallsTo("sendMessage", 42) {
+		if strings.HasPrefix(c.Text(), "✉️") && !strings.Contains(c.Text(), "\n") {
+			headers++
+		}
+	}
+	if headers != 2 {
+		t.Errorf("%d headers were sent on their own, want 2", headers)
+	}
+}
+
+func TestEditsWhileSendingAreApplied(t *testing.T) {
+	th := telegramtest.New(t)
+	store := db.NewMemoryStore()
+	ctx := context.Background()
+	newRecipient(t, store, 42)
+	th.Server.SlowSends(42, 100*time.Millisecond)
+	queued := queue(t, store, 42, "see you at 7")
+
+	cfg := config.Default().Outbox
+	cfg.PollInterval = 10 * time.Millisecond
+	startOutbox(t, th, store, cfg)
+
+	// The sender edits it after the outbox read it but before it arrived.
+	for deadline := time.Now().Add(time.Second); ; {
+		if message, _ := store.GetMessage(ctx, queued.ID); message.MessageState == models.Sending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the message was never claimed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := store.UpdateMessagePayload(ctx, queued.ID, models.Payload{Type: models.PayloadText, Text: "see you at 8"}); err != nil {
+		t.Fatalf("UpdateMessagePayload: %v", err)
+	}
+	waitUntilDelivered(t, store)
+
+	if _, ok := th.Server.WaitFor(time.Second, func(c telegramtest.Call) bool {
+		return c.Method == "editMessageText" && c.ChatID() == 42 && strings.HasSuffix(c.Text(), "see you at 8")
+	}); !ok {
+		t.Error("the edit never reached the delivered copy")
+	}
+}
@@ -0,0 +1,110 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"grandfather/internal/models"
+	"grandfather/utils"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	tgModels "github.com/go-telegram/bot/models"
+)
+
+// excerptLength is how much of an undeliverable message its sender is
+// reminded of.
+const excerptLength = 200
+
+// errUnknownRecipient is returned for messages to users who are no longer
+// registered.
+var errUnknownRecipient = errors.New("recipient is not registered")
+
+// recipientGone are the bad requests that mean the recipient's chat is gone,
+// rather than that something was wrong with one attempt.
+var recipientGone = []string{"chat not found", "user not found", "PEER_ID_INVALID"}
+
+// isPermanent reports whether sending again cannot succeed, e.g. because the
+// recipient blocked the bot or their chat no longer exists. Other bad
+// requests are retried like any failure until MaxAttempts.
+func isPermanent(err error) bool {
+	if errors.Is(err, errUnknownRecipient) || errors.Is(err, bot.ErrorForbidden) {
+		return true
+	}
+	if errors.Is(err, bot.ErrorBadRequest) {
+		for _, description := range recipientGone {
+			if strings.Contains(err.Error(), description) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryDelay is how long to wait before the attempt after the given number of
+// failed ones. It doubles with every attempt, but never undercuts a flood
+// wait Telegram asked for.
+func (o Outbox) retryDelay(attempts int, err error) time.Duration {
+	delay := o.cfg.RetryBaseDelay
+	for i := 1; i < attempts && delay < o.cfg.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, o.cfg.RetryMaxDelay)
+
+	var tooMany *bot.TooManyRequestsError
+	if errors.As(err, &tooMany) {
+		delay = max(delay, time.Duration(tooMany.RetryAfter)*time.Second)
+	}
+	return delay
+}
+
+// recordFailure schedules message for another attempt or, once retrying is
+// pointless, marks it as failed and tells its sender. chatID is the
+// recipient's chat, if they are still registered.
+func (o Outbox) recordFailure(message *models.Message, chatID int64, err error) {
+	attempts := message.Attempts + 1
+
+	if !isPermanent(err) && attempts < o.cfg.MaxAttempts {
+		nextAttemptAt := time.Now().Add(o.retryDelay(attempts, err))
+		if scheduleErr := o.store.ScheduleMessageRetry(o.ctx, message.ID, o.owner, attempts, nextAttemptAt, err.Error()); scheduleErr != nil {
+			fmt.Printf("There was an error scheduling a retry of message %s: %s\n", message.ID.Hex(), scheduleErr)
+		}
+		return
+	}
+
+	if failErr := o.store.UpdateMessageToFailed(o.ctx, message.ID, o.owner, attempts, err.Error()); failErr != nil {
+		fmt.Printf("There was an error marking message %s as failed: %s\n", message.ID.Hex(), failErr)
+		return
+	}
+	fmt.Printf("Giving up on message %s after %d attempts: %s\n", message.ID.Hex(), attempts, err)
+	o.updateConfirmation(message)
+
+	// A header sent ahead of content that never arrived would be left
+	// dangling.
+	if len(message.DeliveredMessageIds) > 0 && chatID != 0 {
+		if _, deleteErr := o.bot.DeleteMessages(o.ctx, &bot.DeleteMessagesParams{ChatID: chatID, MessageIDs: message.DeliveredMessageIds}); deleteErr != nil {
+			fmt.Printf("There was an error deleting the header of failed message %s: %s\n", message.ID.Hex(), deleteErr)
+		}
+	}
+
+	// Nobody is waiting on the bot's own notifications.
+	if message.Kind != models.KindRelay || message.SenderId == 0 {
+		return
+	}
+
+	notice := &models.Message{
+		RecepientId: message.SenderId,
+		CircleName:  message.CircleName,
+		Message: fmt.Sprintf(
+			"⚠️ Your message to your %s in circle <b>%s</b> could not be delivered:\n\n<i>%s</i>",
+			message.RecipientRole(),
+			html.EscapeString(message.CircleName),
+			html.EscapeString(utils.Excerpt(message.Message, excerptLength)),
+		),
+		ParseMode: string(tgModels.ParseModeHTML),
+	}
+	if notifyErr := o.store.CreateNotifications(o.ctx, []*models.Message{notice}); notifyErr != nil {
+		fmt.Printf("There was an error telling user %d about failed message %s: %s\n", message.SenderId, message.ID.Hex(), notifyErr)
+	}
+}
@@ -0,0 +1,51 @@
+package sender
+
+import "time"
+
+// bucket is a token bucket that allows burst messages at once and then one
+// every interval. It only tracks when the next message would be on time if
+// messages went out exactly every interval (the generic cell rate
+// algorithm), which is equivalent but needs no refilling.
+type bucket struct {
+	interval time.Duration
+	burst    int
+	next     time.Time
+}
+
+// delay is how long a message would have to wait at now.
+func (b *bucket) delay(now time.Time) time.Duration {
+	next := b.next
+	if next.Before(now) {
+		next = now
+	}
+	return max(next.Sub(now)-time.Duration(b.burst-1)*b.interval, 0)
+}
+
+// take uses up a token.
+func (b *bucket) take(now time.Time) {
+	if b.next.Before(now) {
+		b.next = now
+	}
+	b.next = b.next.Add(b.interval)
+}
+
+// reserve takes a token and returns how long to wait before using it.
+func (b *bucket) reserve(now time.Time) time.Duration {
+	delay := b.delay(now)
+	b.take(now)
+	return delay
+}
+
+// pauseUntil makes every message wait until at least until.
+func (b *bucket) pauseUntil(until time.Time) {
+	blocked := until.Add(time.Duration(b.burst-1) * b.interval)
+	if b.next.Before(blocked) {
+		b.next = blocked
+	}
+}
+
+// idle reports whether the bucket is full again, so forgetting it changes
+// nothing.
+func (b *bucket) idle(now time.Time) bool {
+	return !b.next.After(now)
+}
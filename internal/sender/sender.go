@@ -0,0 +1,320 @@
+// Package sender keeps the bot under Telegram's flood limits. It sits
+// between the bot library and the network, so every message the handlers
+// and the outbox send goes through the same limits.
+package sender
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"grandfather/internal/config"
+
+	"github.com/go-telegram/bot"
+)
+
+// Priority orders requests waiting for the global limit.
+type Priority int
+
+const (
+	// Interactive requests answer something a user just did. They are the
+	// default.
+	Interactive Priority = iota
+	// Bulk requests, such as outbox deliveries, wait behind interactive ones.
+	Bulk
+)
+
+type priorityKey struct{}
+
+// WithPriority marks the requests made with ctx as having priority p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+func priorityOf(ctx context.Context) Priority {
+	p, _ := ctx.Value(priorityKey{}).(Priority)
+	return p
+}
+
+// limitedMethods are the Bot API methods that post a message and so count
+// towards Telegram's limits.
+var limitedMethods = map[string]bool{
+	"sendMessage":    true,
+	"sendPhoto":      true,
+	"sendAudio":      true,
+	"sendDocument":   true,
+	"sendVideo":      true,
+	"sendAnimation":  true,
+	"sendVoice":      true,
+	"sendVideoNote":  true,
+	"sendMediaGroup": true,
+	"sendLocation":   true,
+	"sendVenue":      true,
+	"sendContact":    true,
+	"sendPoll":       true,
+	"sendDice":       true,
+	"sendSticker":    true,
+	"copyMessage":    true,
+	"copyMessages":   true,
+	"forwardMessage": true,
+}
+
+// maxRetries is how often a request answered with 429 Too Many Requests is
+// sent again before the error is handed to the caller.
+const maxRetries = 3
+
+// pruneThreshold is how many chats are tracked before idle ones are
+// forgotten.
+const pruneThreshold = 1000
+
+// Sender is a bot.HttpClient that delays messages to stay within the
+// configured limits and retries them after the wait Telegram asks for.
+type Sender struct {
+	client bot.HttpClient
+	cfg    config.RateLimitConfig
+
+	mu     sync.Mutex
+	global bucket
+	chats  map[int64]*bucket
+	// queues hold the requests waiting for the global limit, by priority.
+	queues [2][]chan struct{}
+	wake   chan struct{}
+}
+
+var _ bot.HttpClient = (*Sender)(nil)
+
+// New wraps client. The dispatcher behind the global limit runs until ctx is
+// done.
+func New(ctx context.Context, client bot.HttpClient, cfg config.RateLimitConfig) *Sender {
+	s := &Sender{
+		client: client,
+		cfg:    cfg,
+		chats:  map[int64]*bucket{},
+		wake:   make(chan struct{}, 1),
+	}
+	if cfg.GlobalPerSecond > 0 {
+		s.global = bucket{interval: time.Second / time.Duration(cfg.GlobalPerSecond), burst: cfg.GlobalPerSecond}
+		go s.dispatch(ctx)
+	}
+	return s
+}
+
+func (s *Sender) Do(req *http.Request) (*http.Response, error) {
+	if !limitedMethods[path.Base(req.URL.Path)] {
+		return s.client.Do(req)
+	}
+
+	// The body is read once so the request can be repeated.
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	chatID := chatIDOf(req.Header.Get("Content-Type"), body)
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		if err := s.wait(ctx, chatID); err != nil {
+			return nil, err
+		}
+
+		attemptReq := req.Clone(ctx)
+		attemptReq.Body = io.NopCloser(bytes.NewReader(body))
+		attemptReq.ContentLength = int64(len(body))
+
+		resp, err := s.client.Do(attemptReq)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt == maxRetries {
+			return resp, err
+		}
+
+		retryAfter := retryAfterOf(resp)
+		resp.Body.Close()
+		if !s.pause(chatID, retryAfter) {
+			// Without limits there is nothing to pause, so wait right here.
+			if err := sleep(ctx, retryAfter); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// wait blocks until a message to chatID may be sent. A chatID of 0 is only
+// held to the global limit.
+func (s *Sender) wait(ctx context.Context, chatID int64) error {
+	if chatID != 0 && s.cfg.ChatInterval > 0 {
+		s.mu.Lock()
+		delay := s.chat(chatID).reserve(time.Now())
+		s.mu.Unlock()
+
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.GlobalPerSecond <= 0 {
+		return nil
+	}
+
+	ready := make(chan struct{})
+	p := priorityOf(ctx)
+
+	s.mu.Lock()
+	s.queues[p] = append(s.queues[p], ready)
+	s.mu.Unlock()
+	s.signal()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		s.queues[p] = slices.DeleteFunc(s.queues[p], func(c chan struct{}) bool { return c == ready })
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// dispatch hands out the global limit's tokens, always to the oldest
+// request of the highest priority.
+func (s *Sender) dispatch(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		waiting := len(s.queues[Interactive]) + len(s.queues[Bulk])
+		delay := s.global.delay(time.Now())
+		if waiting > 0 && delay == 0 {
+			s.global.take(time.Now())
+			for p := range s.queues {
+				if len(s.queues[p]) > 0 {
+					close(s.queues[p][0])
+					s.queues[p] = s.queues[p][1:]
+					break
+				}
+			}
+		}
+		s.mu.Unlock()
+
+		switch {
+		case waiting == 0:
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			}
+		case delay > 0:
+			// A more urgent request may arrive meanwhile, so the token is
+			// only given out once it is there.
+			if sleep(ctx, delay) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Sender) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pause holds back messages after Telegram answered with retry_after. The
+// pause applies to the chat when it is known and to every chat otherwise.
+// It returns false when no limit is configured that could be paused.
+func (s *Sender) pause(chatID int64, retryAfter time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until := time.Now().Add(retryAfter)
+	switch {
+	case chatID != 0 && s.cfg.ChatInterval > 0:
+		s.chat(chatID).pauseUntil(until)
+	case s.cfg.GlobalPerSecond > 0:
+		s.global.pauseUntil(until)
+	default:
+		return false
+	}
+	return true
+}
+
+// chat returns chatID's bucket. Callers must hold s.mu.
+func (s *Sender) chat(chatID int64) *bucket {
+	now := time.Now()
+	if len(s.chats) >= pruneThreshold {
+		for id, b := range s.chats {
+			if b.idle(now) {
+				delete(s.chats, id)
+			}
+		}
+	}
+
+	b, ok := s.chats[chatID]
+	if !ok {
+		b = &bucket{interval: s.cfg.ChatInterval, burst: s.cfg.ChatBurst}
+		s.chats[chatID] = b
+	}
+	return b
+}
+
+// chatIDOf finds the chat_id field of a multipart Bot API request. It
+// returns 0 when there is none or it names a channel by username.
+func chatIDOf(contentType string, body []byte) int64 {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return 0
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return 0
+		}
+		if part.FormName() != "chat_id" {
+			continue
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return 0
+		}
+		chatID, _ := strconv.ParseInt(string(value), 10, 64)
+		return chatID
+	}
+}
+
+// retryAfterOf reads how long a 429 response asks to wait, defaulting to a
+// second.
+func retryAfterOf(resp *http.Response) time.Duration {
+	var body struct {
+		Parameters struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Parameters.RetryAfter <= 0 {
+		return time.Second
+	}
+	return time.Duration(body.Parameters.RetryAfter) * time.Second
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
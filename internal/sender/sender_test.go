@@ -0,0 +1,124 @@
+package sender_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"grandfather/internal/config"
+	"grandfather/internal/sender"
+	"grandfather/internal/telegramtest"
+
+	"github.com/go-telegram/bot"
+)
+
+func newBot(t *testing.T, serverURL string, cfg config.RateLimitConfig) *bot.Bot {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	client := sender.New(ctx, &http.Client{Timeout: 5 * time.Second}, cfg)
+	b, err := bot.New(telegramtest.Token, bot.WithServerURL(serverURL), bot.WithSkipGetMe(), bot.WithHTTPClient(5*time.Second, client))
+	if err != nil {
+		t.Fatalf("create bot: %v", err)
+	}
+	return b
+}
+
+func TestChatLimitSpacesMessages(t *testing.T) {
+	srv := telegramtest.NewServer()
+	t.Cleanup(srv.Close)
+	b := newBot(t, srv.URL, config.RateLimitConfig{ChatInterval: 50 * time.Millisecond, ChatBurst: 2})
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := range 4 {
+		if _, err := b.SendMessage(ctx, &bot.SendMessageParams{ChatID: 1, Text: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+	}
+	// Two go out at once, the other two 50ms apart.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("4 messages to one chat took %s, want at least 100ms", elapsed)
+	}
+
+	// Other chats have their own allowance.
+	start = time.Now()
+	if _, err := b.SendMessage(ctx, &bot.SendMessageParams{ChatID: 2, Text: "hi"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("a message to another chat took %s, want no wait", elapsed)
+	}
+}
+
+func TestRetryAfterIsHonoured(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 1","parameters":{"retry_after":1}}`)
+			return
+		}
+		fmt.Fprint(w, `{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1,"type":"private"}}}`)
+	}))
+	t.Cleanup(srv.Close)
+	b := newBot(t, srv.URL, config.Default().Telegram.RateLimit)
+
+	start := time.Now()
+	if _, err := b.SendMessage(context.Background(), &bot.SendMessageParams{ChatID: 1, Text: "hi"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("the retry came after %s, want at least the second Telegram asked for", elapsed)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("server got %d requests, want 2", n)
+	}
+}
+
+func TestInteractiveRequestsGoFirst(t *testing.T) {
+	srv := telegramtest.NewServer()
+	t.Cleanup(srv.Close)
+	// A burst of 10, then one message every 100ms.
+	b := newBot(t, srv.URL, config.RateLimitConfig{GlobalPerSecond: 10})
+
+	bulk := sender.WithPriority(context.Background(), sender.Bulk)
+	var wg sync.WaitGroup
+	for i := range 15 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = b.SendMessage(bulk, &bot.SendMessageParams{ChatID: int64(100 + i), Text: "bulk"})
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(srv.Calls()) < 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("the burst never went out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := b.SendMessage(context.Background(), &bot.SendMessageParams{ChatID: 1, Text: "interactive"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	wg.Wait()
+
+	for i, c := range srv.Calls() {
+		if c.Text() == "interactive" {
+			if i > 10 {
+				t.Errorf("the interactive message went out %dth, behind %d bulk ones", i+1, i-10)
+			}
+			return
+		}
+	}
+	t.Fatal("the interactive message was never sent")
+}
@@ -0,0 +1,180 @@
+package telegramtest
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// Harness couples a fake server with a bot pointed at it. Updates are
+// processed synchronously, so every reply a handler sends has been recorded
+// by the time Send or Press returns.
+type Harness struct {
+	t      testing.TB
+	Server *Server
+	Bot    *bot.Bot
+
+	nextUpdateID atomic.Int64
+
+	mu sync.Mutex
+	// actedAt is how many calls had been recorded when each user's latest
+	// update started processing.
+	actedAt map[int64]int
+}
+
+func New(t testing.TB, opts ...bot.Option) *Harness {
+	t.Helper()
+
+	srv := NewServer()
+	t.Cleanup(srv.Close)
+
+	opts = append(opts, bot.WithServerURL(srv.URL), bot.WithNotAsyncHandlers())
+	b, err := bot.New(Token, opts...)
+	if err != nil {
+		t.Fatalf("create bot: %v", err)
+	}
+
+	return &Harness{t: t, Server: srv, Bot: b, actedAt: map[int64]int{}}
+}
+
+// NewUser returns a Telegram user whose private chat ID equals its user ID.
+func NewUser(id int64, firstName, username string) models.User {
+	return models.User{ID: id, FirstName: firstName, Username: username}
+}
+
+func privateChat(user models.User) models.Chat {
+	return models.Chat{ID: user.ID, Type: models.ChatTypePrivate, FirstName: user.FirstName, Username: user.Username}
+}
+
+func (h *Harness) process(from int64, update *models.Update) {
+	update.ID = h.nextUpdateID.Add(1)
+
+	h.mu.Lock()
+	h.actedAt[from] = len(h.Server.Calls())
+	h.mu.Unlock()
+
+	h.Bot.ProcessUpdate(context.Background(), update)
+}
+
+// Send delivers a text message from user. Text starting with "/" is marked
+// as a bot command the way Telegram does.
+func (h *Harness) Send(user models.User, text string) {
+	msg := &models.Message{
+		ID:   h.Server.NextMessageID(),
+		Date: int(time.Now().Unix()),
+		From: &user,
+		Chat: privateChat(user),
+		Text: text,
+	}
+
+	if strings.HasPrefix(text, "/") {
+		command, _, _ := strings.Cut(text, " ")
+		msg.Entities = []models.MessageEntity{{Type: models.MessageEntityTypeBotCommand, Offset: 0, Length: len(command)}}
+	}
+
+	h.process(user.ID, &models.Update{Message: msg})
+}
+
+// SendMessage delivers an arbitrary message from user, e.g. a photo.
+func (h *Harness) SendMessage(user models.User, msg models.Message) {
+	msg.From = &user
+	msg.Chat = privateChat(user)
+	if msg.ID == 0 {
+		msg.ID = h.Server.NextMessageID()
+	}
+	if msg.Date == 0 {
+		msg.Date = int(time.Now().Unix())
+	}
+	h.process(user.ID, &models.Update{Message: &msg})
+}
+
+// EditMessage delivers user's edit of a message they sent earlier. msg.ID
+// must be the ID of that message.
+func (h *Harness) EditMessage(user models.User, msg models.Message) {
+	msg.From = &user
+	msg.Chat = privateChat(user)
+	if msg.Date == 0 {
+		msg.Date = int(time.Now().Unix())
+	}
+	msg.EditDate = int(time.Now().Unix())
+	h.process(user.ID, &models.Update{EditedMessage: &msg})
+}
+
+// React simulates user reacting to messageID in their chat with emoji.
+func (h *Harness) React(user models.User, messageID int, emoji string) {
+	h.process(user.ID, &models.Update{MessageReaction: &models.MessageReactionUpdated{
+		Chat:      privateChat(user),
+		MessageID: messageID,
+		User:      &user,
+		Date:      int(time.Now().Unix()),
+		NewReaction: []models.ReactionType{{
+			Type:              models.ReactionTypeTypeEmoji,
+			ReactionTypeEmoji: &models.ReactionTypeEmoji{Type: models.ReactionTypeTypeEmoji, Emoji: emoji},
+		}},
+	}})
+}
+
+// Press simulates user tapping a button carrying data on messageID.
+func (h *Harness) Press(user models.User, data string, messageID int) {
+	h.process(user.ID, &models.Update{CallbackQuery: &models.CallbackQuery{
+		ID:   "cb",
+		From: user,
+		Data: data,
+		Message: models.MaybeInaccessibleMessage{
+			Type: models.MaybeInaccessibleMessageTypeMessage,
+			Message: &models.Message{
+				ID:   messageID,
+				Date: int(time.Now().Unix()),
+				Chat: privateChat(user),
+			},
+		},
+	}})
+}
+
+// PressButton taps the button labelled text on the most recent message in
+// user's chat that has one, failing the test if there is none.
+func (h *Harness) PressButton(user models.User, text string) {
+	h.t.Helper()
+
+	calls := h.Server.Calls()
+	for i := len(calls) - 1; i >= 0; i-- {
+		c := calls[i]
+		if c.ChatID() != user.ID {
+			continue
+		}
+		if data, ok := c.Button(text); ok {
+			h.Press(user, data, c.MessageID)
+			return
+		}
+	}
+	h.t.Fatalf("no button %q in chat %d", text, user.ID)
+}
+
+// LastText returns the text of the latest message sent or edited in user's chat.
+func (h *Harness) LastText(user models.User) string {
+	c, _ := h.Server.Last(user.ID)
+	return c.Text()
+}
+
+// TextsSinceLastAction returns the texts of messages sent or edited in user's
+// chat since the user's latest update. Besides the handler's replies this
+// can include notifications that raced with them.
+func (h *Harness) TextsSinceLastAction(user models.User) []string {
+	h.mu.Lock()
+	from := h.actedAt[user.ID]
+	h.mu.Unlock()
+
+	var texts []string
+	for _, c := range h.Server.Calls()[from:] {
+		if c.ChatID() == user.ID && (strings.HasPrefix(c.Method, "send") || strings.HasPrefix(c.Method, "edit")) {
+			texts = append(texts, c.Text())
+		}
+	}
+	return texts
+}
@@ -0,0 +1,374 @@
+// Package telegramtest provides a fake Telegram Bot API server for driving
+// the bot end to end in tests.
+package telegramtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	Token       = "123456:test-token"
+	BotUsername = "grandfather_test_bot"
+)
+
+// Call is a single Bot API request received by the fake server. Params holds
+// the multipart form fields exactly as the client sent them; structured
+// fields such as reply_markup arrive JSON encoded.
+type Call struct {
+	Method string
+	Params map[string]string
+	// MessageID is the message the call created or edited, if any.
+	MessageID int
+	// Failed is set when the server answered with an error, either one set
+	// up by FailSends or because the text's entities don't parse.
+	Failed bool
+}
+
+func (c Call) ChatID() int64 {
+	id, _ := strconv.ParseInt(c.Params["chat_id"], 10, 64)
+	return id
+}
+
+func (c Call) Text() string {
+	return c.Params["text"]
+}
+
+// Keyboard decodes the inline keyboard attached to the call, if any.
+func (c Call) Keyboard() [][]models.InlineKeyboardButton {
+	var markup models.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(c.Params["reply_markup"]), &markup); err != nil {
+		return nil
+	}
+	return markup.InlineKeyboard
+}
+
+// Button returns the callback data of the button labelled text.
+func (c Call) Button(text string) (string, bool) {
+	for _, row := range c.Keyboard() {
+		for _, btn := range row {
+			if btn.Text == text {
+				return btn.CallbackData, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Server is a fake Bot API. Point bot.New at it with bot.WithServerURL.
+type Server struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	calls         []Call
+	nextMessageID int
+	changed       chan struct{}
+	failures      map[failureKey]apiError
+	delays        map[int64]time.Duration
+}
+
+// failureKey picks the calls that fail. An empty method stands for every
+// send.
+type failureKey struct {
+	chatID int64
+	method string
+}
+
+type apiError struct {
+	code        int
+	description string
+}
+
+func NewServer() *Server {
+	s := &Server{nextMessageID: 1, changed: make(chan struct{}), failures: map[failureKey]apiError{}, delays: map[int64]time.Duration{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	prefix := "/bot" + Token + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, prefix)
+
+	params := map[string]string{}
+	if err := r.ParseMultipartForm(1 << 20); err == nil {
+		for key, values := range r.MultipartForm.Value {
+			params[key] = values[0]
+		}
+	}
+
+	call := Call{Method: method, Params: params}
+	s.mu.Lock()
+	delay := s.delays[call.ChatID()]
+	s.mu.Unlock()
+	if strings.HasPrefix(method, "send") || method == "copyMessage" {
+		time.Sleep(delay)
+	}
+
+	s.mu.Lock()
+	failure, fail := s.failures[failureKey{call.ChatID(), method}]
+	if !fail {
+		failure, fail = s.failures[failureKey{call.ChatID(), ""}]
+		fail = fail && (strings.HasPrefix(method, "send") || method == "copyMessage")
+	}
+	if err := checkEntities(params); !fail && err != nil {
+		failure, fail = apiError{code: http.StatusBadRequest, description: "Bad Request: can't parse entities: " + err.Error()}, true
+	}
+	if description := checkLength(params); !fail && description != "" {
+		failure, fail = apiError{code: http.StatusBadRequest, description: description}, true
+	}
+	var result any
+	if fail {
+		call.Failed = true
+	} else {
+		result = s.result(&call)
+	}
+	s.calls = append(s.calls, call)
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mu.Unlock()
+
+	if fail {
+		writeError(w, failure.code, failure.description)
+		return
+	}
+	writeResult(w, result)
+}
+
+// FailSends makes every message sent to chatID fail with the given Bot API
+// error, e.g. 403 "Forbidden: bot was blocked by the user". A code of 0
+// lets sends succeed again.
+func (s *Server) FailSends(chatID int64, code int, description string) {
+	s.FailCalls(chatID, "", code, description)
+}
+
+// FailCalls is FailSends for calls of a single method, e.g. "sendSticker".
+func (s *Server) FailCalls(chatID int64, method string, code int, description string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := failureKey{chatID, method}
+	if code == 0 {
+		delete(s.failures, key)
+		return
+	}
+	s.failures[key] = apiError{code: code, description: description}
+}
+
+// SlowSends makes every message sent to chatID take delay to go out, the
+// way waiting out rate limits does. A delay of 0 makes sends quick again.
+func (s *Server) SlowSends(chatID int64, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.delays[chatID] = delay
+}
+
+// htmlTags are the tags Telegram accepts in HTML formatted messages.
+var htmlTags = map[string]bool{
+	"b": true, "strong": true, "i": true, "em": true, "u": true, "ins": true,
+	"s": true, "strike": true, "del": true, "a": true, "code": true, "pre": true,
+	"span": true, "tg-spoiler": true, "tg-emoji": true, "blockquote": true,
+}
+
+// checkEntities rejects formatted text the way Telegram does when its
+// markup doesn't parse, so tests catch user content that isn't escaped.
+func checkEntities(params map[string]string) error {
+	for _, text := range []string{params["text"], params["caption"]} {
+		switch params["parse_mode"] {
+		case string(models.ParseModeMarkdown):
+			for _, marker := range []string{"_", "*", "`"} {
+				if strings.Count(text, marker)%2 != 0 {
+					return fmt.Errorf("can't find end of the entity starting with %q", marker)
+				}
+			}
+			if strings.Count(text, "[") != strings.Count(text, "]") {
+				return fmt.Errorf("can't find end of the link")
+			}
+		case string(models.ParseModeHTML):
+			var open []string
+			for rest := text; ; {
+				start := strings.IndexAny(rest, "<>")
+				if start < 0 {
+					break
+				}
+				end := strings.IndexByte(rest[start:], '>')
+				if rest[start] == '>' || end < 0 {
+					return fmt.Errorf("unexpected %q", rest[start])
+				}
+				tag := rest[start+1 : start+end]
+				rest = rest[start+end+1:]
+
+				name, closing := strings.CutPrefix(tag, "/")
+				name, _, _ = strings.Cut(name, " ")
+				if !htmlTags[name] {
+					return fmt.Errorf("unsupported start tag %q", name)
+				}
+				if !closing {
+					open = append(open, name)
+					continue
+				}
+				if len(open) == 0 || open[len(open)-1] != name {
+					return fmt.Errorf("unmatched end tag %q", name)
+				}
+				open = open[:len(open)-1]
+			}
+			if len(open) > 0 {
+				return fmt.Errorf("can't find end tag corresponding to start tag %q", open[len(open)-1])
+			}
+		}
+	}
+	return nil
+}
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// checkLength rejects text and captions longer than Telegram allows, which
+// it counts in UTF-16 code units of the text as shown.
+func checkLength(params map[string]string) string {
+	shownLength := func(text string) int {
+		if params["parse_mode"] == string(models.ParseModeHTML) {
+			text = html.UnescapeString(htmlTag.ReplaceAllString(text, ""))
+		}
+		return len(utf16.Encode([]rune(text)))
+	}
+	if shownLength(params["text"]) > 4096 {
+		return "Bad Request: message is too long"
+	}
+	if shownLength(params["caption"]) > 1024 {
+		return "Bad Request: message caption is too long"
+	}
+	return ""
+}
+
+// result builds the response for call and fills in call.MessageID. Callers
+// must hold s.mu.
+func (s *Server) result(call *Call) any {
+	switch call.Method {
+	case "getMe":
+		return models.User{ID: 123456, IsBot: true, FirstName: "Grandfather", Username: BotUsername}
+	case "sendMessage", "sendPhoto", "sendSticker", "sendVoice", "sendVideo", "sendDocument", "sendLocation":
+		msg := models.Message{
+			ID:      s.nextMessageID,
+			Date:    int(time.Now().Unix()),
+			Chat:    models.Chat{ID: call.ChatID(), Type: models.ChatTypePrivate},
+			Text:    call.Text(),
+			Caption: call.Params["caption"],
+		}
+		call.MessageID = msg.ID
+		s.nextMessageID++
+		return msg
+	case "copyMessage":
+		id := models.MessageID{ID: s.nextMessageID}
+		call.MessageID = id.ID
+		s.nextMessageID++
+		return id
+	case "editMessageText", "editMessageCaption", "editMessageReplyMarkup":
+		call.MessageID, _ = strconv.Atoi(call.Params["message_id"])
+		return models.Message{
+			ID:   call.MessageID,
+			Date: int(time.Now().Unix()),
+			Chat: models.Chat{ID: call.ChatID(), Type: models.ChatTypePrivate},
+			Text: call.Text(),
+		}
+	default:
+		return true
+	}
+}
+
+func writeResult(w http.ResponseWriter, result any) {
+	raw, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"ok":true,"result":%s}`, raw)
+}
+
+func writeError(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `{"ok":false,"error_code":%d,"description":%q}`, code, description)
+}
+
+// NextMessageID reserves a message ID, so messages users send in tests never
+// collide with the ones the bot sent.
+func (s *Server) NextMessageID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextMessageID
+	s.nextMessageID++
+	return id
+}
+
+// Calls returns every request received so far.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// CallsTo returns the requests for method sent to chatID. A chatID of 0
+// matches every chat.
+func (s *Server) CallsTo(method string, chatID int64) []Call {
+	var matched []Call
+	for _, c := range s.Calls() {
+		if c.Method == method && (chatID == 0 || c.ChatID() == chatID) {
+			matched = append(matched, c)
+		}
+	}
+	return matched
+}
+
+// Last returns the most recent request that sent or edited a message in chatID.
+func (s *Server) Last(chatID int64) (Call, bool) {
+	calls := s.Calls()
+	for i := len(calls) - 1; i >= 0; i-- {
+		c := calls[i]
+		if c.ChatID() == chatID && (strings.HasPrefix(c.Method, "send") || strings.HasPrefix(c.Method, "edit")) {
+			return c, true
+		}
+	}
+	return Call{}, false
+}
+
+// Reset forgets every recorded request.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+}
+
+// WaitFor blocks until match returns true for some recorded call or the
+// timeout expires. It is meant for asynchronous senders such as the outbox.
+func (s *Server) WaitFor(timeout time.Duration, match func(Call) bool) (Call, bool) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		for _, c := range s.calls {
+			if match(c) {
+				s.mu.Unlock()
+				return c, true
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return Call{}, false
+		}
+	}
+}
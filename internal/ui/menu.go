@@ -31,7 +31,8 @@ func (m *Menu) PrependButtonRow(text, command string) *Menu {
 }
 
 func (m Menu) ToInlineKeyboard() *models.InlineKeyboardMarkup {
-	var rows [][]models.InlineKeyboardButton
+	// An empty keyboard, rather than none, removes the buttons on edits.
+	rows := [][]models.InlineKeyboardButton{}
 
 	for _, row := range m.Buttons {
 		var btnRow []models.InlineKeyboardButton
@@ -0,0 +1,144 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"grandfather/internal/config"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+// maxUpdateSize bounds the request bodies the webhook reads. Updates are far
+// smaller.
+const maxUpdateSize = 1 << 20
+
+// Handler returns the HTTP handler Telegram delivers updates to. Requests
+// without the configured secret token or with a body that isn't an update
+// are rejected before they reach the bot.
+func Handler(b *bot.Bot, cfg config.WebhookConfig) http.Handler {
+	updates := b.WebhookHandler()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("POST "+cfg.ServePath(), func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.SecretToken)) != 1 {
+			log.Printf("Rejected webhook request from %s: bad secret token\n", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		// The bot answers 200 to bodies it can't decode, which would hide
+		// them from Telegram's getWebhookInfo.
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUpdateSize))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(body, &models.Update{}); err != nil {
+			log.Printf("Rejected webhook request from %s: %v\n", r.RemoteAddr, err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		updates(w, r)
+	})
+	return mux
+}
+
+// Run registers the webhook with Telegram for the allowed kinds of update,
+// serves updates until ctx is done and then shuts the server down, removing
+// the webhook if configured to.
+func Run(ctx context.Context, b *bot.Bot, cfg config.WebhookConfig, allowedUpdates []string) error {
+	if err := register(ctx, b, cfg, allowedUpdates); err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.ListenAddr,
+		Handler:           Handler(b, cfg),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Serving webhook on %s%s\n", cfg.ListenAddr, cfg.ServePath())
+		var err error
+		if cfg.TLSCertFile != "" {
+			err = srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+		}
+		close(serveErr)
+	}()
+
+	go b.StartWebhook(ctx)
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+	case runErr = <-serveErr:
+	}
+
+	// ctx is already cancelled here, so clean up with a fresh deadline.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("webhook server shutdown error:", err)
+	}
+
+	if cfg.DeleteOnShutdown {
+		if _, err := b.DeleteWebhook(shutdownCtx, &bot.DeleteWebhookParams{}); err != nil {
+			log.Println("delete webhook error:", err)
+		} else {
+			log.Println("Webhook deleted")
+		}
+	}
+
+	if runErr != nil {
+		return fmt.Errorf("webhook server: %w", runErr)
+	}
+	return nil
+}
+
+func register(ctx context.Context, b *bot.Bot, cfg config.WebhookConfig, allowedUpdates []string) error {
+	params := &bot.SetWebhookParams{
+		URL:            cfg.URL,
+		SecretToken:    cfg.SecretToken,
+		MaxConnections: cfg.MaxConnections,
+		AllowedUpdates: allowedUpdates,
+	}
+
+	if cfg.SelfSigned {
+		cert, err := os.ReadFile(cfg.TLSCertFile)
+		if err != nil {
+			return fmt.Errorf("read webhook certificate: %w", err)
+		}
+		params.Certificate = &models.InputFileUpload{Filename: "cert.pem", Data: bytes.NewReader(cert)}
+	}
+
+	if _, err := b.SetWebhook(ctx, params); err != nil {
+		return fmt.Errorf("set webhook: %w", err)
+	}
+
+	log.Printf("Webhook registered at %s\n", cfg.URL)
+	return nil
+}
@@ -0,0 +1,104 @@
+package webhook_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"grandfather/internal/config"
+	"grandfather/internal/webhook"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const secret = "s3cret"
+
+// newHandler returns the webhook handler of a bot that reports every update
+// it handles on the returned channel.
+func newHandler(t *testing.T) (http.Handler, <-chan *models.Update) {
+	t.Helper()
+
+	handled := make(chan *models.Update, 1)
+	b, err := bot.New("123:abc",
+		bot.WithSkipGetMe(),
+		bot.WithDefaultHandler(func(ctx context.Context, b *bot.Bot, update *models.Update) {
+			handled <- update
+		}),
+	)
+	if err != nil {
+		t.Fatalf("bot.New: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go b.StartWebhook(ctx)
+
+	cfg := config.WebhookConfig{URL: "https://bot.example.com/hook", SecretToken: secret}
+	return webhook.Handler(b, cfg), handled
+}
+
+func post(handler http.Handler, secretHeader, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(body))
+	if secretHeader != "" {
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secretHeader)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestUpdatesWithTheSecretAreDispatched(t *testing.T) {
+	handler, handled := newHandler(t)
+
+	rec := post(handler, secret, `{"update_id": 7, "message": {"message_id": 1, "chat": {"id": 1001}, "text": "hi"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	select {
+	case update := <-handled:
+		if update.ID != 7 || update.Message.Text != "hi" {
+			t.Errorf("handled update %+v, want update 7", update)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the update was not dispatched")
+	}
+}
+
+func TestRequestsWithoutTheSecretAreRejected(t *testing.T) {
+	handler, handled := newHandler(t)
+
+	for _, header := range []string{"", "wrong"} {
+		if rec := post(handler, header, `{"update_id": 7}`); rec.Code != http.StatusUnauthorized {
+			t.Errorf("secret %q: status = %d, want 401", header, rec.Code)
+		}
+	}
+
+	select {
+	case update := <-handled:
+		t.Fatalf("update %+v was dispatched without the secret", update)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestInvalidJSONIsRejected(t *testing.T) {
+	handler, _ := newHandler(t)
+
+	if rec := post(handler, secret, `{"update_id": `); rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	handler, _ := newHandler(t)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+}
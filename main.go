@@ -2,182 +2,112 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	handlers "grandfather/internal/bot"
-	"grandfather/internal/commands.go"
+	"grandfather/internal/config"
 	"grandfather/internal/db"
-	appModels "grandfather/internal/models"
 	"grandfather/internal/outbox"
+	"grandfather/internal/sender"
 	"grandfather/internal/ui"
+	"grandfather/internal/webhook"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-telegram/bot"
-	"github.com/go-telegram/bot/models"
 )
 
-func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
+// pollTimeout is how long getUpdates waits for new updates.
+const pollTimeout = time.Minute
 
-	opts := []bot.Option{
-		bot.WithDefaultHandler(defaultHandler),
-	}
+// closableStore is a db.Store that has to be closed on shutdown.
+type closableStore interface {
+	db.Store
+	Close(ctx context.Context) error
+}
 
-	b, err := bot.New("8334069842:AAE0GvBFBFPT69R0pPAJvf8n_9PXlkEdQfs", opts...)
-	if err != nil {
-		panic(err)
+// openStore connects to the database the config selects.
+func openStore(ctx context.Context, cfg *config.Config) (closableStore, error) {
+	if cfg.Storage == config.StorageSQLite {
+		return db.NewSQLiteStore(ctx, cfg.SQLite)
 	}
+	return db.NewMongoStore(ctx, cfg.Mongo)
+}
 
-	// --- Register command handlers ---
-	b.RegisterHandler(bot.HandlerTypeMessageText, "start", bot.MatchTypeCommandStartOnly, handlers.StartCommandHandler)
-
-	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, "", bot.MatchTypePrefix, CallbackHandler)
-
-	commands.Router[commands.MainMenuCommand] = handlers.MainMenuCommandHandler
-	commands.Router[commands.StartNewCircleCommand] = handlers.StartNewCircleCommandHandler
-	commands.Router[commands.JoinCircleCommand] = handlers.JoinCircleCommandHandler
-	commands.Router[commands.ListCirclesCommand] = handlers.ListCirclesCommandHandler
-
-	ui.RegisterMenus()
-	outbox := outbox.NewOutbox(ctx, b)
-	defer outbox.Stop()
+func main() {
+	configPath := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "path to a YAML or TOML config file")
+	flag.Parse()
 
-	b.Start(ctx)
+	if err := run(*configPath); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func CallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	if update.CallbackQuery == nil {
-		return
+// run starts the bot and blocks until it is stopped. Failures are returned
+// rather than exiting, so that everything opened so far is closed first.
+func run(configPath string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	cmd := update.CallbackQuery.Data
-
-	if !strings.Contains(cmd, "@") {
-		fmt.Printf("Normal command received: %s\n", cmd)
-		// Check if we have a registered handler
-		if handler, ok := commands.Router[commands.Command(cmd)]; ok {
-			handler(ctx, b, update)
-			return
-		}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-		b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-			CallbackQueryID: update.CallbackQuery.ID,
-			Text:            "Unknown action",
-			ShowAlert:       false,
-		})
-		return
+	store, err := openStore(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open the %s database: %w", cfg.Storage, err)
 	}
-	fmt.Printf("Dynamic command received: %s\n", cmd)
-
-	parts := strings.SplitN(cmd, "@", 2)
-	cmdPrefix, extraData := parts[0], parts[1]
-
-	switch commands.Command(cmdPrefix) {
-	case commands.GetCircleCommand:
-		handlers.GetCircleDetailsHandler(ctx, b, update, extraData)
-	case commands.RemoveUserCommand:
-		handlers.RemoveUserCommandHandler(ctx, b, update, extraData)
-	case commands.RemoveSpecificUserCommand:
-		data := strings.SplitN(extraData, "@", 2)
-		if len(data) != 2 {
-			// Invalid payload, bail out gracefully
-			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-				ChatID: update.Message.Chat.ID,
-				Text:   "❌ Invalid command format.",
-			})
-			return
+	defer func() {
+		if err := store.Close(context.Background()); err != nil {
+			log.Printf("failed to close the %s database: %v", cfg.Storage, err)
 		}
+	}()
 
-		circleName, userIdStr := data[0], data[1]
+	h := handlers.New(store, cfg.Bot)
 
-		// Parse the user ID as int64
-		userIdToRemove, err := strconv.ParseInt(userIdStr, 10, 64)
-		if err != nil {
-			_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-				ChatID: update.Message.Chat.ID,
-				Text:   "❌ Invalid user ID.",
-			})
-			return
-		}
-		handlers.RemoveSpecificUserCommandHandler(ctx, b, update, circleName, userIdToRemove)
-	case commands.GetMemberListCommand:
-		handlers.GetMemberListCommandHandler(ctx, b, update, extraData)
-	case commands.StartNewSessionCommand:
-		handlers.StartNewSessionCommandHandler(ctx, b, update, extraData)
-	case commands.EndSessionCommand:
-		handlers.EndSessionCommandHandler(ctx, b, update, extraData)
-	case commands.RevealMortalCommand:
-		handlers.RevealMortalCommandHandler(ctx, b, update, extraData)
-	case commands.RevealAngelCommand:
-		handlers.RevealAngelCommandHandler(ctx, b, update, extraData)
-	case commands.SendMessageCommandToAngel:
-		handlers.SendMessageToAngelCommandHandler(ctx, b, update, extraData)
-	case commands.SendMessageCommandToMortal:
-		handlers.SendMessageToMortalCommandHandler(ctx, b, update, extraData)
-	default:
-		b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-			CallbackQueryID: update.CallbackQuery.ID,
-			Text:            "Unknown action",
-			ShowAlert:       false,
-		})
-	}
+	// Everything the bot sends goes through the rate limiter, which also
+	// holds the long polling getUpdates requests to pollTimeout.
+	client := sender.New(ctx, &http.Client{Timeout: pollTimeout}, cfg.Telegram.RateLimit)
 
-	_, err := b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
-		CallbackQueryID: update.CallbackQuery.ID,
-	})
+	opts := []bot.Option{
+		bot.WithDefaultHandler(h.DefaultHandler),
+		bot.WithHTTPClient(pollTimeout, client),
+		bot.WithAllowedUpdates(handlers.AllowedUpdates),
+	}
+	if cfg.Telegram.Mode == config.ModeWebhook {
+		opts = append(opts, bot.WithWebhookSecretToken(cfg.Telegram.Webhook.SecretToken))
+	}
 
+	b, err := bot.New(cfg.Telegram.Token, opts...)
 	if err != nil {
-		log.Println("answer callback error:", err)
+		return fmt.Errorf("failed to create the bot: %w", err)
 	}
 
-}
+	// --- Register command handlers ---
+	h.Register(b)
 
-func defaultHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	if update.Message == nil {
-		return
-	}
+	ui.RegisterMenus()
+	outbox := outbox.NewOutbox(ctx, b, store, cfg.Outbox)
+	defer outbox.Stop()
 
-	userID := update.Message.From.ID
-	user, getUserErr := db.GetUser(ctx, userID)
+	go h.RunChatSweeper(ctx)
 
-	if getUserErr != nil {
-		fmt.Printf("failed to get user %d: %v\n", userID, getUserErr)
-		_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   "Have you been registered? If you haven't, run the /start command to begin!",
-		})
-		return
+	if cfg.Telegram.Mode == config.ModeWebhook {
+		if err := webhook.Run(ctx, b, cfg.Telegram.Webhook, handlers.AllowedUpdates); err != nil {
+			return fmt.Errorf("webhook mode failed: %w", err)
+		}
+		return nil
 	}
 
-	state := user.State
-
-	switch state {
-	case appModels.StateWaitingCircleName:
-		handlers.StartNewCircleWithNameCommandHandler(ctx, b, update)
-	case appModels.StateWaitingJoinCircleName:
-		handlers.JoinCircleWithNameCommandHandler(ctx, b, update)
-	case appModels.StateWaitingSendMessageToAngel:
-		handlers.SendMessageToAngelWithMessageCommandHandler(ctx, b, update, user)
-	case appModels.StateWaitingSendMessageToMortal:
-		handlers.SendMessageToMortalWithMessageCommandHandler(ctx, b, update, user)
-	default:
-
-		fmt.Println("ChatID:", update.Message.Chat.ID)
-		fmt.Println("Text:", update.Message.Text)
-
-		user := update.Message.From
-		fmt.Println("User ID:", user.ID)        // unique int64 ID
-		fmt.Println("Username:", user.Username) // may be empty
-		fmt.Println("First name:", user.FirstName)
-		fmt.Println("Last name:", user.LastName)
-
-		_, _ = b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: update.Message.Chat.ID,
-			Text:   "Use /start to load up the menu!",
-		})
+	// getUpdates is refused while a webhook is set, e.g. after switching modes.
+	if _, err := b.DeleteWebhook(ctx, &bot.DeleteWebhookParams{}); err != nil {
+		log.Println("delete webhook error:", err)
 	}
+	b.Start(ctx)
+	return nil
 }
@@ -3,6 +3,7 @@ package utils
 import (
 	"context"
 	"fmt"
+	appModels "grandfather/internal/models"
 	"grandfather/internal/ui"
 	"math/rand"
 	"strings"
@@ -64,6 +65,55 @@ func SendMenu(ctx context.Context, b *bot.Bot, chatID int64, menu ui.Menu) {
 	})
 }
 
+// EditConfirmation brings the sender's confirmation of a relay up to date
+// with the relay's status. Errors are ignored, most often the confirmation
+// already says the same.
+func EditConfirmation(ctx context.Context, b *bot.Bot, message *appModels.Message) {
+	if message.Confirmation == nil || message.Confirmation.MessageId == 0 {
+		return
+	}
+	_, _ = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      message.Confirmation.ChatId,
+		MessageID:   message.Confirmation.MessageId,
+		Text:        message.ConfirmationText(),
+		ReplyMarkup: ui.Menu{Buttons: message.ConfirmationButtons()}.ToInlineKeyboard(),
+	})
+}
+
+// EditRelay makes the delivered copy of a relay in the recipient's chat show
+// the relay's current text or caption. Only those can change; the recipient
+// keeps the file they were sent.
+func EditRelay(ctx context.Context, b *bot.Bot, chatID int64, message *appModels.Message) error {
+	if message.Payload == nil || len(message.DeliveredMessageIds) == 0 {
+		return nil
+	}
+
+	// The content is always the last message the outbox sent.
+	deliveredId := message.DeliveredMessageIds[len(message.DeliveredMessageIds)-1]
+	markup := ui.Menu{Buttons: message.RecipientButtons()}.ToInlineKeyboard()
+
+	var err error
+	switch message.Payload.Type {
+	case appModels.PayloadText:
+		_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:      chatID,
+			MessageID:   deliveredId,
+			Text:        message.DeliveredRelayText(message.Payload.Text, appModels.MaxTextLength),
+			ParseMode:   models.ParseModeHTML,
+			ReplyMarkup: markup,
+		})
+	case appModels.PayloadPhoto, appModels.PayloadVoice, appModels.PayloadVideo, appModels.PayloadDocument:
+		_, err = b.EditMessageCaption(ctx, &bot.EditMessageCaptionParams{
+			ChatID:      chatID,
+			MessageID:   deliveredId,
+			Caption:     message.DeliveredRelayText(message.Payload.Caption, appModels.MaxCaptionLength),
+			ParseMode:   models.ParseModeHTML,
+			ReplyMarkup: markup,
+		})
+	}
+	return err
+}
+
 func IsValidOnlyAlphanumericAndSpaces(name string) bool {
 	if len(name) == 0 {
 		return false
@@ -91,3 +141,13 @@ func EscapeMarkdownV2(text string) string {
 	}
 	return text
 }
+
+// Excerpt shortens text to at most length characters, marking the cut with
+// an ellipsis.
+func Excerpt(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length-1]) + "…"
+}